@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/harrydayexe/Omni/internal/loadbalancer"
 )
@@ -12,6 +19,7 @@ import (
 func main() {
 	verbose := flag.Bool("v", false, "verbose")
 	fptr := flag.String("config", "config.yaml", "file path to read the config from")
+	watchInterval := flag.Duration("watch-interval", 5*time.Second, "how often to check the config file for changes, 0 to disable")
 	flag.Parse()
 
 	var logLevel slog.Leveler
@@ -38,11 +46,128 @@ func main() {
 	if err != nil {
 		panic("could not create router")
 	}
+	defer router.Close()
 
-	server := &http.Server{
-		Handler: router,
+	// Stop on SIGINT or SIGTERM, letting requests in flight finish
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	router.StartHealthChecks(ctx)
+
+	// Reload the config when the file changes or on SIGHUP. A config which
+	// fails to load is logged and the running config is kept.
+	reload := func(reason string) {
+		logger.Info("Reloading config", slog.String("configFile", *fptr), slog.String("reason", reason))
+		if err := router.ReloadFromFile(*fptr); err != nil {
+			logger.Error("Could not reload config", slog.String("configFile", *fptr), slog.Any("error", err))
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reload("SIGHUP")
+		}
+	}()
+
+	if *watchInterval > 0 {
+		go func() {
+			err := loadbalancer.WatchFile(ctx, *fptr, *watchInterval, func() {
+				reload("config file changed")
+			})
+			if err != nil {
+				logger.Error("Could not watch config", slog.String("configFile", *fptr), slog.Any("error", err))
+			}
+		}()
+	}
+
+	server, certs, err := config.Server.NewHTTPServer(router, logger)
+	if err != nil {
+		logger.Error("Could not create server", slog.Any("error", err))
+		panic("could not create server")
+	}
+	if certs != nil && *watchInterval > 0 {
+		certs.Watch(ctx, *watchInterval)
+	}
+	servers := []*http.Server{server}
+
+	// User traffic may come through a load balancer using the PROXY protocol
+	public := map[*http.Server]bool{server: true}
+	if redirect := config.Server.NewRedirectServer(); redirect != nil {
+		servers = append(servers, redirect)
+		public[redirect] = true
 	}
 
-	logger.Info("Starting server")
-	err = server.ListenAndServe()
+	// The control endpoints are only served on their own listener, so they
+	// can be kept off the network user traffic arrives on
+	if config.Admin.Address != "" {
+		tlsConfig, err := config.Admin.TLSConfig()
+		if err != nil {
+			logger.Error("Could not load admin TLS config", slog.Any("error", err))
+			panic("could not load admin TLS config")
+		}
+		if tlsConfig == nil {
+			logger.Warn("Admin listener is not using TLS, bearer tokens are sent in plain text")
+		}
+
+		servers = append(servers, &http.Server{
+			Addr:              config.Admin.Address,
+			Handler:           router.AdminHandler(),
+			TLSConfig:         tlsConfig,
+			ReadHeaderTimeout: 10 * time.Second,
+		})
+	} else {
+		logger.Warn("No admin address is configured, the admin endpoints are disabled")
+	}
+
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			logger.Info("Starting server", slog.String("address", srv.Addr), slog.Bool("tls", srv.TLSConfig != nil))
+			var listener net.Listener
+			var err error
+			if public[srv] {
+				listener, err = config.Server.Listen(srv.Addr)
+			} else {
+				listener, err = net.Listen("tcp", srv.Addr)
+			}
+			if err == nil {
+				if srv.TLSConfig != nil {
+					err = srv.ServeTLS(listener, "", "")
+				} else {
+					err = srv.Serve(listener)
+				}
+			}
+			if err != nil && err != http.ErrServerClosed {
+				errs <- fmt.Errorf("server on %s stopped: %w", srv.Addr, err)
+			}
+		}(srv)
+	}
+
+	select {
+	case <-ctx.Done():
+		logger.Info("Shutting down")
+	case err := <-errs:
+		logger.Error("Shutting down", slog.Any("error", err))
+	}
+
+	shutdownTimeout := config.Server.ShutdownTimeout
+	if shutdownTimeout == 0 {
+		shutdownTimeout = 30 * time.Second
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				logger.Error("Could not shut down server", slog.String("address", srv.Addr), slog.Any("error", err))
+			}
+		}(srv)
+	}
+	wg.Wait()
 }
@@ -0,0 +1,308 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var XRequestID = http.CanonicalHeaderKey("X-Request-Id")
+
+// The formats access logs can be written in
+const (
+	accessLogJSON     = "json"
+	accessLogCombined = "combined"
+)
+
+// An AccessLogger writes one record for every request proxied to a route, in
+// JSON or the Combined Log Format. It is kept apart from the slog output so
+// the records can be shipped and parsed on their own.
+type AccessLogger struct {
+	format string
+	mu     sync.Mutex // Keeps records from interleaving
+	out    io.Writer
+	file   *os.File // Nil when writing to stdout
+}
+
+// NewAccessLogger opens the access log described by spec, or returns nil if
+// access logging is off
+func NewAccessLogger(spec AccessLog) (*AccessLogger, error) {
+	if spec.Format == "" {
+		return nil, nil
+	}
+	if spec.File == "" {
+		return &AccessLogger{format: spec.Format, out: os.Stdout}, nil
+	}
+
+	file, err := os.OpenFile(spec.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open access log: %w", err)
+	}
+	return &AccessLogger{format: spec.Format, out: file, file: file}, nil
+}
+
+// Close closes the access log file. It is safe to call on a nil AccessLogger.
+func (l *AccessLogger) Close() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// An accessRecord gathers what happens to a request as it is proxied. The
+// proxy fills in the route and backend through the request context.
+type accessRecord struct {
+	start     time.Time
+	requestID string
+	route     string
+	backend   string
+	tries     int
+	connect   time.Duration // Until the connection to the last backend was ready
+	upstream  time.Duration // Until the last backend finished responding
+	bytesIn   atomic.Int64
+}
+
+type accessRecordKey struct{}
+
+// accessRecordFrom returns the record of the request, or nil if the request
+// is not being logged
+func accessRecordFrom(ctx context.Context) *accessRecord {
+	record, _ := ctx.Value(accessRecordKey{}).(*accessRecord)
+	return record
+}
+
+// traceTry records the backend of a try and when its connection was ready.
+// The returned function records when the backend finished responding.
+func (a *accessRecord) traceTry(ctx context.Context, backend string) (context.Context, func()) {
+	start := time.Now()
+	a.backend = backend
+	a.tries++
+	a.connect = 0
+
+	var gotConn atomic.Int64
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			gotConn.CompareAndSwap(0, int64(time.Since(start)))
+		},
+	})
+	return ctx, func() {
+		a.connect = time.Duration(gotConn.Load())
+		a.upstream = time.Since(start)
+	}
+}
+
+// serve passes the request to next and logs it if it was handled by a proxy.
+// Each request is given an X-Request-Id, unless it already has a valid one,
+// which is sent to the backend and returned to the client so the two can be
+// matched up with the log. Nothing is changed when l is nil.
+func (l *AccessLogger) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	if l == nil {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	requestID := r.Header.Get(XRequestID)
+	if !validRequestID(requestID) {
+		requestID = newRequestID()
+		r.Header.Set(XRequestID, requestID)
+	}
+	w.Header().Set(XRequestID, requestID)
+
+	record := &accessRecord{start: time.Now(), requestID: requestID}
+	r.Body = &countingReader{ReadCloser: r.Body, n: &record.bytesIn}
+	rec := &accessRecorder{ResponseWriter: w}
+	next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessRecordKey{}, record)))
+
+	// Requests which did not reach a proxy, such as /livez, are not logged
+	if record.route != "" {
+		l.write(r, rec, record)
+	}
+}
+
+func (l *AccessLogger) write(r *http.Request, rec *accessRecorder, record *accessRecord) {
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	var line []byte
+	switch l.format {
+	case accessLogJSON:
+		line, _ = json.Marshal(accessLogEntry{
+			Time:                 record.start.UTC().Format(time.RFC3339Nano),
+			RequestID:            record.requestID,
+			ClientIP:             clientIP(r),
+			Method:               r.Method,
+			Host:                 r.Host,
+			URI:                  r.RequestURI,
+			Protocol:             r.Proto,
+			Status:               status,
+			BytesIn:              record.bytesIn.Load(),
+			BytesOut:             rec.bytes,
+			Duration:             time.Since(record.start).Seconds(),
+			Route:                record.route,
+			Backend:              record.backend,
+			Tries:                record.tries,
+			UpstreamConnectTime:  record.connect.Seconds(),
+			UpstreamResponseTime: record.upstream.Seconds(),
+			Referer:              r.Referer(),
+			UserAgent:            r.UserAgent(),
+		})
+	default:
+		line = []byte(combinedLogLine(r, status, rec.bytes, record))
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(line)
+}
+
+// An accessLogEntry is a record in the JSON format. Times are in seconds.
+type accessLogEntry struct {
+	Time                 string  `json:"time"`
+	RequestID            string  `json:"request_id"`
+	ClientIP             string  `json:"client_ip"`
+	Method               string  `json:"method"`
+	Host                 string  `json:"host"`
+	URI                  string  `json:"uri"`
+	Protocol             string  `json:"protocol"`
+	Status               int     `json:"status"`
+	BytesIn              int64   `json:"bytes_in"`
+	BytesOut             int64   `json:"bytes_out"`
+	Duration             float64 `json:"duration"`
+	Route                string  `json:"route"`
+	Backend              string  `json:"backend,omitempty"` // Empty if no backend was tried
+	Tries                int     `json:"tries"`
+	UpstreamConnectTime  float64 `json:"upstream_connect_time"`
+	UpstreamResponseTime float64 `json:"upstream_response_time"`
+	Referer              string  `json:"referer,omitempty"`
+	UserAgent            string  `json:"user_agent,omitempty"`
+}
+
+// combinedLogLine formats a record in the Combined Log Format, followed by
+// the fields it has no place for as quoted key=value pairs
+func combinedLogLine(r *http.Request, status int, bytesOut int64, record *accessRecord) string {
+	size := "-"
+	if bytesOut > 0 {
+		size = strconv.FormatInt(bytesOut, 10)
+	}
+
+	// The load balancer does not authenticate users, so the identity and user
+	// fields are always empty
+	return fmt.Sprintf(`%s - - [%s] %s %d %s %s %s request_id=%s route=%s backend=%s bytes_in=%d duration=%.3f upstream_connect_time=%.3f upstream_response_time=%.3f`,
+		clientIP(r),
+		record.start.Format("02/Jan/2006:15:04:05 -0700"),
+		logQuote(r.Method+" "+r.RequestURI+" "+r.Proto),
+		status,
+		size,
+		logQuote(r.Referer()),
+		logQuote(r.UserAgent()),
+		logQuote(record.requestID),
+		logQuote(record.route),
+		logQuote(record.backend),
+		record.bytesIn.Load(),
+		time.Since(record.start).Seconds(),
+		record.connect.Seconds(),
+		record.upstream.Seconds(),
+	)
+}
+
+// logQuote quotes a field of a Combined Log Format line, escaping quotes and
+// control characters so a client cannot forge a record
+func logQuote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+// The longest X-Request-Id a client can set which is kept
+const maxRequestIDLength = 128
+
+// validRequestID reports whether an X-Request-Id set by the client can be
+// kept. Only short IDs of letters, digits and -_.: are, so clients cannot
+// flood the log or slip anything into it.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random 128-bit ID in hex
+func newRequestID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// An accessRecorder records the status and size of the response
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *accessRecorder) WriteHeader(status int) {
+	// Informational responses such as 103 Early Hints come before the final one
+	if r.status == 0 && status >= 200 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *accessRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (r *accessRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Hijack records the switch to another protocol, see responseRecorder
+func (r *accessRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err == nil {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+// A countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,143 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAccessLogJSON(t *testing.T) {
+	var backendRequestID string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendRequestID = r.Header.Get(XRequestID)
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	defer backend.Close()
+
+	file := filepath.Join(t.TempDir(), "access.log")
+	lb := newTestLoadBalancer(t, Config{
+		Algorithm: "round-robin",
+		Paths:     []Route{{Pattern: "POST /post", Backends: []Backend{{Address: backend.URL}}}},
+		AccessLog: AccessLog{Format: "json", File: file},
+	})
+	defer lb.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/post?draft=true", strings.NewReader(`{"title":"hello"}`))
+	req.RemoteAddr = "203.0.113.7:51234"
+	rr := httptest.NewRecorder()
+	lb.ServeHTTP(rr, req)
+	lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/livez", nil))
+
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one record for the proxied request, got %q", contents)
+	}
+
+	var entry accessLogEntry
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entry.Route != "POST /post" || entry.Backend != backend.URL || entry.Tries != 1 {
+		t.Errorf("expected the route and backend to be logged, got %+v", entry)
+	}
+	if entry.Status != http.StatusCreated || entry.BytesIn != 17 || entry.BytesOut != 7 {
+		t.Errorf("expected the status and sizes to be logged, got %+v", entry)
+	}
+	if entry.ClientIP != "203.0.113.7" || entry.URI != "/post?draft=true" || entry.Method != http.MethodPost {
+		t.Errorf("expected the request to be logged, got %+v", entry)
+	}
+	if entry.UpstreamResponseTime <= 0 || entry.UpstreamConnectTime <= 0 {
+		t.Errorf("expected upstream times to be logged, got %+v", entry)
+	}
+	if entry.RequestID == "" || entry.RequestID != backendRequestID || entry.RequestID != rr.Header().Get(XRequestID) {
+		t.Errorf("expected the request ID %q to reach the backend and the client, got %q and %q", entry.RequestID, backendRequestID, rr.Header().Get(XRequestID))
+	}
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	lb := newTestLoadBalancer(t, Config{Algorithm: "round-robin", Paths: patterns("GET /post/{id}")})
+	var out strings.Builder
+	lb.accessLog = &AccessLogger{format: "combined", out: &out}
+
+	req := httptest.NewRequest(http.MethodGet, "/post/1", nil)
+	req.RemoteAddr = "203.0.113.7:51234"
+	req.Header.Set(XRequestID, "abc123")
+	req.Header.Set("User-Agent", `curl/8.0 "quoted"`)
+	lb.ServeHTTP(httptest.NewRecorder(), req)
+
+	// There are no backends, so the route replies itself
+	pattern := regexp.MustCompile(`^203\.0\.113\.7 - - \[[^\]]+\] "GET /post/1 HTTP/1\.1" 502 \d+ "-" "curl/8\.0 \\"quoted\\"" ` +
+		`request_id="abc123" route="GET /post/\{id\}" backend="-" bytes_in=0 duration=[0-9.]+ upstream_connect_time=0\.000 upstream_response_time=0\.000\n$`)
+	if !pattern.MatchString(out.String()) {
+		t.Errorf("unexpected record %q", out.String())
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var backendRequestID string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendRequestID = r.Header.Get(XRequestID)
+	}))
+	defer backend.Close()
+
+	cases := []struct {
+		name      string
+		logging   bool
+		requestID string
+		want      string // Empty for a new ID
+	}{
+		{name: "logging off", requestID: "abc123", want: "abc123"},
+		{name: "new id", logging: true},
+		{name: "client id", logging: true, requestID: "f47ac10b-58cc-4372-a567-0e02b2c3d479", want: "f47ac10b-58cc-4372-a567-0e02b2c3d479"},
+		{name: "client id too long", logging: true, requestID: strings.Repeat("a", maxRequestIDLength+1)},
+		{name: "client id with spaces", logging: true, requestID: `abc" injected="1`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := newTestLoadBalancer(t, Config{
+				Algorithm: "round-robin",
+				Paths:     []Route{{Pattern: "GET /post/{id}", Backends: []Backend{{Address: backend.URL}}}},
+			})
+			if tt.logging {
+				lb.accessLog = &AccessLogger{format: "combined", out: io.Discard}
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/post/1", nil)
+			if tt.requestID != "" {
+				req.Header.Set(XRequestID, tt.requestID)
+			}
+			rr := httptest.NewRecorder()
+			lb.ServeHTTP(rr, req)
+
+			got := rr.Header().Get(XRequestID)
+			if !tt.logging {
+				if got != "" || backendRequestID != tt.want {
+					t.Errorf("expected the request ID to be left alone, got %q to the client and %q to the backend", got, backendRequestID)
+				}
+				return
+			}
+			if got != backendRequestID {
+				t.Errorf("expected the client and backend to get the same ID, got %q and %q", got, backendRequestID)
+			}
+			if tt.want != "" && got != tt.want {
+				t.Errorf("expected the client's ID %q to be kept, got %q", tt.want, got)
+			}
+			if tt.want == "" && (got == tt.requestID || !validRequestID(got)) {
+				t.Errorf("expected a new ID, got %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+type callerKey struct{}
+
+// AdminHandler serves the control endpoints of the load balancer, such as
+// /addz and /removez, and its metrics. Every request must carry one of the
+// bearer tokens from the admin config or a verified client certificate. It
+// should be served on the admin address rather than alongside the proxied
+// paths.
+func (loadBalancer *LoadBalancer) AdminHandler() http.Handler {
+	return loadBalancer.authenticate(loadBalancer.adminMux)
+}
+
+func (loadBalancer *LoadBalancer) buildAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /addz", func(w http.ResponseWriter, r *http.Request) {
+		loadBalancer.addBackend(w, r)
+	})
+	mux.HandleFunc("DELETE /removez", func(w http.ResponseWriter, r *http.Request) {
+		loadBalancer.removeBackend(w, r)
+	})
+	mux.HandleFunc("PUT /weightz", func(w http.ResponseWriter, r *http.Request) {
+		loadBalancer.setGroupWeights(w, r)
+	})
+	mux.HandleFunc("GET /breakerz", func(w http.ResponseWriter, r *http.Request) {
+		loadBalancer.breakerz(w, r)
+	})
+	mux.HandleFunc("GET /backendz", func(w http.ResponseWriter, r *http.Request) {
+		loadBalancer.backendz(w, r)
+	})
+	mux.HandleFunc("GET /routez", func(w http.ResponseWriter, r *http.Request) {
+		loadBalancer.routez(w, r)
+	})
+	// Metrics name every backend and its health, so they are only served to
+	// callers of the admin listener
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		loadBalancer.metrics(w, r)
+	})
+	return mux
+}
+
+// authenticate only passes on requests from known callers, recording who
+// they are in the request context. Tokens are read from the current config so
+// they can be changed by a reload.
+func (loadBalancer *LoadBalancer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := loadBalancer.identify(r)
+		if !ok {
+			loadBalancer.Logger.WarnContext(r.Context(), "rejecting unauthenticated admin request",
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("remote_addr", r.RemoteAddr),
+			)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="omni-loadbalancer"`)
+			writeJSONError(w, http.StatusUnauthorized, "A valid bearer token or client certificate is required.")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), callerKey{}, identity)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// identify returns the identity of the caller, which is the common name of a
+// verified client certificate or the name of the bearer token used
+func (loadBalancer *LoadBalancer) identify(r *http.Request) (string, bool) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		return "cert:" + r.TLS.VerifiedChains[0][0].Subject.CommonName, true
+	}
+
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+
+	loadBalancer.RLock()
+	defer loadBalancer.RUnlock()
+	for name, expected := range loadBalancer.Config.Admin.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+			return "token:" + name, true
+		}
+	}
+	return "", false
+}
+
+// caller returns the identity of the caller of an admin request
+func caller(ctx context.Context) string {
+	identity, ok := ctx.Value(callerKey{}).(string)
+	if !ok {
+		return "unknown"
+	}
+	return identity
+}
+
+// TLSConfig builds the TLS config for the admin listener, or returns nil if
+// it is served without TLS. Callers with a client certificate signed by the
+// client CA are verified, and if there are no tokens a certificate is
+// required.
+func (a *Admin) TLSConfig() (*tls.Config, error) {
+	if a.TLS.CertFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(a.TLS.CertFile, a.TLS.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load admin certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if a.TLS.ClientCAFile != "" {
+		pem, err := os.ReadFile(a.TLS.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read admin client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("admin client CA file contains no certificates")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if len(a.Tokens) == 0 {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,163 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newAdminTestLoadBalancer(t *testing.T, logs *bytes.Buffer) *LoadBalancer {
+	t.Helper()
+	config := Config{
+		Algorithm: "round-robin",
+		Paths:     patterns("GET /"),
+		Admin: Admin{
+			Address: ":9090",
+			Tokens:  map[string]string{"deploy-bot": "s3cret"},
+		},
+	}
+	lb, err := New(config, slog.New(slog.NewJSONHandler(logs, nil)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return lb
+}
+
+func TestAdminHandlerAuthentication(t *testing.T) {
+	lb := newAdminTestLoadBalancer(t, &bytes.Buffer{})
+
+	cases := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{name: "no token", want: http.StatusUnauthorized},
+		{name: "wrong token", authorization: "Bearer wrong", want: http.StatusUnauthorized},
+		{name: "wrong scheme", authorization: "Basic s3cret", want: http.StatusUnauthorized},
+		{name: "valid token", authorization: "Bearer s3cret", want: http.StatusOK},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/routez", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rr := httptest.NewRecorder()
+			lb.AdminHandler().ServeHTTP(rr, req)
+
+			if rr.Code != tt.want {
+				t.Fatalf("got %d, want %d", rr.Code, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("expected a WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestAdminEndpointsNotOnPublicListener(t *testing.T) {
+	lb := newAdminTestLoadBalancer(t, &bytes.Buffer{})
+
+	req := httptest.NewRequest(http.MethodPost, "/addz", strings.NewReader(`{"path":"GET /","address":"http://evil:80"}`))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rr := httptest.NewRecorder()
+	lb.ServeHTTP(rr, req)
+
+	if rr.Code == http.StatusCreated {
+		t.Fatalf("expected /addz not to be served on the public listener")
+	}
+	if lb.Proxies["GET /"].balancer.Len() != 0 {
+		t.Errorf("expected no backend to be added")
+	}
+}
+
+func TestAdminLogsCaller(t *testing.T) {
+	var logs bytes.Buffer
+	lb := newAdminTestLoadBalancer(t, &logs)
+
+	req := httptest.NewRequest(http.MethodPost, "/addz", strings.NewReader(`{"path":"GET /","address":"http://omniread:80"}`))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rr := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("got %d, want %d", rr.Code, http.StatusCreated)
+	}
+	if !strings.Contains(logs.String(), `"caller":"token:deploy-bot"`) {
+		t.Errorf("expected the caller to be logged, got %s", logs.String())
+	}
+}
+
+func TestAdminClientCertificate(t *testing.T) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "omni admin CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	clientKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "ops-laptop"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTemplate, caCert, &clientKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var logs bytes.Buffer
+	lb := newAdminTestLoadBalancer(t, &logs)
+
+	server := httptest.NewUnstartedServer(lb.AdminHandler())
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	server.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	server.StartTLS()
+	defer server.Close()
+
+	client := server.Client()
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{{
+		Certificate: [][]byte{clientDER},
+		PrivateKey:  clientKey,
+	}}
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/addz", strings.NewReader(`{"path":"GET /","address":"http://omniread:80"}`))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+	if !strings.Contains(logs.String(), `"caller":"cert:ops-laptop"`) {
+		t.Errorf("expected the certificate to identify the caller, got %s", logs.String())
+	}
+}
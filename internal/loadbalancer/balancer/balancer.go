@@ -3,7 +3,9 @@ package balancer
 import (
 	"errors"
 	"net/url"
+	"slices"
 	"sync"
+	"time"
 )
 
 var (
@@ -18,6 +20,47 @@ type Balancer interface {
 	Remove(*url.URL)            // Remove a server from the load balancer
 	Balance() (*url.URL, error) // Return the next server to use
 	Len() int                   // Return the number of servers in the load balancer
+	Servers() []*url.URL        // Return a copy of the servers in the load balancer
+}
+
+// A ConnectionTracker is a Balancer which needs to be told when a request to
+// one of its servers starts and finishes
+type ConnectionTracker interface {
+	Inc(*url.URL)  // A request has been sent to the server
+	Done(*url.URL) // A request to the server has finished
+}
+
+// A LatencyObserver is a Balancer which is told how long each request to one
+// of its servers took
+type LatencyObserver interface {
+	Observe(*url.URL, time.Duration) // A request to the server finished after the duration
+}
+
+// A KeyBalancer is a Balancer which consistently maps a key, such as a user
+// or post identifier, to the same server
+type KeyBalancer interface {
+	BalanceKey(key string) (*url.URL, error) // Return the server for the key
+}
+
+// ServerOptions carries per-server metadata for balancers which make use of it
+type ServerOptions struct {
+	Weight        int // Relative share of traffic the server should receive
+	MaxConcurrent int // Requests the proxy sends the server at once, zero for the limit of the route, not used by balancers
+}
+
+// An OptionsBalancer is a Balancer which makes use of per-server metadata
+type OptionsBalancer interface {
+	AddWithOptions(*url.URL, ServerOptions) // Add a new server, or update the options of an existing one
+}
+
+// AddServer adds a server to the balancer, passing on the options if the
+// balancer supports them
+func AddServer(b Balancer, server *url.URL, options ServerOptions) {
+	if ob, ok := b.(OptionsBalancer); ok {
+		ob.AddWithOptions(server, options)
+		return
+	}
+	b.Add(server)
 }
 
 var factories = make(map[string]func() Balancer)
@@ -31,6 +74,12 @@ func BuildBalancer(algorithm string) (Balancer, error) {
 	return fac(), nil
 }
 
+// IsSupported reports whether a balancer is registered for the algorithm
+func IsSupported(algorithm string) bool {
+	_, ok := factories[algorithm]
+	return ok
+}
+
 type BaseBalancer struct {
 	sync.RWMutex
 	servers []*url.URL
@@ -67,3 +116,9 @@ func (b *BaseBalancer) Len() int {
 	defer b.RUnlock()
 	return len(b.servers)
 }
+
+func (b *BaseBalancer) Servers() []*url.URL {
+	b.RLock()
+	defer b.RUnlock()
+	return slices.Clone(b.servers)
+}
@@ -20,3 +20,117 @@ func TestBaseBalancer_Len(t *testing.T) {
 		t.Errorf("expected 2, got %v", b.Len())
 	}
 }
+
+func TestBaseBalancer_Servers(t *testing.T) {
+	// Test that the Servers method returns a copy the caller can change
+	b := &BaseBalancer{}
+	b.Add(&url.URL{Host: "localhost:8080"})
+	servers := b.Servers()
+	servers[0] = &url.URL{Host: "localhost:4040"}
+	if got := b.Servers(); len(got) != 1 || got[0].Host != "localhost:8080" {
+		t.Errorf("expected the servers to be unchanged, got %v", got)
+	}
+}
+
+func TestIsSupported(t *testing.T) {
+	cases := []struct {
+		algorithm string
+		want      bool
+	}{
+		{algorithm: "round-robin", want: true},
+		{algorithm: "least-connections", want: true},
+		{algorithm: "weighted-round-robin", want: true},
+		{algorithm: "consistent-hash", want: true},
+		{algorithm: "p2c-ewma", want: true},
+		{algorithm: "unsupported", want: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.algorithm, func(t *testing.T) {
+			if got := IsSupported(c.algorithm); got != c.want {
+				t.Errorf("expected %v, got %v", c.want, got)
+			}
+		})
+	}
+}
+
+func TestLeastConnectionsBalance(t *testing.T) {
+	first := &url.URL{Scheme: "http", Host: "localhost:8080"}
+	second := &url.URL{Scheme: "http", Host: "localhost:4040"}
+
+	bal, err := BuildBalancer("least-connections")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := bal.Balance(); err != NoHealthyHostsError {
+		t.Errorf("expected NoHealthyHostsError, got %v", err)
+	}
+
+	bal.Add(first)
+	bal.Add(second)
+	tracker, ok := bal.(ConnectionTracker)
+	if !ok {
+		t.Fatalf("expected least-connections balancer to be a ConnectionTracker")
+	}
+
+	// Keep a long request open on the first server, every new request
+	// should then go to the second
+	tracker.Inc(first)
+	for i := 0; i < 3; i++ {
+		got, err := bal.Balance()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got.String() != second.String() {
+			t.Errorf("expected %v, got %v", second, got)
+		}
+	}
+
+	// Once the second server is busier, the first should be picked
+	tracker.Inc(second)
+	tracker.Inc(second)
+	got, _ := bal.Balance()
+	if got.String() != first.String() {
+		t.Errorf("expected %v, got %v", first, got)
+	}
+
+	// When every request finishes both servers should be used again
+	tracker.Done(first)
+	tracker.Done(second)
+	tracker.Done(second)
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		got, _ := bal.Balance()
+		seen[got.String()] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("expected both servers to be used when idle, got %v", seen)
+	}
+}
+
+func TestLeastConnectionsDoneNeverNegative(t *testing.T) {
+	server := &url.URL{Scheme: "http", Host: "localhost:8080"}
+	bal := NewLeastConnectionsBalancer().(*LeastConnectionsBalancer)
+	bal.Add(server)
+
+	bal.Done(server)
+	if bal.conns[server.String()] != 0 {
+		t.Errorf("expected 0 connections, got %d", bal.conns[server.String()])
+	}
+}
+
+func TestLeastConnectionsRemove(t *testing.T) {
+	server := &url.URL{Scheme: "http", Host: "localhost:8080"}
+	bal := NewLeastConnectionsBalancer().(*LeastConnectionsBalancer)
+	bal.Add(server)
+	bal.Inc(server)
+
+	bal.Remove(server)
+	if bal.Len() != 0 {
+		t.Errorf("expected 0 servers, got %d", bal.Len())
+	}
+	if _, ok := bal.conns[server.String()]; ok {
+		t.Errorf("expected connection count to be removed")
+	}
+}
@@ -0,0 +1,139 @@
+package balancer
+
+import (
+	"hash/fnv"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// The number of points each unit of weight places on the ring. More points
+// give a more even spread of keys at the cost of a larger ring.
+const virtualNodes = 160
+
+// A ConsistentHashBalancer maps keys onto a hash ring with virtual nodes, so
+// that the same key keeps landing on the same server. Adding or removing a
+// server only moves the keys on its own share of the ring, about 1/N of them.
+type ConsistentHashBalancer struct {
+	BaseBalancer
+	weights map[string]int
+	ring    []ringPoint
+	current atomic.Uint64
+}
+
+type ringPoint struct {
+	hash   uint64
+	server *url.URL
+}
+
+func (c *ConsistentHashBalancer) Add(server *url.URL) {
+	c.AddWithOptions(server, ServerOptions{Weight: 1})
+}
+
+func (c *ConsistentHashBalancer) AddWithOptions(server *url.URL, options ServerOptions) {
+	c.BaseBalancer.Add(server)
+
+	weight := options.Weight
+	if weight < 1 {
+		weight = 1
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.weights == nil {
+		c.weights = make(map[string]int)
+	}
+	c.weights[server.String()] = weight
+	c.buildRing()
+}
+
+func (c *ConsistentHashBalancer) Remove(server *url.URL) {
+	c.BaseBalancer.Remove(server)
+
+	c.Lock()
+	defer c.Unlock()
+	delete(c.weights, server.String())
+	c.buildRing()
+}
+
+// Balance is used when a request carries no key, it falls back to round robin
+func (c *ConsistentHashBalancer) Balance() (*url.URL, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if len(c.servers) == 0 {
+		return &url.URL{}, NoHealthyHostsError
+	}
+
+	i := c.current.Add(1) % uint64(len(c.servers))
+	return c.servers[i], nil
+}
+
+func (c *ConsistentHashBalancer) BalanceKey(key string) (*url.URL, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if len(c.ring) == 0 {
+		return &url.URL{}, NoHealthyHostsError
+	}
+
+	h := hashKey(key)
+	i := sort.Search(len(c.ring), func(i int) bool { return c.ring[i].hash >= h })
+	if i == len(c.ring) {
+		i = 0
+	}
+	return c.ring[i].server, nil
+}
+
+// buildRing must be called with the lock held
+func (c *ConsistentHashBalancer) buildRing() {
+	ring := make([]ringPoint, 0, len(c.servers)*virtualNodes)
+	for _, server := range c.servers {
+		name := server.String()
+		for i := 0; i < c.weights[name]*virtualNodes; i++ {
+			ring = append(ring, ringPoint{
+				hash:   hashKey(name + "#" + strconv.Itoa(i)),
+				server: server,
+			})
+		}
+	}
+	slices.SortFunc(ring, func(a, b ringPoint) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		}
+		return 0
+	})
+	c.ring = ring
+}
+
+// hashKey hashes with FNV-1a and then applies the splitmix64 finaliser, as
+// FNV alone clusters similar strings such as "host#1" and "host#2"
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func NewConsistentHashBalancer() Balancer {
+	return &ConsistentHashBalancer{
+		BaseBalancer: BaseBalancer{
+			servers: []*url.URL{},
+		},
+		weights: make(map[string]int),
+	}
+}
+
+func init() {
+	factories["consistent-hash"] = NewConsistentHashBalancer
+}
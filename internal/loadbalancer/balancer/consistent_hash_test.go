@@ -0,0 +1,152 @@
+package balancer
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+)
+
+func buildConsistentHash(t *testing.T, n int) (Balancer, []*url.URL) {
+	t.Helper()
+	bal, err := BuildBalancer("consistent-hash")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	servers := make([]*url.URL, n)
+	for i := range servers {
+		servers[i] = &url.URL{Scheme: "http", Host: fmt.Sprintf("omniread-%d:80", i)}
+		bal.Add(servers[i])
+	}
+	return bal, servers
+}
+
+func assignKeys(t *testing.T, bal Balancer, keys int) map[string]string {
+	t.Helper()
+	kb := bal.(KeyBalancer)
+	assignment := make(map[string]string, keys)
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("post-%d", i)
+		server, err := kb.BalanceKey(key)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assignment[key] = server.String()
+	}
+	return assignment
+}
+
+func TestConsistentHashBalanceKeyIsStable(t *testing.T) {
+	bal, _ := buildConsistentHash(t, 5)
+	kb := bal.(KeyBalancer)
+
+	first, _ := kb.BalanceKey("1234")
+	for i := 0; i < 10; i++ {
+		got, _ := kb.BalanceKey("1234")
+		if got.String() != first.String() {
+			t.Fatalf("expected key to stay on %v, got %v", first, got)
+		}
+	}
+}
+
+func TestConsistentHashBalanceNoServers(t *testing.T) {
+	bal := NewConsistentHashBalancer()
+	if _, err := bal.Balance(); err != NoHealthyHostsError {
+		t.Errorf("expected NoHealthyHostsError, got %v", err)
+	}
+	if _, err := bal.(KeyBalancer).BalanceKey("key"); err != NoHealthyHostsError {
+		t.Errorf("expected NoHealthyHostsError, got %v", err)
+	}
+}
+
+func TestConsistentHashSpread(t *testing.T) {
+	const n, keys = 5, 10000
+	bal, _ := buildConsistentHash(t, n)
+
+	counts := make(map[string]int)
+	for _, server := range assignKeys(t, bal, keys) {
+		counts[server]++
+	}
+
+	// Each server should own roughly 1/N of the keys
+	for server, count := range counts {
+		share := float64(count) / keys
+		if share < 0.5/n || share > 1.5/n {
+			t.Errorf("server %s owns %.3f of the keys, expected about %.3f", server, share, 1.0/n)
+		}
+	}
+}
+
+func TestConsistentHashAddMovesOnlyOneNth(t *testing.T) {
+	const n, keys = 10, 10000
+	bal, _ := buildConsistentHash(t, n)
+	before := assignKeys(t, bal, keys)
+
+	added := &url.URL{Scheme: "http", Host: "omniread-new:80"}
+	bal.Add(added)
+	after := assignKeys(t, bal, keys)
+
+	moved := 0
+	for key, server := range after {
+		if server == before[key] {
+			continue
+		}
+		moved++
+		if server != added.String() {
+			t.Errorf("key %s moved from %s to %s, keys should only move to the new server", key, before[key], server)
+		}
+	}
+
+	// Expect about 1/(N+1) of the keys to move, allow up to double that
+	expected := float64(keys) / (n + 1)
+	if float64(moved) > 2*expected || moved == 0 {
+		t.Errorf("%d keys moved, expected about %.0f", moved, expected)
+	}
+}
+
+func TestConsistentHashRemoveMovesOnlyOneNth(t *testing.T) {
+	const n, keys = 10, 10000
+	bal, servers := buildConsistentHash(t, n)
+	before := assignKeys(t, bal, keys)
+
+	removed := servers[3]
+	bal.Remove(removed)
+	after := assignKeys(t, bal, keys)
+
+	moved := 0
+	for key, server := range after {
+		if server == before[key] {
+			continue
+		}
+		moved++
+		if before[key] != removed.String() {
+			t.Errorf("key %s moved from %s to %s, only keys of the removed server should move", key, before[key], server)
+		}
+	}
+
+	expected := float64(keys) / n
+	if float64(moved) > 2*expected || moved == 0 {
+		t.Errorf("%d keys moved, expected about %.0f", moved, expected)
+	}
+}
+
+func TestConsistentHashWeights(t *testing.T) {
+	const keys = 10000
+	light := &url.URL{Scheme: "http", Host: "light:80"}
+	heavy := &url.URL{Scheme: "http", Host: "heavy:80"}
+
+	bal := NewConsistentHashBalancer()
+	AddServer(bal, light, ServerOptions{Weight: 1})
+	AddServer(bal, heavy, ServerOptions{Weight: 3})
+
+	heavyCount := 0
+	for _, server := range assignKeys(t, bal, keys) {
+		if server == heavy.String() {
+			heavyCount++
+		}
+	}
+
+	share := float64(heavyCount) / keys
+	if share < 0.65 || share > 0.85 {
+		t.Errorf("heavy server owns %.3f of the keys, expected about 0.75", share)
+	}
+}
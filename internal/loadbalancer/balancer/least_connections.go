@@ -0,0 +1,76 @@
+package balancer
+
+import (
+	"net/url"
+	"sync/atomic"
+)
+
+// A LeastConnectionsBalancer selects the server with the fewest in-flight
+// requests. Ties are broken in round robin order so that an idle pool is
+// still spread evenly.
+type LeastConnectionsBalancer struct {
+	BaseBalancer
+	conns   map[string]int64
+	current atomic.Uint64
+}
+
+func (l *LeastConnectionsBalancer) Remove(server *url.URL) {
+	l.BaseBalancer.Remove(server)
+
+	l.Lock()
+	defer l.Unlock()
+	delete(l.conns, server.String())
+}
+
+func (l *LeastConnectionsBalancer) Balance() (*url.URL, error) {
+	l.RLock()
+	defer l.RUnlock()
+
+	if len(l.servers) == 0 {
+		return &url.URL{}, NoHealthyHostsError
+	}
+
+	start := l.current.Add(1)
+	var best *url.URL
+	var bestConns int64
+	for i := range l.servers {
+		server := l.servers[(start+uint64(i))%uint64(len(l.servers))]
+		conns := l.conns[server.String()]
+		if best == nil || conns < bestConns {
+			best = server
+			bestConns = conns
+		}
+	}
+
+	return best, nil
+}
+
+func (l *LeastConnectionsBalancer) Inc(server *url.URL) {
+	l.Lock()
+	defer l.Unlock()
+	if l.conns == nil {
+		l.conns = make(map[string]int64)
+	}
+	l.conns[server.String()]++
+}
+
+func (l *LeastConnectionsBalancer) Done(server *url.URL) {
+	l.Lock()
+	defer l.Unlock()
+	if l.conns[server.String()] > 0 {
+		l.conns[server.String()]--
+	}
+}
+
+func NewLeastConnectionsBalancer() Balancer {
+	return &LeastConnectionsBalancer{
+		BaseBalancer: BaseBalancer{
+			servers: []*url.URL{},
+		},
+		conns: make(map[string]int64),
+	}
+}
+
+func init() {
+	factories["least-connections"] = NewLeastConnectionsBalancer
+}
@@ -0,0 +1,150 @@
+package balancer
+
+import (
+	"math"
+	"math/rand/v2"
+	"net/url"
+	"time"
+)
+
+// The time constant of the moving average. A sample taken this long ago has
+// about a third of the influence of one taken now.
+const ewmaDecay = 10 * time.Second
+
+// A P2CEWMABalancer samples two servers at random and picks the one with the
+// lower cost, where the cost is the exponentially weighted moving average of
+// its response latency multiplied by its outstanding requests. Slow servers
+// are avoided without the whole pool herding onto the single fastest one.
+type P2CEWMABalancer struct {
+	BaseBalancer
+	stats map[string]*p2cStats
+
+	intN func(n int) int  // Random source, replaceable in tests
+	now  func() time.Time // Clock, replaceable in tests
+}
+
+type p2cStats struct {
+	inFlight int64
+	ewma     float64 // Nanoseconds
+	observed time.Time
+}
+
+func (p *P2CEWMABalancer) Add(server *url.URL) {
+	p.BaseBalancer.Add(server)
+
+	p.Lock()
+	defer p.Unlock()
+	if p.stats == nil {
+		p.stats = make(map[string]*p2cStats)
+	}
+	if _, ok := p.stats[server.String()]; ok {
+		return
+	}
+
+	// Start new servers at the average latency of the pool, otherwise a cost
+	// of zero would send them every request until their first response
+	var total float64
+	var observed int
+	for _, s := range p.stats {
+		if s.ewma > 0 {
+			total += s.ewma
+			observed++
+		}
+	}
+	stats := &p2cStats{observed: p.now()}
+	if observed > 0 {
+		stats.ewma = total / float64(observed)
+	}
+	p.stats[server.String()] = stats
+}
+
+func (p *P2CEWMABalancer) Remove(server *url.URL) {
+	p.BaseBalancer.Remove(server)
+
+	p.Lock()
+	defer p.Unlock()
+	delete(p.stats, server.String())
+}
+
+func (p *P2CEWMABalancer) Balance() (*url.URL, error) {
+	p.RLock()
+	defer p.RUnlock()
+
+	switch len(p.servers) {
+	case 0:
+		return &url.URL{}, NoHealthyHostsError
+	case 1:
+		return p.servers[0], nil
+	}
+
+	i := p.intN(len(p.servers))
+	j := p.intN(len(p.servers) - 1)
+	if j >= i {
+		j++
+	}
+
+	a, b := p.servers[i], p.servers[j]
+	if p.cost(b) < p.cost(a) {
+		return b, nil
+	}
+	return a, nil
+}
+
+// cost must be called with the lock held
+func (p *P2CEWMABalancer) cost(server *url.URL) float64 {
+	stats, ok := p.stats[server.String()]
+	if !ok {
+		return 0
+	}
+	return stats.ewma * float64(stats.inFlight+1)
+}
+
+func (p *P2CEWMABalancer) Inc(server *url.URL) {
+	p.Lock()
+	defer p.Unlock()
+	if stats, ok := p.stats[server.String()]; ok {
+		stats.inFlight++
+	}
+}
+
+func (p *P2CEWMABalancer) Done(server *url.URL) {
+	p.Lock()
+	defer p.Unlock()
+	if stats, ok := p.stats[server.String()]; ok && stats.inFlight > 0 {
+		stats.inFlight--
+	}
+}
+
+func (p *P2CEWMABalancer) Observe(server *url.URL, latency time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	stats, ok := p.stats[server.String()]
+	if !ok {
+		return
+	}
+
+	now := p.now()
+	if stats.ewma == 0 {
+		stats.ewma = float64(latency)
+	} else {
+		// Weight the old average by how long ago it was last updated
+		w := math.Exp(-float64(now.Sub(stats.observed)) / float64(ewmaDecay))
+		stats.ewma = stats.ewma*w + float64(latency)*(1-w)
+	}
+	stats.observed = now
+}
+
+func NewP2CEWMABalancer() Balancer {
+	return &P2CEWMABalancer{
+		BaseBalancer: BaseBalancer{
+			servers: []*url.URL{},
+		},
+		stats: make(map[string]*p2cStats),
+		intN:  rand.IntN,
+		now:   time.Now,
+	}
+}
+
+func init() {
+	factories["p2c-ewma"] = NewP2CEWMABalancer
+}
@@ -0,0 +1,128 @@
+package balancer
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newTestP2C returns a balancer which always samples the first two servers
+// and whose clock only moves when the test advances it
+func newTestP2C(servers ...*url.URL) (*P2CEWMABalancer, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	bal := NewP2CEWMABalancer().(*P2CEWMABalancer)
+	bal.intN = func(n int) int { return 0 }
+	bal.now = func() time.Time { return now }
+	for _, s := range servers {
+		bal.Add(s)
+	}
+	return bal, &now
+}
+
+func TestP2CEWMABalanceNoServers(t *testing.T) {
+	bal := NewP2CEWMABalancer()
+	if _, err := bal.Balance(); err != NoHealthyHostsError {
+		t.Errorf("expected NoHealthyHostsError, got %v", err)
+	}
+}
+
+func TestP2CEWMABalanceOneServer(t *testing.T) {
+	server := &url.URL{Scheme: "http", Host: "a:80"}
+	bal, _ := newTestP2C(server)
+
+	got, err := bal.Balance()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.String() != server.String() {
+		t.Errorf("got %v, want %v", got, server)
+	}
+}
+
+func TestP2CEWMAAvoidsSlowServer(t *testing.T) {
+	fast := &url.URL{Scheme: "http", Host: "fast:80"}
+	slow := &url.URL{Scheme: "http", Host: "slow:80"}
+	bal, _ := newTestP2C(slow, fast)
+
+	bal.Observe(fast, 10*time.Millisecond)
+	bal.Observe(slow, 500*time.Millisecond)
+
+	got, _ := bal.Balance()
+	if got.String() != fast.String() {
+		t.Errorf("got %v, want %v", got, fast)
+	}
+}
+
+func TestP2CEWMAOutstandingRequests(t *testing.T) {
+	a := &url.URL{Scheme: "http", Host: "a:80"}
+	b := &url.URL{Scheme: "http", Host: "b:80"}
+	bal, _ := newTestP2C(a, b)
+
+	bal.Observe(a, 10*time.Millisecond)
+	bal.Observe(b, 15*time.Millisecond)
+
+	// a is faster but has enough outstanding requests to cost more than b
+	bal.Inc(a)
+	bal.Inc(a)
+	got, _ := bal.Balance()
+	if got.String() != b.String() {
+		t.Errorf("got %v, want %v", got, b)
+	}
+
+	bal.Done(a)
+	bal.Done(a)
+	got, _ = bal.Balance()
+	if got.String() != a.String() {
+		t.Errorf("got %v, want %v", got, a)
+	}
+}
+
+func TestP2CEWMADecay(t *testing.T) {
+	server := &url.URL{Scheme: "http", Host: "a:80"}
+	bal, now := newTestP2C(server)
+
+	bal.Observe(server, 100*time.Millisecond)
+
+	// A sample immediately after the last has almost no influence
+	bal.Observe(server, 10*time.Millisecond)
+	if got := time.Duration(bal.stats[server.String()].ewma); got < 99*time.Millisecond {
+		t.Errorf("expected the average to stay near 100ms, got %v", got)
+	}
+
+	// A sample long after the last replaces the average
+	*now = now.Add(10 * ewmaDecay)
+	bal.Observe(server, 10*time.Millisecond)
+	if got := time.Duration(bal.stats[server.String()].ewma); got > 11*time.Millisecond {
+		t.Errorf("expected the average to decay to near 10ms, got %v", got)
+	}
+}
+
+func TestP2CEWMANewServerStartsAtPoolAverage(t *testing.T) {
+	a := &url.URL{Scheme: "http", Host: "a:80"}
+	b := &url.URL{Scheme: "http", Host: "b:80"}
+	c := &url.URL{Scheme: "http", Host: "c:80"}
+	bal, _ := newTestP2C(a, b)
+
+	bal.Observe(a, 10*time.Millisecond)
+	bal.Observe(b, 30*time.Millisecond)
+	bal.Add(c)
+
+	if got := time.Duration(bal.stats[c.String()].ewma); got != 20*time.Millisecond {
+		t.Errorf("expected new server to start at 20ms, got %v", got)
+	}
+}
+
+func TestP2CEWMASamplesDistinctServers(t *testing.T) {
+	a := &url.URL{Scheme: "http", Host: "a:80"}
+	b := &url.URL{Scheme: "http", Host: "b:80"}
+	bal, _ := newTestP2C(a, b)
+	bal.Observe(a, 50*time.Millisecond)
+	bal.Observe(b, 10*time.Millisecond)
+
+	// Both random draws return the same index, the second must be shifted so
+	// that a server is never compared with itself
+	got, _ := bal.Balance()
+	if got.String() != b.String() {
+		t.Errorf("got %v, want %v", got, b)
+	}
+}
@@ -0,0 +1,96 @@
+package balancer
+
+import (
+	"net/url"
+)
+
+// A WeightedRoundRobinBalancer implements the smooth weighted round robin
+// algorithm used by nginx. Servers are selected in proportion to their
+// weight, and selections of heavy servers are interleaved with the rest of
+// the pool rather than sent in bursts.
+type WeightedRoundRobinBalancer struct {
+	BaseBalancer
+	weights map[string]*weightedServer
+}
+
+type weightedServer struct {
+	weight        int
+	currentWeight int
+}
+
+func (w *WeightedRoundRobinBalancer) Add(server *url.URL) {
+	w.AddWithOptions(server, ServerOptions{Weight: 1})
+}
+
+func (w *WeightedRoundRobinBalancer) AddWithOptions(server *url.URL, options ServerOptions) {
+	weight := options.Weight
+	if weight < 1 {
+		weight = 1
+	}
+
+	// The server and its weight are added together so Balance never sees one
+	// without the other
+	w.Lock()
+	defer w.Unlock()
+	if w.weights == nil {
+		w.weights = make(map[string]*weightedServer)
+	}
+	if ws, ok := w.weights[server.String()]; ok {
+		ws.weight = weight
+		return
+	}
+	w.servers = append(w.servers, server)
+	w.weights[server.String()] = &weightedServer{weight: weight}
+}
+
+func (w *WeightedRoundRobinBalancer) Remove(server *url.URL) {
+	w.Lock()
+	defer w.Unlock()
+	for i, s := range w.servers {
+		if s.String() == server.String() {
+			w.servers = append(w.servers[:i], w.servers[i+1:]...)
+			break
+		}
+	}
+	delete(w.weights, server.String())
+}
+
+func (w *WeightedRoundRobinBalancer) Balance() (*url.URL, error) {
+	// Selecting a server updates the current weights so a full lock is needed
+	w.Lock()
+	defer w.Unlock()
+
+	if len(w.servers) == 0 {
+		return &url.URL{}, NoHealthyHostsError
+	}
+
+	var best *url.URL
+	var bestWeight *weightedServer
+	total := 0
+	for _, server := range w.servers {
+		// Servers are only added and removed along with their weight
+		ws := w.weights[server.String()]
+		ws.currentWeight += ws.weight
+		total += ws.weight
+		if bestWeight == nil || ws.currentWeight > bestWeight.currentWeight {
+			best = server
+			bestWeight = ws
+		}
+	}
+
+	bestWeight.currentWeight -= total
+	return best, nil
+}
+
+func NewWeightedRoundRobinBalancer() Balancer {
+	return &WeightedRoundRobinBalancer{
+		BaseBalancer: BaseBalancer{
+			servers: []*url.URL{},
+		},
+		weights: make(map[string]*weightedServer),
+	}
+}
+
+func init() {
+	factories["weighted-round-robin"] = NewWeightedRoundRobinBalancer
+}
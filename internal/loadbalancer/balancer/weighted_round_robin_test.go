@@ -0,0 +1,189 @@
+package balancer
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestWeightedRoundRobinBalance(t *testing.T) {
+	a := &url.URL{Scheme: "http", Host: "a:8080"}
+	b := &url.URL{Scheme: "http", Host: "b:8080"}
+	c := &url.URL{Scheme: "http", Host: "c:8080"}
+
+	bal, err := BuildBalancer("weighted-round-robin")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	AddServer(bal, a, ServerOptions{Weight: 5})
+	AddServer(bal, b, ServerOptions{Weight: 1})
+	AddServer(bal, c, ServerOptions{Weight: 1})
+
+	// The smooth weighted round robin sequence from the nginx implementation
+	want := []*url.URL{a, a, b, a, c, a, a}
+	for round := 0; round < 2; round++ {
+		for i, w := range want {
+			got, err := bal.Balance()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.String() != w.String() {
+				t.Errorf("round %d selection %d: got %v, want %v", round, i, got, w)
+			}
+		}
+	}
+}
+
+func TestWeightedRoundRobinBalanceNoServers(t *testing.T) {
+	bal := NewWeightedRoundRobinBalancer()
+	if _, err := bal.Balance(); err != NoHealthyHostsError {
+		t.Errorf("expected NoHealthyHostsError, got %v", err)
+	}
+}
+
+func TestWeightedRoundRobinAdd(t *testing.T) {
+	server := &url.URL{Scheme: "http", Host: "localhost:8080"}
+
+	cases := []struct {
+		name    string
+		options []ServerOptions
+		want    int
+	}{
+		{
+			name:    "Add without options defaults to weight 1",
+			options: nil,
+			want:    1,
+		},
+		{
+			name:    "Add with a weight",
+			options: []ServerOptions{{Weight: 3}},
+			want:    3,
+		},
+		{
+			name:    "Add with a zero weight is treated as 1",
+			options: []ServerOptions{{Weight: 0}},
+			want:    1,
+		},
+		{
+			name:    "Adding an existing server updates its weight",
+			options: []ServerOptions{{Weight: 3}, {Weight: 7}},
+			want:    7,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			bal := NewWeightedRoundRobinBalancer().(*WeightedRoundRobinBalancer)
+			if c.options == nil {
+				bal.Add(server)
+			}
+			for _, opt := range c.options {
+				AddServer(bal, server, opt)
+			}
+
+			if bal.Len() != 1 {
+				t.Errorf("expected 1 server, got %d", bal.Len())
+			}
+			if got := bal.weights[server.String()].weight; got != c.want {
+				t.Errorf("expected weight %d, got %d", c.want, got)
+			}
+		})
+	}
+}
+
+func TestWeightedRoundRobinRemove(t *testing.T) {
+	a := &url.URL{Scheme: "http", Host: "a:8080"}
+	b := &url.URL{Scheme: "http", Host: "b:8080"}
+
+	bal := NewWeightedRoundRobinBalancer().(*WeightedRoundRobinBalancer)
+	AddServer(bal, a, ServerOptions{Weight: 2})
+	AddServer(bal, b, ServerOptions{Weight: 1})
+	bal.Remove(a)
+
+	if _, ok := bal.weights[a.String()]; ok {
+		t.Errorf("expected weight to be removed")
+	}
+	for i := 0; i < 3; i++ {
+		got, err := bal.Balance()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got.String() != b.String() {
+			t.Errorf("got %v, want %v", got, b)
+		}
+	}
+}
+
+func TestWeightedRoundRobinConcurrentAdd(t *testing.T) {
+	bal := NewWeightedRoundRobinBalancer().(*WeightedRoundRobinBalancer)
+	AddServer(bal, &url.URL{Scheme: "http", Host: "a:8080"}, ServerOptions{Weight: 1})
+
+	// Servers being added while others are selected must never be seen
+	// without a weight
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := range 200 {
+			AddServer(bal, &url.URL{Scheme: "http", Host: fmt.Sprintf("b%d:8080", i)}, ServerOptions{Weight: 2})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range 1000 {
+			if _, err := bal.Balance(); err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	for _, server := range bal.Servers() {
+		want := 2
+		if server.Host == "a:8080" {
+			want = 1
+		}
+		if ws, ok := bal.weights[server.String()]; !ok || ws.weight != want {
+			t.Fatalf("expected %v to have weight %d, got %+v", server, want, ws)
+		}
+	}
+
+	// Over one full cycle from the start each server is picked as often as
+	// its weight
+	for _, ws := range bal.weights {
+		ws.currentWeight = 0
+	}
+	counts := make(map[string]int)
+	for range 1 + 200*2 {
+		got, err := bal.Balance()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		counts[got.Host]++
+	}
+	for host, count := range counts {
+		want := 2
+		if host == "a:8080" {
+			want = 1
+		}
+		if count != want {
+			t.Errorf("expected %s to be picked %d times, got %d", host, want, count)
+		}
+	}
+	if len(counts) != 201 {
+		t.Errorf("expected every server to be picked, got %d", len(counts))
+	}
+}
+
+func TestAddServerWithoutOptionsSupport(t *testing.T) {
+	// Balancers which do not support options should still receive the server
+	server := &url.URL{Scheme: "http", Host: "localhost:8080"}
+	bal := NewRoundRobinBalancer()
+	AddServer(bal, server, ServerOptions{Weight: 5})
+
+	if bal.Len() != 1 {
+		t.Errorf("expected 1 server, got %d", bal.Len())
+	}
+}
@@ -0,0 +1,320 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/harrydayexe/Omni/internal/loadbalancer/balancer"
+)
+
+// The sliding window of a circuit breaker is split into this many buckets,
+// and a bucket is dropped from the error rate once it is a window old
+const breakerBuckets = 10
+
+// errAllBreakersOpen is returned when every backend of a route has an open
+// circuit breaker
+var errAllBreakersOpen = errors.New("every backend circuit breaker is open")
+
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // Requests are sent to the backend
+	breakerOpen                         // Requests are not sent to the backend
+	breakerHalfOpen                     // A few trial requests decide whether to close again
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+type breakerBucket struct {
+	start    time.Time
+	requests int
+	errors   int
+}
+
+// A circuitBreaker stops requests to a backend whose error rate over a
+// sliding window is too high. It is protected by the lock of its proxy.
+type circuitBreaker struct {
+	state    breakerState
+	openedAt time.Time
+	buckets  [breakerBuckets]breakerBucket
+
+	trials    int // Trial requests in flight while half-open
+	successes int // Trial requests which passed while half-open
+}
+
+// allow reports whether a request can be sent to the backend, moving an open
+// breaker to half-open once it has been open long enough. A half-open breaker
+// only lets TrialRequests requests through at once.
+func (b *circuitBreaker) allow(spec CircuitBreaker, now time.Time) bool {
+	switch b.state {
+	case breakerOpen:
+		if now.Before(b.openedAt.Add(spec.OpenDuration)) {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.trials = 0
+		b.successes = 0
+		fallthrough
+	case breakerHalfOpen:
+		if b.trials >= spec.TrialRequests {
+			return false
+		}
+		b.trials++
+		return true
+	}
+	return true
+}
+
+// record counts the result of a request to the backend
+func (b *circuitBreaker) record(spec CircuitBreaker, now time.Time, failed bool) {
+	switch b.state {
+	case breakerHalfOpen:
+		if b.trials > 0 {
+			b.trials--
+		}
+		if failed {
+			b.open(now)
+			return
+		}
+		b.successes++
+		if b.successes >= spec.TrialRequests {
+			b.state = breakerClosed
+			b.buckets = [breakerBuckets]breakerBucket{}
+		}
+		return
+	case breakerOpen:
+		// A request sent before the breaker opened
+		return
+	}
+
+	bucket := b.bucket(spec, now)
+	bucket.requests++
+	if failed {
+		bucket.errors++
+	}
+
+	requests, errors := b.counts(spec, now)
+	if requests >= spec.MinRequests && errors*100 >= spec.ErrorRate*requests {
+		b.open(now)
+	}
+}
+
+func (b *circuitBreaker) open(now time.Time) {
+	b.state = breakerOpen
+	b.openedAt = now
+	b.trials = 0
+	b.successes = 0
+}
+
+// bucket returns the bucket of the window for now, clearing it if it was last
+// used a window ago
+func (b *circuitBreaker) bucket(spec CircuitBreaker, now time.Time) *breakerBucket {
+	width := spec.Window / breakerBuckets
+	start := now.Truncate(width)
+	bucket := &b.buckets[(start.UnixNano()/int64(width))%breakerBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = breakerBucket{start: start}
+	}
+	return bucket
+}
+
+// counts returns the requests and errors within the window
+func (b *circuitBreaker) counts(spec CircuitBreaker, now time.Time) (requests, errors int) {
+	for _, bucket := range b.buckets {
+		if now.Sub(bucket.start) < spec.Window {
+			requests += bucket.requests
+			errors += bucket.errors
+		}
+	}
+	return requests, errors
+}
+
+// retryAfter returns how long until the breaker lets a trial request through
+func (b *circuitBreaker) retryAfter(spec CircuitBreaker, now time.Time) time.Duration {
+	if b.state != breakerOpen {
+		return 0
+	}
+	return max(b.openedAt.Add(spec.OpenDuration).Sub(now), 0)
+}
+
+// allowRequest reports whether the circuit breaker of a backend lets a
+// request through. Every allowed request must be followed by recordBreaker, or
+// by releaseBreaker if its result says nothing about the backend.
+func (p *LoadBalancerProxy) allowRequest(server *url.URL) bool {
+	spec := p.breakerSpec.withDefaults()
+	if spec.Disabled {
+		return true
+	}
+
+	p.Lock()
+	if _, ok := p.lookup(server); !ok {
+		p.Unlock()
+		return true
+	}
+	b := p.breaker(server)
+	from := b.state
+	allowed := b.allow(spec, time.Now())
+	to := b.state
+	p.Unlock()
+
+	p.logBreakerTransition(server, from, to)
+	return allowed
+}
+
+// recordBreaker counts the result of a request in the circuit breaker of the
+// backend
+func (p *LoadBalancerProxy) recordBreaker(server *url.URL, status int) {
+	spec := p.breakerSpec.withDefaults()
+	if spec.Disabled {
+		return
+	}
+
+	p.Lock()
+	if _, ok := p.lookup(server); !ok {
+		p.Unlock()
+		return
+	}
+	b := p.breaker(server)
+	from := b.state
+	b.record(spec, time.Now(), status >= 500)
+	to := b.state
+	p.Unlock()
+
+	p.logBreakerTransition(server, from, to)
+}
+
+// releaseBreaker gives back the trial a request held in the circuit breaker
+// of the backend without counting its result, such as when the client hung up
+func (p *LoadBalancerProxy) releaseBreaker(server *url.URL) {
+	if p.breakerSpec.withDefaults().Disabled {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.lookup(server); !ok {
+		return
+	}
+	if b := p.breaker(server); b.state == breakerHalfOpen && b.trials > 0 {
+		b.trials--
+	}
+}
+
+// breaker returns the circuit breaker of a backend, creating it if needed.
+// Must be called with the lock held.
+func (p *LoadBalancerProxy) breaker(server *url.URL) *circuitBreaker {
+	if p.breakerMap == nil {
+		p.breakerMap = make(map[string]*circuitBreaker)
+	}
+	b, ok := p.breakerMap[server.Host]
+	if !ok {
+		b = &circuitBreaker{}
+		p.breakerMap[server.Host] = b
+	}
+	return b
+}
+
+func (p *LoadBalancerProxy) logBreakerTransition(server *url.URL, from, to breakerState) {
+	if from == to {
+		return
+	}
+	level := slog.LevelInfo
+	if to == breakerOpen {
+		level = slog.LevelWarn
+	}
+	p.log().Log(context.Background(), level, "circuit breaker changed state",
+		slog.String("path", p.pattern),
+		slog.String("backend", server.String()),
+		slog.String("from", from.String()),
+		slog.String("to", to.String()),
+	)
+}
+
+// breakerRetryAfter returns how long until the first open circuit breaker of
+// the proxy lets a trial request through
+func (p *LoadBalancerProxy) breakerRetryAfter() time.Duration {
+	spec := p.breakerSpec.withDefaults()
+	now := time.Now()
+
+	p.RLock()
+	defer p.RUnlock()
+
+	var wait time.Duration
+	for _, b := range p.breakerMap {
+		if b.state != breakerOpen {
+			continue
+		}
+		if d := b.retryAfter(spec, now); wait == 0 || d < wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// pickBackend selects a backend for the request which has not been tried yet,
+// is below its concurrency limit and whose circuit breaker lets the request
+// through, from the balancer the request was sent to. The returned backend
+// holds a concurrency slot for the request which serveTry gives back.
+func (p *LoadBalancerProxy) pickBackend(bal balancer.Balancer, r *http.Request, tried map[string]bool) (*url.URL, error) {
+	first, err := p.balance(bal, r)
+	if err != nil {
+		return nil, err
+	}
+
+	// The balancer only picks once. Balancers which pick at random or by key
+	// may never return some servers however often they are asked, so if its
+	// pick cannot be used the rest of the pool is tried in order.
+	checked := make(map[string]bool)
+	open, saturated := false, false
+	for _, host := range append([]*url.URL{first}, bal.Servers()...) {
+		if tried[host.String()] || checked[host.String()] {
+			continue
+		}
+		checked[host.String()] = true
+		if !p.limits.acquire(host.Host, p.concurrencyLimit(host)) {
+			saturated = true
+		} else if p.allowRequest(host) {
+			return host, nil
+		} else {
+			open = true
+			p.limits.release(host.Host)
+		}
+	}
+	if saturated {
+		return nil, errSaturated
+	}
+	if open {
+		return nil, errAllBreakersOpen
+	}
+	return nil, errors.New("every backend has been tried")
+}
+
+// breakerStates returns the state of the circuit breaker of every backend
+func (p *LoadBalancerProxy) breakerStates() map[string]string {
+	p.RLock()
+	defer p.RUnlock()
+
+	states := make(map[string]string, len(p.serviceMap))
+	for server := range p.serviceMap {
+		state := breakerClosed
+		if b, ok := p.breakerMap[server.Host]; ok {
+			state = b.state
+		}
+		states[server.String()] = state.String()
+	}
+	return states
+}
@@ -0,0 +1,252 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerOpensOnErrorRate(t *testing.T) {
+	spec := CircuitBreaker{MinRequests: 4, ErrorRate: 50}.withDefaults()
+	now := time.Now()
+	b := &circuitBreaker{}
+
+	b.record(spec, now, false)
+	b.record(spec, now, true)
+	b.record(spec, now, true)
+	if b.state != breakerClosed {
+		t.Fatalf("expected breaker to stay closed below the minimum requests, got %v", b.state)
+	}
+
+	b.record(spec, now, false)
+	if b.state != breakerOpen {
+		t.Fatalf("expected breaker to open at a 50%% error rate, got %v", b.state)
+	}
+	if b.allow(spec, now.Add(time.Second)) {
+		t.Errorf("expected open breaker to refuse requests")
+	}
+}
+
+func TestCircuitBreakerWindowSlides(t *testing.T) {
+	spec := CircuitBreaker{Window: 10 * time.Second, MinRequests: 4, ErrorRate: 50}.withDefaults()
+	now := time.Now()
+	b := &circuitBreaker{}
+
+	b.record(spec, now, true)
+	b.record(spec, now, true)
+	b.record(spec, now, true)
+
+	// The errors are out of the window by the time there are enough requests
+	later := now.Add(11 * time.Second)
+	b.record(spec, later, true)
+	if b.state != breakerClosed {
+		t.Fatalf("expected errors outside the window to be forgotten, got %v", b.state)
+	}
+	if requests, errors := b.counts(spec, later); requests != 1 || errors != 1 {
+		t.Errorf("expected 1 request and error in the window, got %d and %d", requests, errors)
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	spec := CircuitBreaker{MinRequests: 1, OpenDuration: time.Minute, TrialRequests: 2}.withDefaults()
+	now := time.Now()
+	b := &circuitBreaker{}
+	b.record(spec, now, true)
+
+	if got := b.retryAfter(spec, now.Add(20*time.Second)); got != 40*time.Second {
+		t.Errorf("expected retry after 40s, got %v", got)
+	}
+
+	now = now.Add(time.Minute)
+	if !b.allow(spec, now) || !b.allow(spec, now) {
+		t.Fatalf("expected half-open breaker to allow the trial requests")
+	}
+	if b.state != breakerHalfOpen {
+		t.Fatalf("expected breaker to be half-open, got %v", b.state)
+	}
+	if b.allow(spec, now) {
+		t.Fatalf("expected half-open breaker to refuse requests beyond the trials")
+	}
+
+	b.record(spec, now, false)
+	if b.state != breakerHalfOpen {
+		t.Fatalf("expected breaker to wait for every trial, got %v", b.state)
+	}
+	b.record(spec, now, false)
+	if b.state != breakerClosed {
+		t.Fatalf("expected breaker to close after the trials pass, got %v", b.state)
+	}
+
+	// A failed trial opens the breaker again
+	b.record(spec, now, true)
+	now = now.Add(time.Minute)
+	b.allow(spec, now)
+	b.record(spec, now, true)
+	if b.state != breakerOpen {
+		t.Fatalf("expected failed trial to open the breaker, got %v", b.state)
+	}
+}
+
+func TestProxyFailsFastWhenBreakersOpen(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+
+	proxy, err := newRouteProxy(Route{
+		Pattern:          "/",
+		Algorithm:        "round-robin",
+		OutlierDetection: OutlierDetection{Disabled: true},
+		CircuitBreaker:   CircuitBreaker{MinRequests: 2, OpenDuration: 90 * time.Second},
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	backendURL, _ := url.Parse(backend.URL)
+	proxy.Add(backendURL)
+	markAlive(proxy)
+
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rr.Code != http.StatusInternalServerError {
+			t.Fatalf("expected backend response before the breaker opens, got %d", rr.Code)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 once the breaker is open, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "90" {
+		t.Errorf("expected Retry-After of 90, got %q", got)
+	}
+	var body struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil || body.Error != "Service Unavailable" {
+		t.Errorf("expected a JSON error, got %+v (%v)", body, err)
+	}
+}
+
+func TestProxyBreakerIgnoresClientAborts(t *testing.T) {
+	started := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer backend.Close()
+
+	proxy, err := newRouteProxy(Route{
+		Pattern:          "/",
+		Algorithm:        "round-robin",
+		OutlierDetection: OutlierDetection{Disabled: true},
+		CircuitBreaker:   CircuitBreaker{MinRequests: 2, OpenDuration: 90 * time.Second},
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	backendURL, _ := url.Parse(backend.URL)
+	proxy.Add(backendURL)
+	markAlive(proxy)
+
+	abort := func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-started
+			cancel()
+		}()
+		proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	}
+	for i := 0; i < 3; i++ {
+		abort()
+	}
+
+	spec := proxy.breakerSpec.withDefaults()
+	proxy.Lock()
+	b := proxy.breaker(backendURL)
+	requests, _ := b.counts(spec, time.Now())
+	proxy.Unlock()
+	if b.state != breakerClosed || requests != 0 {
+		t.Errorf("expected client aborts not to count in the breaker, got %v with %d requests", b.state, requests)
+	}
+
+	// A trial request the client gives up on frees the trial for another
+	proxy.Lock()
+	b.state = breakerHalfOpen
+	proxy.Unlock()
+	abort()
+	proxy.Lock()
+	defer proxy.Unlock()
+	if b.state != breakerHalfOpen || b.trials != 0 {
+		t.Errorf("expected an aborted trial to be given back, got %v with %d trials", b.state, b.trials)
+	}
+}
+
+func TestBreakerz(t *testing.T) {
+	lb := newTestLoadBalancer(t, Config{
+		Algorithm: "round-robin",
+		Paths: []Route{
+			{Pattern: "GET /", Backends: []Backend{{Address: "http://omniread:80"}}},
+		},
+	})
+	lb.Proxies["GET /"].breakerMap["omniread:80"] = &circuitBreaker{state: breakerOpen}
+
+	rr := httptest.NewRecorder()
+	lb.adminMux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/breakerz", nil))
+
+	var states map[string]map[string]string
+	if err := json.NewDecoder(rr.Body).Decode(&states); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := states["GET /"]["http://omniread:80"]; got != "open" {
+		t.Errorf("expected open breaker, got %v", states)
+	}
+}
+
+func TestPickBackendFindsEveryUsableBackend(t *testing.T) {
+	for _, algorithm := range []string{"p2c-ewma", "consistent-hash", "weighted-round-robin"} {
+		t.Run(algorithm, func(t *testing.T) {
+			proxy, err := NewLoadBalancerProxy(algorithm)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			proxy.hashKey = &requestKey{source: "header", name: "X-Omni-User"}
+			servers := make([]*url.URL, 8)
+			for i := range servers {
+				servers[i] = &url.URL{Scheme: "http", Host: fmt.Sprintf("localhost:80%02d", i)}
+				proxy.Add(servers[i])
+			}
+			markAlive(proxy)
+
+			// Only the last backend can take the request, which a balancer
+			// picking at random or by key may not return however often it
+			// is asked
+			now := time.Now()
+			tried := map[string]bool{servers[0].String(): true}
+			for _, server := range servers[1 : len(servers)-1] {
+				proxy.breakerMap[server.Host] = &circuitBreaker{state: breakerOpen, openedAt: now}
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Omni-User", "42")
+			for range 20 {
+				got, err := proxy.pickBackend(proxy.balancer, req, tried)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if got.String() != servers[len(servers)-1].String() {
+					t.Fatalf("expected the only usable backend, got %v", got)
+				}
+				proxy.limits.release(got.Host)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package loadbalancer
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errSaturated    = errors.New("every backend is at its concurrency limit")
+	errQueueFull    = errors.New("too many requests are waiting for a backend")
+	errQueueTimeout = errors.New("timed out waiting for a backend")
+)
+
+// A concurrencyLimiter counts the requests a proxy has in flight, for the
+// route as a whole and for each backend, and queues requests which are over a
+// limit until a request finishes
+type concurrencyLimiter struct {
+	spec Concurrency
+
+	mu       sync.Mutex
+	active   int            // Requests holding a slot for the route
+	backends map[string]int // Tries in flight to each backend, by host
+	waiters  *list.List     // Queued requests, oldest at the front
+
+	rejected atomic.Int64 // Requests which failed because the queue was full or they waited too long
+}
+
+// A waiter is a queued request. It is signalled whenever a slot may have
+// become free, and keeps its place in the queue until it gets one.
+type waiter struct {
+	ready chan struct{}
+}
+
+func newConcurrencyLimiter(spec Concurrency) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		spec:     spec.withDefaults(),
+		backends: make(map[string]int),
+		waiters:  list.New(),
+	}
+}
+
+// enter takes a slot for the route, reporting whether there was one free
+func (l *concurrencyLimiter) enter() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.spec.MaxRequests > 0 && l.active >= l.spec.MaxRequests {
+		return false
+	}
+	l.active++
+	return true
+}
+
+// leave gives back a slot for the route
+func (l *concurrencyLimiter) leave() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.wake(l.waiters.Front())
+}
+
+// acquire takes a slot on a backend which allows limit requests at once, or
+// any number if limit is zero. It reports whether there was one free.
+func (l *concurrencyLimiter) acquire(host string, limit int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limit > 0 && l.backends[host] >= limit {
+		return false
+	}
+	l.backends[host]++
+	return true
+}
+
+// release gives back a slot on a backend
+func (l *concurrencyLimiter) release(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.backends[host]--; l.backends[host] <= 0 {
+		delete(l.backends, host)
+	}
+	l.wake(l.waiters.Front())
+}
+
+// wait calls admit, queuing the request and calling it again each time a
+// slot may have become free, until admit returns true or the queue timeout
+// or ctx end. Admit must take any slots the request needs and report whether
+// it no longer needs to wait.
+func (l *concurrencyLimiter) wait(ctx context.Context, admit func() bool) error {
+	if admit() {
+		return nil
+	}
+
+	l.mu.Lock()
+	if l.waiters.Len() >= l.spec.QueueSize {
+		l.mu.Unlock()
+		l.rejected.Add(1)
+		return errQueueFull
+	}
+	w := &waiter{ready: make(chan struct{}, 1)}
+	element := l.waiters.PushBack(w)
+	// A slot may have been freed since admit failed, before the request was
+	// queued to be told about it
+	l.wake(element)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.spec.QueueTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-w.ready:
+		case <-timer.C:
+			l.dequeue(element, true)
+			l.rejected.Add(1)
+			return errQueueTimeout
+		case <-ctx.Done():
+			l.dequeue(element, true)
+			l.rejected.Add(1)
+			return ctx.Err()
+		}
+
+		if admit() {
+			l.dequeue(element, false)
+			return nil
+		}
+
+		// The slot which was freed is no use to this request, such as when
+		// it is on a backend in another group, so it may be to the next
+		l.mu.Lock()
+		l.wake(element.Next())
+		l.mu.Unlock()
+	}
+}
+
+// dequeue removes a waiter from the queue. A waiter which gives up may have
+// been signalled for a slot it did not take, and one which got a slot may
+// have been signalled again while it was taking it, so in either case the
+// next one gets to try for it.
+func (l *concurrencyLimiter) dequeue(element *list.Element, passOn bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-element.Value.(*waiter).ready:
+		passOn = true
+	default:
+	}
+	if passOn {
+		l.wake(element.Next())
+	}
+	l.waiters.Remove(element)
+}
+
+// wake signals the waiter, if there is one. Must be called with the lock held.
+func (l *concurrencyLimiter) wake(element *list.Element) {
+	if element == nil {
+		return
+	}
+	select {
+	case element.Value.(*waiter).ready <- struct{}{}:
+	default:
+		// Already signalled
+	}
+}
+
+// queued returns the number of requests waiting
+func (l *concurrencyLimiter) queued() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.waiters.Len()
+}
+
+// concurrencyLimit returns the number of requests the backend can be sent at
+// once, zero for no limit
+func (p *LoadBalancerProxy) concurrencyLimit(server *url.URL) int {
+	p.RLock()
+	defer p.RUnlock()
+	if limit := p.optionsMap[server.Host].MaxConcurrent; limit > 0 {
+		return limit
+	}
+	return p.limits.spec.MaxPerBackend
+}
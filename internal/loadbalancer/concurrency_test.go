@@ -0,0 +1,224 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiterQueueOrder(t *testing.T) {
+	limiter := newConcurrencyLimiter(Concurrency{MaxRequests: 1, QueueTimeout: time.Minute})
+	if !limiter.enter() {
+		t.Fatalf("expected the first request to get a slot")
+	}
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := limiter.wait(context.Background(), func() bool {
+				if !limiter.enter() {
+					return false
+				}
+				mu.Lock()
+				order = append(order, i)
+				mu.Unlock()
+				limiter.leave()
+				return true
+			})
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+		// Queue the requests one at a time so their order is known
+		if !waitFor(t, func() bool { return limiter.queued() == i+1 }) {
+			t.Fatalf("expected %d requests to be queued, got %d", i+1, limiter.queued())
+		}
+	}
+
+	limiter.leave()
+	wg.Wait()
+	if len(order) != 3 || order[0] != 0 || order[1] != 1 || order[2] != 2 {
+		t.Errorf("expected the requests to be let through in order, got %v", order)
+	}
+}
+
+func TestConcurrencyLimiterQueueLimits(t *testing.T) {
+	limiter := newConcurrencyLimiter(Concurrency{QueueSize: 1, QueueTimeout: 50 * time.Millisecond})
+	never := func() bool { return false }
+
+	done := make(chan error)
+	go func() { done <- limiter.wait(context.Background(), never) }()
+	if !waitFor(t, func() bool { return limiter.queued() == 1 }) {
+		t.Fatalf("expected the request to be queued")
+	}
+
+	if err := limiter.wait(context.Background(), never); err != errQueueFull {
+		t.Errorf("expected the queue to be full, got %v", err)
+	}
+	if err := <-done; err != errQueueTimeout {
+		t.Errorf("expected the queued request to time out, got %v", err)
+	}
+	if got := limiter.rejected.Load(); got != 2 {
+		t.Errorf("expected 2 rejected requests, got %d", got)
+	}
+	if got := limiter.queued(); got != 0 {
+		t.Errorf("expected the queue to be empty, got %d", got)
+	}
+}
+
+func TestConcurrencyLimiterBackendLimit(t *testing.T) {
+	limiter := newConcurrencyLimiter(Concurrency{})
+
+	if !limiter.acquire("omniwrite:80", 2) || !limiter.acquire("omniwrite:80", 2) {
+		t.Fatalf("expected requests within the limit to get a slot")
+	}
+	if limiter.acquire("omniwrite:80", 2) {
+		t.Fatalf("expected a request over the limit to be refused")
+	}
+	if !limiter.acquire("omniread:80", 2) {
+		t.Errorf("expected other backends to have their own limit")
+	}
+
+	limiter.release("omniwrite:80")
+	if !limiter.acquire("omniwrite:80", 2) {
+		t.Errorf("expected a released slot to be free again")
+	}
+}
+
+func TestProxyConcurrencyLimit(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer backend.Close()
+
+	lb := newTestLoadBalancer(t, Config{
+		Algorithm: "round-robin",
+		Paths: []Route{{
+			Pattern:     "POST /post",
+			Backends:    []Backend{{Address: backend.URL, MaxConcurrent: 1}},
+			Concurrency: Concurrency{QueueSize: 1, QueueTimeout: time.Minute},
+		}},
+	})
+	proxy := lb.Proxies["POST /post"]
+
+	codes := make(chan int, 2)
+	serve := func() {
+		rr := httptest.NewRecorder()
+		lb.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/post", nil))
+		codes <- rr.Code
+	}
+	go serve()
+	<-started
+	go serve()
+	if !waitFor(t, func() bool { return proxy.limits.queued() == 1 }) {
+		t.Fatalf("expected the second request to wait for the backend")
+	}
+
+	// The queue is full, so a third request fails straight away
+	rr := httptest.NewRecorder()
+	lb.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/post", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 with the queue full, got %d", rr.Code)
+	}
+
+	close(release)
+	for range 2 {
+		if code := <-codes; code != http.StatusCreated {
+			t.Errorf("expected the queued request to be proxied once the backend was free, got %d", code)
+		}
+	}
+}
+
+func TestProxyConcurrencyQueueTimeout(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	lb := newTestLoadBalancer(t, Config{
+		Algorithm: "round-robin",
+		Paths: []Route{{
+			Pattern:     "POST /post",
+			Backends:    []Backend{{Address: backend.URL}},
+			Concurrency: Concurrency{MaxRequests: 1, QueueTimeout: 50 * time.Millisecond},
+		}},
+	})
+
+	go lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/post", nil))
+	<-started
+
+	start := time.Now()
+	rr := httptest.NewRecorder()
+	lb.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/post", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 once the queue timeout passed, got %d", rr.Code)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected the request to wait for the queue timeout, took %v", elapsed)
+	}
+}
+
+func TestProxyConcurrencyRetryWaits(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+			conn.Close()
+		}
+	}))
+	defer broken.Close()
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer backend.Close()
+
+	lb := newTestLoadBalancer(t, Config{
+		Algorithm: "round-robin",
+		Paths: []Route{{
+			Pattern:     "GET /post",
+			Backends:    []Backend{{Address: broken.URL}, {Address: backend.URL, MaxConcurrent: 1}},
+			Concurrency: Concurrency{QueueSize: 1, QueueTimeout: time.Minute},
+			Retry:       Retry{Attempts: 2},
+		}},
+	})
+	proxy := lb.Proxies["GET /post"]
+
+	codes := make(chan int, 2)
+	serve := func() {
+		rr := httptest.NewRecorder()
+		lb.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/post", nil))
+		codes <- rr.Code
+	}
+	go serve()
+	<-started
+
+	// The second request fails on the broken backend, and its retry waits
+	// for the busy one rather than failing
+	go serve()
+	queued := waitFor(t, func() bool { return proxy.limits.queued() == 1 })
+	close(release)
+	if !queued {
+		t.Fatalf("expected the retry to wait for the busy backend")
+	}
+	for range 2 {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("expected the retry to be proxied once the backend was free, got %d", code)
+		}
+	}
+}
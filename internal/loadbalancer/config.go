@@ -4,14 +4,730 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/harrydayexe/Omni/internal/loadbalancer/balancer"
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
-	Algorithm string   `yaml:"algorithm"`
-	Paths     []string `yaml:"paths"`
+	Algorithm string    `yaml:"algorithm"` // Default algorithm for routes which do not set one
+	HashKey   string    `yaml:"hash_key"`  // Default request key for the consistent-hash algorithm
+	Paths     []Route   `yaml:"paths"`
+	Admin     Admin     `yaml:"admin"`
+	Server    Server    `yaml:"server"`
+	AccessLog AccessLog `yaml:"access_log"`
+}
+
+// AccessLog configures the record written for every proxied request. It is
+// separate from the load balancer's own logs. Changes need a restart.
+type AccessLog struct {
+	Format string `yaml:"format"` // json or combined, requests are not logged if empty
+	File   string `yaml:"file"`   // File to append records to, defaults to stdout
+}
+
+// Server configures the listener for user traffic. Changes need a restart.
+type Server struct {
+	Address           string        `yaml:"address"`             // Defaults to :80, or :443 with TLS
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"` // Defaults to 10s
+	ReadTimeout       time.Duration `yaml:"read_timeout"`        // Time allowed to read a whole request, defaults to 30s
+	WriteTimeout      time.Duration `yaml:"write_timeout"`       // Zero for no limit other than the route timeouts
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`        // Defaults to 2m
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout"`    // Time allowed for requests to finish on shutdown, defaults to 30s
+	TLS               ServerTLS     `yaml:"tls"`
+
+	// ProxyProtocol reads the PROXY protocol v1 or v2 header a load balancer
+	// in front sends on each connection. Only trusted proxies may send one, so
+	// it needs TrustedProxies, which can be 0.0.0.0/0 and ::/0 to trust anyone.
+	ProxyProtocol  bool     `yaml:"proxy_protocol"`
+	TrustedProxies []string `yaml:"trusted_proxies"` // Addresses or CIDRs of proxies whose forwarding headers are believed
+}
+
+// ServerTLS configures TLS termination. TLS is used when a cert file is set,
+// and the cert and key files are reloaded when they change.
+type ServerTLS struct {
+	CertFile        string `yaml:"cert_file"`
+	KeyFile         string `yaml:"key_file"`
+	MinVersion      string `yaml:"min_version"`      // 1.2 or 1.3, defaults to 1.2
+	RedirectAddress string `yaml:"redirect_address"` // If set, plain HTTP requests to this address are redirected to HTTPS
+	DisableHTTP2    bool   `yaml:"disable_http2"`
+}
+
+// Admin configures the separate listener for the load balancer's control
+// endpoints such as /addz. The endpoints are not served at all unless an
+// address is set, and every request must authenticate with either a bearer
+// token or a client certificate signed by the client CA.
+type Admin struct {
+	Address string            `yaml:"address"` // Address to listen on, such as :9090
+	Tokens  map[string]string `yaml:"tokens"`  // Bearer tokens by the name of the caller using them
+	TLS     AdminTLS          `yaml:"tls"`
+}
+
+// AdminTLS configures TLS for the admin listener. Changes need a restart.
+type AdminTLS struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"` // Callers with a certificate signed by this CA need no token
+}
+
+// A Route is a single pattern served by the load balancer along with the
+// settings for its pool of backends. For backwards compatibility a route can
+// also be written as just its pattern, in which case the defaults from the
+// top level of the config are used.
+type Route struct {
+	Pattern     string        `yaml:"pattern"`
+	Algorithm   string        `yaml:"algorithm"`
+	HashKey     string        `yaml:"hash_key"`
+	Backends    []Backend     `yaml:"backends"` // Static backends added when the load balancer starts
+	Timeout     time.Duration `yaml:"timeout"`  // Maximum time for a proxied request, zero for no limit, streams are exempt if the route allows them
+	HealthCheck HealthCheck   `yaml:"health_check"`
+
+	OutlierDetection OutlierDetection `yaml:"outlier_detection"`
+	Retry            Retry            `yaml:"retry"`
+	CircuitBreaker   CircuitBreaker   `yaml:"circuit_breaker"`
+	RateLimit        RateLimit        `yaml:"rate_limit"`
+	Discovery        Discovery        `yaml:"discovery"`
+	Rewrite          Rewrite          `yaml:"rewrite"`
+	FlushInterval    time.Duration    `yaml:"flush_interval"` // Time between flushes of a response to the client, negative to flush after every write
+	Streaming        bool             `yaml:"streaming"`      // Lets WebSockets and event streams outlast the timeouts and concurrency limits once the backend answers with one
+	Mirror           Mirror           `yaml:"mirror"`
+	Groups           []BackendGroup   `yaml:"groups"` // Named pools traffic is split between, in place of backends
+	Concurrency      Concurrency      `yaml:"concurrency"`
+}
+
+// A BackendGroup is a named pool of backends, such as the stable and canary
+// releases of a service. Requests are split between the groups of a route by
+// their weights, unless they match the overrides of a group.
+type BackendGroup struct {
+	Name     string     `yaml:"name"`
+	Weight   int        `yaml:"weight"` // Percentage of requests sent to the group, the weights of a route add up to 100
+	Backends []Backend  `yaml:"backends"`
+	Match    GroupMatch `yaml:"match"`
+}
+
+// GroupMatch sends every request carrying one of its headers or cookies with
+// the given value to the group, whatever its weight
+type GroupMatch struct {
+	Headers map[string]string `yaml:"headers"` // Such as X-Omni-Canary: "1"
+	Cookies map[string]string `yaml:"cookies"`
+}
+
+// Mirror copies a share of a route's requests to a shadow pool of backends, so
+// a new build can be tried against real traffic. The shadow responses are
+// discarded, and how they differ from the primary responses is logged.
+type Mirror struct {
+	Backends    []Backend     `yaml:"backends"`      // Shadow pool, requests are not mirrored if empty
+	Percent     int           `yaml:"percent"`       // Share of requests mirrored, defaults to 100
+	Timeout     time.Duration `yaml:"timeout"`       // Time allowed for each mirrored request, defaults to 10s
+	MaxInFlight int           `yaml:"max_in_flight"` // Most mirrored requests at once, others are not mirrored, defaults to 100
+}
+
+// Rewrite changes requests before they are sent to a backend and responses
+// before they are returned to the client
+type Rewrite struct {
+	StripPrefix     string      `yaml:"strip_prefix"`     // Removed from the start of the path, such as /api/read
+	AddPrefix       string      `yaml:"add_prefix"`       // Added to the start of the path once any prefix is stripped
+	Host            string      `yaml:"host"`             // Host header sent to backends, defaults to the backend address
+	RequestHeaders  HeaderRules `yaml:"request_headers"`  // Applied after the load balancer sets its own headers
+	ResponseHeaders HeaderRules `yaml:"response_headers"` // Applied to every response from a backend
+}
+
+// HeaderRules change the headers of a request or response. Headers are
+// removed first, then set, then appended to.
+type HeaderRules struct {
+	Set    map[string]string `yaml:"set"`    // Replaces any values the header has
+	Append map[string]string `yaml:"append"` // Adds a value, keeping any the header has
+	Remove []string          `yaml:"remove"`
+}
+
+// Discovery finds the backends of a route by resolving a DNS name, such as a
+// Kubernetes headless service, instead of listing them. The name is resolved
+// again on every interval and backends are added and removed to match.
+type Discovery struct {
+	Name     string        `yaml:"name"`     // DNS name to resolve, discovery is off if empty
+	Type     string        `yaml:"type"`     // a to look up A and AAAA records, or srv, defaults to a
+	Port     int           `yaml:"port"`     // Port of the backends, needed for a records as srv records have their own
+	Scheme   string        `yaml:"scheme"`   // http or https, defaults to http
+	Interval time.Duration `yaml:"interval"` // Time between lookups, defaults to 30s
+}
+
+// A RateLimit limits how often each client can call a route, using a token
+// bucket per client. Routes are not limited unless Requests is set.
+type RateLimit struct {
+	Requests int           `yaml:"requests"` // Requests allowed each Per
+	Per      time.Duration `yaml:"per"`      // Defaults to 1s
+	Burst    int           `yaml:"burst"`    // Requests allowed at once, defaults to Requests
+	Key      string        `yaml:"key"`      // ip for the peer, forwarded-for for the client behind trusted proxies, or jwt-subject, defaults to ip
+	MaxKeys  int           `yaml:"max_keys"` // Clients tracked at once, defaults to 10000
+
+	// JWTSecretEnv names the environment variable holding the secret OmniAuth
+	// signs tokens with, which the jwt-subject key verifies tokens with.
+	// Defaults to JWT_SECRET.
+	JWTSecretEnv string `yaml:"jwt_secret_env"`
+}
+
+// Concurrency limits the requests a route sends to its backends at once.
+// Requests over a limit wait in a queue, and are let through in the order
+// they arrived as requests finish. Streams are exempt.
+type Concurrency struct {
+	MaxRequests   int           `yaml:"max_requests"`    // Requests proxied for the route at once, zero for no limit
+	MaxPerBackend int           `yaml:"max_per_backend"` // Requests sent to each backend at once, zero for no limit, overridden by the max_concurrent of a backend
+	QueueSize     int           `yaml:"queue_size"`      // Requests which can wait at once, defaults to 100
+	QueueTimeout  time.Duration `yaml:"queue_timeout"`   // Time a request can wait before it fails with 503, defaults to 1s
+}
+
+// A CircuitBreaker describes when requests stop being sent to a backend
+// because too many of them are failing. Once a breaker has been open for
+// OpenDuration a few trial requests decide whether it closes again.
+type CircuitBreaker struct {
+	Disabled      bool          `yaml:"disabled"`
+	Window        time.Duration `yaml:"window"`         // Sliding window the error rate is measured over, defaults to 10s
+	MinRequests   int           `yaml:"min_requests"`   // Requests needed in the window before the breaker can open, defaults to 20
+	ErrorRate     int           `yaml:"error_rate"`     // Percentage of 5xx responses in the window which opens the breaker, defaults to 50
+	OpenDuration  time.Duration `yaml:"open_duration"`  // Time the breaker stays open before trying the backend, defaults to 30s
+	TrialRequests int           `yaml:"trial_requests"` // Requests let through while half-open, which all must pass to close, defaults to 1
+}
+
+// Retry describes how requests which fail to reach a backend are retried on
+// a different one. Only idempotent requests, and POSTs with an
+// Idempotency-Key header, are retried.
+type Retry struct {
+	Attempts      int           `yaml:"attempts"`        // Most tries for a request including the first, defaults to 3, 1 disables retries
+	PerTryTimeout time.Duration `yaml:"per_try_timeout"` // Time allowed for each try, zero for no limit other than the route timeout
+	Budget        int           `yaml:"budget"`          // Most retries in flight as a percentage of requests in flight, defaults to 20
+}
+
+// OutlierDetection describes how backends which keep failing real requests
+// are ejected from the balancer, even if they pass their health checks
+type OutlierDetection struct {
+	Disabled           bool          `yaml:"disabled"`
+	ConsecutiveErrors  int           `yaml:"consecutive_errors"`   // 5xx responses or transport errors in a row before ejecting, defaults to 5
+	BaseEjectionTime   time.Duration `yaml:"base_ejection_time"`   // First ejection period, doubled on each ejection, defaults to 30s
+	MaxEjectionTime    time.Duration `yaml:"max_ejection_time"`    // Longest ejection period, defaults to 5m
+	MaxEjectionPercent int           `yaml:"max_ejection_percent"` // Most of the pool which can be ejected at once, defaults to 50
+}
+
+// A HealthCheck describes how the backends of a route are actively probed.
+// It can be written as just the path to probe, in which case the defaults are
+// used for everything else.
+type HealthCheck struct {
+	Path               string        `yaml:"path"`                // Defaults to /readyz
+	ExpectedStatus     StatusRange   `yaml:"expected_status"`     // Defaults to 200-299
+	Interval           time.Duration `yaml:"interval"`            // Time between probes, defaults to 10s
+	Timeout            time.Duration `yaml:"timeout"`             // Time allowed for each probe, defaults to 5s
+	HealthyThreshold   int           `yaml:"healthy_threshold"`   // Consecutive passes before a new or failed backend is used, defaults to 2
+	UnhealthyThreshold int           `yaml:"unhealthy_threshold"` // Consecutive failures before a backend is removed, defaults to 3
+}
+
+// A StatusRange is an inclusive range of HTTP status codes, written as either
+// a single code such as 200 or a range such as 200-399
+type StatusRange struct {
+	Min int
+	Max int
+}
+
+// A Backend is a statically configured server for a route. It can be written
+// as just its address, in which case it has a weight of 1.
+type Backend struct {
+	Address       string `yaml:"address"`
+	Weight        int    `yaml:"weight"`
+	MaxConcurrent int    `yaml:"max_concurrent"` // Requests sent to the backend at once, zero for the limit of the route
+}
+
+// options returns the options the proxy uses for the backend, where the
+// weight defaults to 1
+func (b Backend) options() balancer.ServerOptions {
+	weight := b.Weight
+	if weight == 0 {
+		weight = 1
+	}
+	return balancer.ServerOptions{Weight: weight, MaxConcurrent: b.MaxConcurrent}
+}
+
+func (r *Route) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var pattern string
+	if err := unmarshal(&pattern); err == nil {
+		*r = Route{Pattern: pattern}
+		return nil
+	}
+
+	// Use a different type so that this method is not called recursively
+	type plain Route
+	return unmarshal((*plain)(r))
+}
+
+func (b *Backend) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var address string
+	if err := unmarshal(&address); err == nil {
+		*b = Backend{Address: address}
+		return nil
+	}
+
+	type plain Backend
+	return unmarshal((*plain)(b))
+}
+
+func (h *HealthCheck) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var path string
+	if err := unmarshal(&path); err == nil {
+		*h = HealthCheck{Path: path}
+		return nil
+	}
+
+	type plain HealthCheck
+	return unmarshal((*plain)(h))
+}
+
+func (s *StatusRange) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+
+	parsed, err := parseStatusRange(str)
+	if err != nil {
+		return err
+	}
+	*s = parsed
+	return nil
+}
+
+func parseStatusRange(s string) (StatusRange, error) {
+	minString, maxString, isRange := strings.Cut(s, "-")
+	if !isRange {
+		maxString = minString
+	}
+
+	min, err := strconv.Atoi(strings.TrimSpace(minString))
+	if err != nil {
+		return StatusRange{}, fmt.Errorf("status range %q could not be parsed: %w", s, err)
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(maxString))
+	if err != nil {
+		return StatusRange{}, fmt.Errorf("status range %q could not be parsed: %w", s, err)
+	}
+	return StatusRange{Min: min, Max: max}, nil
+}
+
+// Contains reports whether the status code is within the range
+func (s StatusRange) Contains(status int) bool {
+	return status >= s.Min && status <= s.Max
+}
+
+func (s StatusRange) String() string {
+	if s.Min == s.Max {
+		return strconv.Itoa(s.Min)
+	}
+	return strconv.Itoa(s.Min) + "-" + strconv.Itoa(s.Max)
+}
+
+// withDefaults fills in any settings which were left out of the config
+func (h HealthCheck) withDefaults() HealthCheck {
+	if h.Path == "" {
+		h.Path = "/readyz"
+	}
+	if h.ExpectedStatus == (StatusRange{}) {
+		h.ExpectedStatus = StatusRange{Min: 200, Max: 299}
+	}
+	if h.Interval == 0 {
+		h.Interval = 10 * time.Second
+	}
+	if h.Timeout == 0 {
+		h.Timeout = 5 * time.Second
+	}
+	if h.HealthyThreshold == 0 {
+		h.HealthyThreshold = 2
+	}
+	if h.UnhealthyThreshold == 0 {
+		h.UnhealthyThreshold = 3
+	}
+	return h
+}
+
+func (h *HealthCheck) IsValid() error {
+	if h.Path != "" && h.Path[0] != '/' {
+		return fmt.Errorf("health check path %s must start with /", h.Path)
+	}
+	if h.ExpectedStatus != (StatusRange{}) &&
+		(h.ExpectedStatus.Min < 100 || h.ExpectedStatus.Max > 599 || h.ExpectedStatus.Min > h.ExpectedStatus.Max) {
+		return fmt.Errorf("health check expected status %s is not a valid range of status codes", h.ExpectedStatus)
+	}
+	if h.Interval < 0 || h.Timeout < 0 {
+		return errors.New("health check interval and timeout must not be negative")
+	}
+	if h.HealthyThreshold < 0 || h.UnhealthyThreshold < 0 {
+		return errors.New("health check thresholds must not be negative")
+	}
+	return nil
+}
+
+// withDefaults fills in any settings which were left out of the config
+func (o OutlierDetection) withDefaults() OutlierDetection {
+	if o.ConsecutiveErrors == 0 {
+		o.ConsecutiveErrors = 5
+	}
+	if o.BaseEjectionTime == 0 {
+		o.BaseEjectionTime = 30 * time.Second
+	}
+	if o.MaxEjectionTime == 0 {
+		o.MaxEjectionTime = 5 * time.Minute
+	}
+	if o.MaxEjectionPercent == 0 {
+		o.MaxEjectionPercent = 50
+	}
+	return o
+}
+
+func (o *OutlierDetection) IsValid() error {
+	if o.ConsecutiveErrors < 0 {
+		return errors.New("outlier detection consecutive errors must not be negative")
+	}
+	if o.BaseEjectionTime < 0 || o.MaxEjectionTime < 0 {
+		return errors.New("outlier detection ejection times must not be negative")
+	}
+	if o.MaxEjectionPercent < 0 || o.MaxEjectionPercent > 100 {
+		return errors.New("outlier detection max ejection percent must be between 0 and 100")
+	}
+	return nil
+}
+
+// withDefaults fills in any settings which were left out of the config
+func (r Retry) withDefaults() Retry {
+	if r.Attempts == 0 {
+		r.Attempts = 3
+	}
+	if r.Budget == 0 {
+		r.Budget = 20
+	}
+	return r
+}
+
+func (r *Retry) IsValid() error {
+	if r.Attempts < 0 {
+		return errors.New("retry attempts must not be negative")
+	}
+	if r.PerTryTimeout < 0 {
+		return errors.New("retry per try timeout must not be negative")
+	}
+	if r.Budget < 0 || r.Budget > 100 {
+		return errors.New("retry budget must be between 0 and 100")
+	}
+	return nil
+}
+
+// withDefaults fills in any settings which were left out of the config
+func (c CircuitBreaker) withDefaults() CircuitBreaker {
+	if c.Window == 0 {
+		c.Window = 10 * time.Second
+	}
+	if c.MinRequests == 0 {
+		c.MinRequests = 20
+	}
+	if c.ErrorRate == 0 {
+		c.ErrorRate = 50
+	}
+	if c.OpenDuration == 0 {
+		c.OpenDuration = 30 * time.Second
+	}
+	if c.TrialRequests == 0 {
+		c.TrialRequests = 1
+	}
+	return c
+}
+
+func (c *CircuitBreaker) IsValid() error {
+	if c.Window < 0 || c.OpenDuration < 0 {
+		return errors.New("circuit breaker window and open duration must not be negative")
+	}
+	if c.Window != 0 && c.Window < breakerBuckets*time.Millisecond {
+		return fmt.Errorf("circuit breaker window must be at least %v", breakerBuckets*time.Millisecond)
+	}
+	if c.MinRequests < 0 || c.TrialRequests < 0 {
+		return errors.New("circuit breaker request counts must not be negative")
+	}
+	if c.ErrorRate < 0 || c.ErrorRate > 100 {
+		return errors.New("circuit breaker error rate must be between 0 and 100")
+	}
+	return nil
+}
+
+func (a *Admin) IsValid() error {
+	if a.Address == "" {
+		if len(a.Tokens) > 0 || a.TLS != (AdminTLS{}) {
+			return errors.New("admin tokens or tls are set without an admin address")
+		}
+		return nil
+	}
+
+	if len(a.Tokens) == 0 && a.TLS.ClientCAFile == "" {
+		return errors.New("the admin listener needs tokens or a client CA to authenticate callers")
+	}
+	for name, token := range a.Tokens {
+		if token == "" {
+			return fmt.Errorf("admin token for %s is empty", name)
+		}
+	}
+	if (a.TLS.CertFile == "") != (a.TLS.KeyFile == "") {
+		return errors.New("admin tls needs both a cert file and a key file")
+	}
+	if a.TLS.ClientCAFile != "" && a.TLS.CertFile == "" {
+		return errors.New("admin client CA needs a cert file and a key file")
+	}
+	return nil
+}
+
+// withDefaults fills in any settings which were left out of the config
+func (r RateLimit) withDefaults() RateLimit {
+	if r.Requests == 0 {
+		return r
+	}
+	if r.Per == 0 {
+		r.Per = time.Second
+	}
+	if r.Burst == 0 {
+		r.Burst = r.Requests
+	}
+	if r.Key == "" {
+		r.Key = rateLimitByIP
+	}
+	if r.MaxKeys == 0 {
+		r.MaxKeys = 10000
+	}
+	if r.Key == rateLimitByJWTSubject && r.JWTSecretEnv == "" {
+		r.JWTSecretEnv = "JWT_SECRET"
+	}
+	return r
+}
+
+func (r *RateLimit) IsValid() error {
+	if r.Requests < 0 || r.Burst < 0 || r.MaxKeys < 0 {
+		return errors.New("rate limit requests, burst and max keys must not be negative")
+	}
+	if r.Per < 0 {
+		return errors.New("rate limit period must not be negative")
+	}
+	switch r.Key {
+	case "", rateLimitByIP, rateLimitByForwardedFor, rateLimitByJWTSubject:
+	default:
+		return fmt.Errorf("rate limit key %s is unknown, expected ip, forwarded-for or jwt-subject", r.Key)
+	}
+	if spec := r.withDefaults(); spec.Key == rateLimitByJWTSubject && os.Getenv(spec.JWTSecretEnv) == "" {
+		return fmt.Errorf("rate limit key jwt-subject needs the token secret in $%s", spec.JWTSecretEnv)
+	}
+	return nil
+}
+
+// withDefaults fills in any settings which were left out of the config. It is
+// applied by the proxy rather than Config.Routes, as the queue is used by
+// backends with their own limits even when the route has none.
+func (c Concurrency) withDefaults() Concurrency {
+	if c.QueueSize == 0 {
+		c.QueueSize = 100
+	}
+	if c.QueueTimeout == 0 {
+		c.QueueTimeout = time.Second
+	}
+	return c
+}
+
+func (c *Concurrency) IsValid() error {
+	if c.MaxRequests < 0 || c.MaxPerBackend < 0 || c.QueueSize < 0 {
+		return errors.New("concurrency limits and queue size must not be negative")
+	}
+	if c.QueueTimeout < 0 {
+		return errors.New("concurrency queue timeout must not be negative")
+	}
+	return nil
+}
+
+// withDefaults fills in any settings which were left out of the config
+func (d Discovery) withDefaults() Discovery {
+	if d.Name == "" {
+		return d
+	}
+	if d.Type == "" {
+		d.Type = discoveryA
+	}
+	if d.Scheme == "" {
+		d.Scheme = "http"
+	}
+	if d.Interval == 0 {
+		d.Interval = 30 * time.Second
+	}
+	return d
+}
+
+func (d *Discovery) IsValid() error {
+	if d.Name == "" {
+		if *d != (Discovery{}) {
+			return errors.New("discovery settings are set without a name")
+		}
+		return nil
+	}
+	if d.Interval < 0 {
+		return errors.New("discovery interval must not be negative")
+	}
+	if d.Port < 0 || d.Port > 65535 {
+		return fmt.Errorf("discovery port %d is out of range", d.Port)
+	}
+	switch d.Type {
+	case "", discoveryA:
+		if d.Port == 0 {
+			return errors.New("discovery of a records needs a port")
+		}
+	case discoverySRV:
+		if d.Port != 0 {
+			return errors.New("discovery of srv records takes the port from the records")
+		}
+	default:
+		return fmt.Errorf("discovery type %s is unknown, expected a or srv", d.Type)
+	}
+	switch d.Scheme {
+	case "", "http", "https":
+	default:
+		return fmt.Errorf("discovery scheme %s is unknown, expected http or https", d.Scheme)
+	}
+	return nil
+}
+
+// withDefaults fills in any settings which were left out of the config
+func (m Mirror) withDefaults() Mirror {
+	if len(m.Backends) == 0 {
+		return m
+	}
+	if m.Percent == 0 {
+		m.Percent = 100
+	}
+	if m.Timeout == 0 {
+		m.Timeout = 10 * time.Second
+	}
+	if m.MaxInFlight == 0 {
+		m.MaxInFlight = 100
+	}
+	return m
+}
+
+func (m *Mirror) IsValid() error {
+	if len(m.Backends) == 0 {
+		if m.Percent != 0 || m.Timeout != 0 || m.MaxInFlight != 0 {
+			return errors.New("mirror settings are set without any backends")
+		}
+		return nil
+	}
+	if err := validateBackends(m.Backends); err != nil {
+		return fmt.Errorf("invalid mirror backend: %w", err)
+	}
+	if m.Percent < 0 || m.Percent > 100 {
+		return errors.New("mirror percent must be between 0 and 100")
+	}
+	if m.Timeout < 0 || m.MaxInFlight < 0 {
+		return errors.New("mirror timeout and max in flight must not be negative")
+	}
+	return nil
+}
+
+func (r *Rewrite) IsValid() error {
+	for _, prefix := range []string{r.StripPrefix, r.AddPrefix} {
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("rewrite prefix %s must start with /", prefix)
+		}
+	}
+	if strings.ContainsAny(r.Host, "/ \t\r\n") {
+		return fmt.Errorf("rewrite host %q is not a valid host", r.Host)
+	}
+	if err := r.RequestHeaders.IsValid(); err != nil {
+		return fmt.Errorf("invalid request headers: %w", err)
+	}
+	if err := r.ResponseHeaders.IsValid(); err != nil {
+		return fmt.Errorf("invalid response headers: %w", err)
+	}
+	return nil
+}
+
+func (h *HeaderRules) IsValid() error {
+	names := slices.Clone(h.Remove)
+	for _, values := range []map[string]string{h.Set, h.Append} {
+		for name, value := range values {
+			if strings.ContainsAny(value, "\r\n") {
+				return fmt.Errorf("header %s has a value containing a line break", name)
+			}
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		if name == "" || strings.IndexFunc(name, isNotToken) != -1 {
+			return fmt.Errorf("header name %q is not valid", name)
+		}
+	}
+	return nil
+}
+
+// withDefaults fills in any settings which were left out of the config
+func (s Server) withDefaults() Server {
+	if s.Address == "" {
+		s.Address = ":80"
+		if s.TLS.CertFile != "" {
+			s.Address = ":443"
+		}
+	}
+	if s.ReadHeaderTimeout == 0 {
+		s.ReadHeaderTimeout = 10 * time.Second
+	}
+	if s.ReadTimeout == 0 {
+		s.ReadTimeout = 30 * time.Second
+	}
+	if s.IdleTimeout == 0 {
+		s.IdleTimeout = 2 * time.Minute
+	}
+	if s.ShutdownTimeout == 0 {
+		s.ShutdownTimeout = 30 * time.Second
+	}
+	if s.TLS.MinVersion == "" {
+		s.TLS.MinVersion = "1.2"
+	}
+	return s
+}
+
+func (s *Server) IsValid() error {
+	if s.ReadHeaderTimeout < 0 || s.ReadTimeout < 0 || s.WriteTimeout < 0 || s.IdleTimeout < 0 || s.ShutdownTimeout < 0 {
+		return errors.New("server timeouts must not be negative")
+	}
+	if (s.TLS.CertFile == "") != (s.TLS.KeyFile == "") {
+		return errors.New("server tls needs both a cert file and a key file")
+	}
+	if s.TLS.CertFile == "" && (s.TLS.RedirectAddress != "" || s.TLS.MinVersion != "") {
+		return errors.New("server tls settings are set without a cert file")
+	}
+	if s.TLS.MinVersion != "" {
+		if _, err := parseTLSVersion(s.TLS.MinVersion); err != nil {
+			return err
+		}
+	}
+	if _, err := parseTrustedProxies(s.TrustedProxies); err != nil {
+		return err
+	}
+	if s.ProxyProtocol && len(s.TrustedProxies) == 0 {
+		return errors.New("server proxy_protocol needs trusted_proxies to say which peers may send a header")
+	}
+	return nil
+}
+
+func (a *AccessLog) IsValid() error {
+	switch a.Format {
+	case "":
+		if a.File != "" {
+			return errors.New("an access log file is set without a format")
+		}
+	case accessLogJSON, accessLogCombined:
+	default:
+		return fmt.Errorf("access log format %s is unknown, expected json or combined", a.Format)
+	}
+	return nil
 }
 
 // ReadConfig read configuration from `fileName` file
@@ -34,29 +750,309 @@ func ReadConfig(fileName string, logger *slog.Logger) (Config, error) {
 
 func (c *Config) Print(logger *slog.Logger) {
 	logger.Info("Algorithm", slog.String("algorithm", c.Algorithm))
-	paths := make([]any, len(c.Paths))
-	for i, path := range c.Paths {
-		paths[i] = slog.String("path", path)
+	if c.HashKey != "" {
+		logger.Info("Hash key", slog.String("hash_key", c.HashKey))
+	}
+	for _, route := range c.Routes() {
+		logger.Info("Path",
+			slog.String("path", route.Pattern),
+			slog.String("algorithm", route.Algorithm),
+			slog.Int("backends", len(route.staticBackends())),
+			slog.Duration("timeout", route.Timeout),
+			slog.String("health_check", route.HealthCheck.Path),
+			slog.Duration("health_check_interval", route.HealthCheck.Interval),
+		)
 	}
-	logger.Info("Paths", paths...)
 }
 
-func (c *Config) IsValid() error {
-	if c.Algorithm != "round-robin" {
-		return errors.New("the algorithm is unknown")
+// Routes returns the configured routes with the top level defaults filled in
+func (c *Config) Routes() []Route {
+	routes := make([]Route, len(c.Paths))
+	for i, route := range c.Paths {
+		if route.Algorithm == "" {
+			route.Algorithm = c.Algorithm
+		}
+		if route.HashKey == "" {
+			route.HashKey = c.HashKey
+		}
+		route.HealthCheck = route.HealthCheck.withDefaults()
+		route.OutlierDetection = route.OutlierDetection.withDefaults()
+		route.Retry = route.Retry.withDefaults()
+		route.CircuitBreaker = route.CircuitBreaker.withDefaults()
+		route.RateLimit = route.RateLimit.withDefaults()
+		route.Discovery = route.Discovery.withDefaults()
+		route.Mirror = route.Mirror.withDefaults()
+		routes[i] = route
 	}
+	return routes
+}
 
+func (c *Config) IsValid() error {
 	if len(c.Paths) == 0 {
 		return errors.New("no paths are defined")
 	}
 
-	for _, path := range c.Paths {
-		_, err := parsePattern(path)
+	for _, route := range c.Routes() {
+		if err := route.IsValid(); err != nil {
+			return fmt.Errorf("invalid route %s: %w", route.Pattern, err)
+		}
+		// Without trusted proxies X-Forwarded-For is whatever the client
+		// says, so each request could claim a bucket of its own
+		if route.RateLimit.Key == rateLimitByForwardedFor && len(c.Server.TrustedProxies) == 0 {
+			return fmt.Errorf("invalid route %s: rate limit key forwarded-for needs the trusted proxies of the server to be set", route.Pattern)
+		}
+	}
+
+	if err := c.Admin.IsValid(); err != nil {
+		return fmt.Errorf("invalid admin config: %w", err)
+	}
+
+	if err := c.Server.IsValid(); err != nil {
+		return fmt.Errorf("invalid server config: %w", err)
+	}
+
+	if err := c.AccessLog.IsValid(); err != nil {
+		return fmt.Errorf("invalid access log config: %w", err)
+	}
+
+	return c.checkConflicts()
+}
+
+// checkConflicts reports paths which match the same requests as another path
+// or one of the load balancer's own public endpoints, as the mux cannot choose
+// between them. Paths with a host only conflict with paths for the same host,
+// and with the endpoints registered for that host, see hostPatterns.
+func (c *Config) checkConflicts() error {
+	routes := make([]*pattern, 0, len(c.Paths))
+	for _, route := range c.Paths {
+		pat, err := parsePattern(route.Pattern)
 		if err != nil {
-			return fmt.Errorf("invalid path pattern found for %s when parsing: %w", path, err)
+			return err
 		}
+		routes = append(routes, pat)
+	}
 
+	reserved := hostPatterns(reservedPatterns, patternHosts(routes))
+	patterns := make([]*pattern, 0, len(reserved)+len(routes))
+	for _, endpoint := range reserved {
+		pat, err := parsePattern(endpoint)
+		if err != nil {
+			return err
+		}
+		patterns = append(patterns, pat)
+	}
+
+	for _, pat := range routes {
+		for _, other := range patterns {
+			if pat.conflictsWith(other) {
+				return fmt.Errorf("path %s conflicts with %s: %s", pat, other, describeConflict(pat, other))
+			}
+		}
+		patterns = append(patterns, pat)
+	}
+
+	return nil
+}
+
+// patternHosts returns the hosts the patterns are qualified with, sorted and
+// without duplicates
+func patternHosts(patterns []*pattern) []string {
+	var hosts []string
+	for _, pat := range patterns {
+		if pat.host != "" {
+			hosts = append(hosts, pat.host)
+		}
+	}
+	slices.Sort(hosts)
+	return slices.Compact(hosts)
+}
+
+// hostPatterns returns the patterns, which must each have a method, along
+// with a copy of each for every host.
+// A pattern with a host takes precedence over one without, so a path such as
+// www.omni.example/ would otherwise hide the unqualified patterns for
+// requests to that host.
+func hostPatterns(patterns []string, hosts []string) []string {
+	all := slices.Clone(patterns)
+	for _, host := range hosts {
+		for _, pat := range patterns {
+			method, path, _ := strings.Cut(pat, " ")
+			all = append(all, method+" "+host+path)
+		}
+	}
+	return all
+}
+
+func (r *Route) IsValid() error {
+	if !balancer.IsSupported(r.Algorithm) {
+		return errors.New("the algorithm is unknown")
+	}
+
+	pat, err := parsePattern(r.Pattern)
+	if err != nil {
+		return fmt.Errorf("invalid path pattern found for %s when parsing: %w", r.Pattern, err)
+	}
+
+	// The mux matches the host of a request without its port, and browsers
+	// and proxies send it in lower case
+	if strings.Contains(pat.host, ":") {
+		return fmt.Errorf("the host of %s must not include a port", r.Pattern)
+	}
+	if pat.host != strings.ToLower(pat.host) {
+		return fmt.Errorf("the host of %s must be lower case", r.Pattern)
+	}
+
+	if r.HashKey != "" {
+		key, err := parseRequestKey(r.HashKey)
+		if err != nil {
+			return err
+		}
+		if err := key.validFor(pat); err != nil {
+			return fmt.Errorf("invalid hash key: %w", err)
+		}
+	} else if r.Algorithm == "consistent-hash" {
+		return errors.New("the consistent-hash algorithm needs a hash_key")
+	}
+
+	if err := validateBackends(r.Backends); err != nil {
+		return err
+	}
+
+	if err := r.validateGroups(); err != nil {
+		return err
+	}
+
+	if r.Timeout < 0 {
+		return errors.New("the timeout must not be negative")
+	}
+
+	if err := r.HealthCheck.IsValid(); err != nil {
+		return err
+	}
+
+	if err := r.OutlierDetection.IsValid(); err != nil {
+		return err
+	}
+
+	if err := r.Retry.IsValid(); err != nil {
+		return err
 	}
 
+	if err := r.CircuitBreaker.IsValid(); err != nil {
+		return err
+	}
+
+	if err := r.RateLimit.IsValid(); err != nil {
+		return err
+	}
+
+	if err := r.Concurrency.IsValid(); err != nil {
+		return err
+	}
+
+	if err := r.Discovery.IsValid(); err != nil {
+		return err
+	}
+
+	if err := r.Rewrite.IsValid(); err != nil {
+		return err
+	}
+
+	return r.Mirror.IsValid()
+}
+
+// validateGroups checks the names and weights of the groups of the route, and
+// that each backend belongs to only one of them
+func (r *Route) validateGroups() error {
+	if len(r.Groups) == 0 {
+		return nil
+	}
+	if len(r.Backends) > 0 {
+		return errors.New("a route with groups must list its backends in the groups")
+	}
+	if r.Discovery.Name != "" {
+		return errors.New("a route with groups cannot use discovery")
+	}
+
+	names := make(map[string]bool)
+	addresses := make(map[string]bool)
+	total := 0
+	for _, group := range r.Groups {
+		if group.Name == "" {
+			return errors.New("every group must have a name")
+		}
+		if names[group.Name] {
+			return fmt.Errorf("group %s is listed more than once", group.Name)
+		}
+		names[group.Name] = true
+
+		if group.Weight < 0 || group.Weight > 100 {
+			return fmt.Errorf("the weight of group %s must be between 0 and 100", group.Name)
+		}
+		total += group.Weight
+
+		if err := validateBackends(group.Backends); err != nil {
+			return fmt.Errorf("invalid backend in group %s: %w", group.Name, err)
+		}
+		for _, backend := range group.Backends {
+			address, _ := parseBackendAddress(backend.Address)
+			if addresses[address.Host] {
+				return fmt.Errorf("backend %s is in more than one group", backend.Address)
+			}
+			addresses[address.Host] = true
+		}
+
+		for _, fields := range []map[string]string{group.Match.Headers, group.Match.Cookies} {
+			for name, value := range fields {
+				if name == "" || strings.IndexFunc(name, isNotToken) != -1 {
+					return fmt.Errorf("group %s matches on %q, which is not a valid name", group.Name, name)
+				}
+				if strings.ContainsAny(value, "\r\n") {
+					return fmt.Errorf("group %s matches %s on a value with a line break", group.Name, name)
+				}
+			}
+		}
+	}
+	if total != 100 {
+		return fmt.Errorf("the weights of the groups of %s add up to %d rather than 100", r.Pattern, total)
+	}
 	return nil
 }
+
+// staticBackends returns the backends listed in the config for the route,
+// including those in its groups
+func (r Route) staticBackends() []Backend {
+	backends := slices.Clone(r.Backends)
+	for _, group := range r.Groups {
+		backends = append(backends, group.Backends...)
+	}
+	return backends
+}
+
+func validateBackends(backends []Backend) error {
+	for _, backend := range backends {
+		if _, err := parseBackendAddress(backend.Address); err != nil {
+			return err
+		}
+		if backend.Weight < 0 {
+			return fmt.Errorf("backend %s has a negative weight", backend.Address)
+		}
+		if backend.MaxConcurrent < 0 {
+			return fmt.Errorf("backend %s has a negative max concurrent", backend.Address)
+		}
+	}
+	return nil
+}
+
+// parseBackendAddress parses a backend address, which must be an absolute URL
+// such as http://omniread:80
+func parseBackendAddress(address string) (*url.URL, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("backend address %s could not be parsed: %w", address, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("backend address %s must include a scheme and host", address)
+	}
+	return u, nil
+}
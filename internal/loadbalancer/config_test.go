@@ -3,7 +3,9 @@ package loadbalancer
 import (
 	"io"
 	"log/slog"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestReadConfig(t *testing.T) {
@@ -21,11 +23,111 @@ func TestReadConfig(t *testing.T) {
 		t.Fatalf("expected 2 paths, got %d paths\n", len(config.Paths))
 	}
 
-	if config.Paths[0] != "GET /test1" {
-		t.Fatalf("unexpected %s, got %s", "GET /test1\n", config.Paths[0])
+	if config.Paths[0].Pattern != "GET /test1" {
+		t.Fatalf("unexpected %s, got %s", "GET /test1\n", config.Paths[0].Pattern)
 	}
-	if config.Paths[1] != "POST /test2" {
-		t.Fatalf("unexpected %s, got %s", "POST /test2\n", config.Paths[1])
+	if config.Paths[1].Pattern != "POST /test2" {
+		t.Fatalf("unexpected %s, got %s", "POST /test2\n", config.Paths[1].Pattern)
+	}
+}
+
+func TestReadConfigRoutes(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	config, err := ReadConfig("../../testdata/loadbalancer-routes-config.yaml", logger)
+	if err != nil {
+		t.Fatalf("error reading config: %v", err)
+	}
+
+	if err := config.IsValid(); err != nil {
+		t.Fatalf("expected config to be valid, got %v", err)
+	}
+
+	defaultHealthCheck := HealthCheck{
+		Path:               "/readyz",
+		ExpectedStatus:     StatusRange{Min: 200, Max: 299},
+		Interval:           10 * time.Second,
+		Timeout:            5 * time.Second,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+	}
+	defaultOutlierDetection := OutlierDetection{
+		ConsecutiveErrors:  5,
+		BaseEjectionTime:   30 * time.Second,
+		MaxEjectionTime:    5 * time.Minute,
+		MaxEjectionPercent: 50,
+	}
+	defaultRetry := Retry{Attempts: 3, Budget: 20}
+	defaultCircuitBreaker := CircuitBreaker{
+		Window:        10 * time.Second,
+		MinRequests:   20,
+		ErrorRate:     50,
+		OpenDuration:  30 * time.Second,
+		TrialRequests: 1,
+	}
+
+	want := []Route{
+		{
+			Pattern:     "POST /post",
+			Algorithm:   "least-connections",
+			Backends:    []Backend{{Address: "http://omniwrite-1:80", Weight: 2}, {Address: "http://omniwrite-2:80"}},
+			Timeout:     30 * time.Second,
+			HealthCheck: defaultHealthCheck,
+
+			OutlierDetection: defaultOutlierDetection,
+			Retry:            defaultRetry,
+			CircuitBreaker:   defaultCircuitBreaker,
+		},
+		{
+			Pattern:     "GET /post/{id}",
+			Algorithm:   "round-robin",
+			Backends:    []Backend{{Address: "http://omniread:80"}},
+			Timeout:     10 * time.Second,
+			HealthCheck: defaultHealthCheck,
+
+			OutlierDetection: defaultOutlierDetection,
+			Retry:            defaultRetry,
+			CircuitBreaker:   defaultCircuitBreaker,
+			RateLimit:        RateLimit{Requests: 100, Per: time.Minute, Burst: 100, Key: "forwarded-for", MaxKeys: 10000},
+			Rewrite: Rewrite{
+				AddPrefix:       "/api",
+				RequestHeaders:  HeaderRules{Set: map[string]string{"X-Gateway": "public"}},
+				ResponseHeaders: HeaderRules{Remove: []string{"X-Proxy"}},
+			},
+		},
+		{
+			Pattern:   "POST /login",
+			Algorithm: "round-robin",
+			Timeout:   2 * time.Second,
+			HealthCheck: HealthCheck{
+				Path:               "/healthz",
+				ExpectedStatus:     StatusRange{Min: 200, Max: 399},
+				Interval:           5 * time.Second,
+				Timeout:            time.Second,
+				HealthyThreshold:   1,
+				UnhealthyThreshold: 2,
+			},
+			OutlierDetection: OutlierDetection{
+				ConsecutiveErrors:  3,
+				BaseEjectionTime:   10 * time.Second,
+				MaxEjectionTime:    5 * time.Minute,
+				MaxEjectionPercent: 50,
+			},
+			Retry:          Retry{Attempts: 2, PerTryTimeout: 500 * time.Millisecond, Budget: 20},
+			CircuitBreaker: defaultCircuitBreaker,
+		},
+		{
+			Pattern:     "GET /",
+			Algorithm:   "round-robin",
+			HealthCheck: defaultHealthCheck,
+
+			OutlierDetection: defaultOutlierDetection,
+			Retry:            defaultRetry,
+			CircuitBreaker:   defaultCircuitBreaker,
+		},
+	}
+
+	if !reflect.DeepEqual(config.Routes(), want) {
+		t.Fatalf("got routes %+v\nwant %+v", config.Routes(), want)
 	}
 }
 
@@ -45,6 +147,32 @@ func TestReadConfigInvalidYaml(t *testing.T) {
 	}
 }
 
+// patterns builds routes in the backwards compatible string-only form
+func patterns(p ...string) []Route {
+	routes := make([]Route, len(p))
+	for i, pattern := range p {
+		routes[i] = Route{Pattern: pattern}
+	}
+	return routes
+}
+
+func TestHostConflictDescribed(t *testing.T) {
+	config := Config{
+		Algorithm: "round-robin",
+		Paths:     patterns("api.omni.example/post/latest", "GET api.omni.example/post/{id}"),
+	}
+
+	err := config.IsValid()
+	if err == nil {
+		t.Fatalf("expected paths on the same host to conflict")
+	}
+	want := "path GET api.omni.example/post/{id} conflicts with api.omni.example/post/latest: " +
+		"GET api.omni.example/post/{id} matches fewer methods than api.omni.example/post/latest, but has a more general path pattern"
+	if got := err.Error(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
 func TestIsValidConfig(t *testing.T) {
 	var cases = []struct {
 		name          string
@@ -55,15 +183,58 @@ func TestIsValidConfig(t *testing.T) {
 			name: "valid config",
 			config: Config{
 				Algorithm: "round-robin",
-				Paths:     []string{"GET /test1", "POST /test2"},
+				Paths:     patterns("GET /test1", "POST /test2"),
 			},
 			expectedError: false,
 		},
+		{
+			name: "valid least-connections config",
+			config: Config{
+				Algorithm: "least-connections",
+				Paths:     patterns("GET /test1", "POST /test2"),
+			},
+			expectedError: false,
+		},
+		{
+			name: "valid consistent-hash config",
+			config: Config{
+				Algorithm: "consistent-hash",
+				Paths:     patterns("GET /post/{id}", "GET /post/{id}/comments"),
+				HashKey:   "path:id",
+			},
+			expectedError: false,
+		},
+		{
+			name: "consistent-hash without hash key",
+			config: Config{
+				Algorithm: "consistent-hash",
+				Paths:     patterns("GET /post/{id}"),
+			},
+			expectedError: true,
+		},
+		{
+			name: "hash key wildcard missing from a path",
+			config: Config{
+				Algorithm: "consistent-hash",
+				Paths:     patterns("GET /post/{id}", "GET /posts"),
+				HashKey:   "path:id",
+			},
+			expectedError: true,
+		},
+		{
+			name: "invalid hash key",
+			config: Config{
+				Algorithm: "consistent-hash",
+				Paths:     patterns("GET /post/{id}"),
+				HashKey:   "query:id",
+			},
+			expectedError: true,
+		},
 		{
 			name: "invalid algorithm",
 			config: Config{
 				Algorithm: "invalid-algorithm",
-				Paths:     []string{"GET /test1", "POST /test2"},
+				Paths:     patterns("GET /test1", "POST /test2"),
 			},
 			expectedError: true,
 		},
@@ -71,15 +242,558 @@ func TestIsValidConfig(t *testing.T) {
 			name: "invalid path",
 			config: Config{
 				Algorithm: "round-robin",
-				Paths:     []string{"GET /test1", "POST /test2", "invalid-path"},
+				Paths:     patterns("GET /test1", "POST /test2", "invalid-path"),
+			},
+			expectedError: true,
+		},
+		{
+			name: "routes with their own algorithms",
+			config: Config{
+				Paths: []Route{
+					{Pattern: "POST /post", Algorithm: "least-connections"},
+					{Pattern: "GET /post/{id}", Algorithm: "round-robin"},
+				},
+			},
+			expectedError: false,
+		},
+		{
+			name: "route without an algorithm and no default",
+			config: Config{
+				Paths: []Route{
+					{Pattern: "POST /post", Algorithm: "least-connections"},
+					{Pattern: "GET /post/{id}"},
+				},
+			},
+			expectedError: true,
+		},
+		{
+			name: "route with a valid backend",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "GET /post/{id}", Backends: []Backend{{Address: "http://omniread:80", Weight: 2}}},
+				},
+			},
+			expectedError: false,
+		},
+		{
+			name: "route with a backend missing its scheme",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "GET /post/{id}", Backends: []Backend{{Address: "omniread:80"}}},
+				},
+			},
+			expectedError: true,
+		},
+		{
+			name: "route with a negative backend weight",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "GET /post/{id}", Backends: []Backend{{Address: "http://omniread:80", Weight: -1}}},
+				},
+			},
+			expectedError: true,
+		},
+		{
+			name: "route with a negative timeout",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "GET /post/{id}", Timeout: -time.Second},
+				},
+			},
+			expectedError: true,
+		},
+		{
+			name: "route with a relative health check path",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "GET /post/{id}", HealthCheck: HealthCheck{Path: "readyz"}},
+				},
+			},
+			expectedError: true,
+		},
+		{
+			name: "health check with an inverted status range",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "GET /post/{id}", HealthCheck: HealthCheck{ExpectedStatus: StatusRange{Min: 299, Max: 200}}},
+				},
+			},
+			expectedError: true,
+		},
+		{
+			name: "health check with a negative threshold",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "GET /post/{id}", HealthCheck: HealthCheck{UnhealthyThreshold: -1}},
+				},
+			},
+			expectedError: true,
+		},
+		{
+			name: "outlier detection with a negative error count",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "GET /post/{id}", OutlierDetection: OutlierDetection{ConsecutiveErrors: -1}},
+				},
+			},
+			expectedError: true,
+		},
+		{
+			name: "outlier detection ejecting more than the whole pool",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "GET /post/{id}", OutlierDetection: OutlierDetection{MaxEjectionPercent: 150}},
+				},
+			},
+			expectedError: true,
+		},
+		{
+			name: "retry budget over 100 percent",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "GET /post/{id}", Retry: Retry{Budget: 101}},
+				},
+			},
+			expectedError: true,
+		},
+		{
+			name: "circuit breaker error rate over 100 percent",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "GET /post/{id}", CircuitBreaker: CircuitBreaker{ErrorRate: 120}},
+				},
+			},
+			expectedError: true,
+		},
+		{
+			name: "rate limit by forwarded for without trusted proxies",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "GET /post/{id}", RateLimit: RateLimit{Requests: 10, Key: "forwarded-for"}},
+				},
+			},
+			expectedError: true,
+		},
+		{
+			name: "rate limit by forwarded for with trusted proxies",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "GET /post/{id}", RateLimit: RateLimit{Requests: 10, Key: "forwarded-for"}},
+				},
+				Server: Server{TrustedProxies: []string{"10.0.0.0/8"}},
+			},
+			expectedError: false,
+		},
+		{
+			name: "rate limit with an unknown key",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "GET /post/{id}", RateLimit: RateLimit{Requests: 10, Key: "cookie"}},
+				},
+			},
+			expectedError: true,
+		},
+		{
+			name: "discovery of a records",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "GET /post/{id}", Discovery: Discovery{Name: "omniread.default.svc.cluster.local", Port: 80}},
+				},
+			},
+			expectedError: false,
+		},
+		{
+			name: "discovery of a records without a port",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "GET /post/{id}", Discovery: Discovery{Name: "omniread.default.svc.cluster.local"}},
+				},
+			},
+			expectedError: true,
+		},
+		{
+			name: "discovery of srv records with a port",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "GET /post/{id}", Discovery: Discovery{Name: "_http._tcp.omniread", Type: "srv", Port: 80}},
+				},
+			},
+			expectedError: true,
+		},
+		{
+			name: "discovery settings without a name",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "GET /post/{id}", Discovery: Discovery{Port: 80}},
+				},
+			},
+			expectedError: true,
+		},
+		{
+			name: "rewrite prefix without a leading slash",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "GET /api/read/", Rewrite: Rewrite{StripPrefix: "api/read"}},
+				},
+			},
+			expectedError: true,
+		},
+		{
+			name: "rewrite header with an invalid name",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "GET /api/read/", Rewrite: Rewrite{ResponseHeaders: HeaderRules{Remove: []string{"X Proxy"}}}},
+				},
 			},
 			expectedError: true,
 		},
+		{
+			name: "rewrite header value with a line break",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "GET /api/read/", Rewrite: Rewrite{RequestHeaders: HeaderRules{Set: map[string]string{"X-Gateway": "public\r\nX-Admin: true"}}}},
+				},
+			},
+			expectedError: true,
+		},
+		{
+			name: "mirror to a shadow pool",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "POST /post", Mirror: Mirror{Backends: []Backend{{Address: "http://omniwrite-canary:80"}}, Percent: 10}},
+				},
+			},
+			expectedError: false,
+		},
+		{
+			name: "mirror percent over 100",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "POST /post", Mirror: Mirror{Backends: []Backend{{Address: "http://omniwrite-canary:80"}}, Percent: 150}},
+				},
+			},
+			expectedError: true,
+		},
+		{
+			name: "mirror with an invalid backend",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "POST /post", Mirror: Mirror{Backends: []Backend{{Address: "omniwrite-canary"}}}},
+				},
+			},
+			expectedError: true,
+		},
+		{
+			name: "mirror settings without backends",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{
+					{Pattern: "POST /post", Mirror: Mirror{Percent: 10}},
+				},
+			},
+			expectedError: true,
+		},
+		{
+			name: "server tls with an unsupported version",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths:     patterns("GET /"),
+				Server:    Server{TLS: ServerTLS{CertFile: "cert.pem", KeyFile: "key.pem", MinVersion: "1.0"}},
+			},
+			expectedError: true,
+		},
+		{
+			name: "server redirect without a certificate",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths:     patterns("GET /"),
+				Server:    Server{TLS: ServerTLS{RedirectAddress: ":80"}},
+			},
+			expectedError: true,
+		},
+		{
+			name: "server with an invalid trusted proxy",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths:     patterns("GET /"),
+				Server:    Server{ProxyProtocol: true, TrustedProxies: []string{"10.0.0.0/33"}},
+			},
+			expectedError: true,
+		},
+		{
+			name: "server proxy protocol without trusted proxies",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths:     patterns("GET /"),
+				Server:    Server{ProxyProtocol: true},
+			},
+			expectedError: true,
+		},
+		{
+			name: "server behind trusted proxies",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths:     patterns("GET /"),
+				Server:    Server{ProxyProtocol: true, TrustedProxies: []string{"10.0.0.0/8", "2001:db8::1"}},
+			},
+			expectedError: false,
+		},
+		{
+			name: "access log with an unknown format",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths:     patterns("GET /"),
+				AccessLog: AccessLog{Format: "apache"},
+			},
+			expectedError: true,
+		},
+		{
+			name: "access log file without a format",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths:     patterns("GET /"),
+				AccessLog: AccessLog{File: "access.log"},
+			},
+			expectedError: true,
+		},
+		{
+			name: "conflicting paths",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths:     patterns("GET /post/{id}", "GET /post/{postId}"),
+			},
+			expectedError: true,
+		},
+		{
+			name: "overlapping paths",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths:     patterns("GET /post/{id}/comments", "GET /post/latest/{rest...}"),
+			},
+			expectedError: true,
+		},
+		{
+			name: "same path on different hosts",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths:     patterns("api.omni.example/post/{id}", "www.omni.example/post/{id}", "GET /post/{id}", "www.omni.example/"),
+			},
+			expectedError: false,
+		},
+		{
+			name: "conflicting paths on the same host",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths:     patterns("GET api.omni.example/post/{id}", "GET api.omni.example/post/{postId}"),
+			},
+			expectedError: true,
+		},
+		{
+			name: "host path conflicting with a load balancer endpoint",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths:     patterns("GET api.omni.example/readyz"),
+			},
+			expectedError: true,
+		},
+		{
+			name: "host with a port",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths:     patterns("api.omni.example:8080/post/{id}"),
+			},
+			expectedError: true,
+		},
+		{
+			name: "host in upper case",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths:     patterns("API.omni.example/post/{id}"),
+			},
+			expectedError: true,
+		},
+		{
+			name: "path conflicting with a load balancer endpoint",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths:     patterns("GET /readyz"),
+			},
+			expectedError: true,
+		},
+		{
+			name: "path matching an admin endpoint on the public listener",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths:     patterns("POST /addz"),
+			},
+			expectedError: false,
+		},
+		{
+			name: "admin listener without authentication",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths:     patterns("GET /"),
+				Admin:     Admin{Address: ":9090"},
+			},
+			expectedError: true,
+		},
+		{
+			name: "admin tokens without an address",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths:     patterns("GET /"),
+				Admin:     Admin{Tokens: map[string]string{"deploy": "secret"}},
+			},
+			expectedError: true,
+		},
+		{
+			name: "admin client CA without a certificate",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths:     patterns("GET /"),
+				Admin:     Admin{Address: ":9090", TLS: AdminTLS{ClientCAFile: "ca.pem"}},
+			},
+			expectedError: true,
+		},
+		{
+			name: "admin listener with a token",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths:     patterns("GET /"),
+				Admin:     Admin{Address: ":9090", Tokens: map[string]string{"deploy": "secret"}},
+			},
+			expectedError: false,
+		},
+		{
+			name: "route with canary groups",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{{
+					Pattern: "GET /post/{id}",
+					Groups: []BackendGroup{
+						{Name: "stable", Weight: 95, Backends: []Backend{{Address: "http://omniread-v1:80"}}},
+						{Name: "canary", Weight: 5, Backends: []Backend{{Address: "http://omniread-v2:80"}}, Match: GroupMatch{Headers: map[string]string{"X-Omni-Canary": "1"}}},
+					},
+				}},
+			},
+			expectedError: false,
+		},
+		{
+			name: "group weights not adding up to 100",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{{
+					Pattern: "GET /post/{id}",
+					Groups: []BackendGroup{
+						{Name: "stable", Weight: 90, Backends: []Backend{{Address: "http://omniread-v1:80"}}},
+						{Name: "canary", Weight: 5, Backends: []Backend{{Address: "http://omniread-v2:80"}}},
+					},
+				}},
+			},
+			expectedError: true,
+		},
+		{
+			name: "backend in two groups",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{{
+					Pattern: "GET /post/{id}",
+					Groups: []BackendGroup{
+						{Name: "stable", Weight: 50, Backends: []Backend{{Address: "http://omniread:80"}}},
+						{Name: "canary", Weight: 50, Backends: []Backend{{Address: "http://omniread:80"}}},
+					},
+				}},
+			},
+			expectedError: true,
+		},
+		{
+			name: "groups alongside backends",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{{
+					Pattern:  "GET /post/{id}",
+					Backends: []Backend{{Address: "http://omniread:80"}},
+					Groups:   []BackendGroup{{Name: "stable", Weight: 100}},
+				}},
+			},
+			expectedError: true,
+		},
+		{
+			name: "group matching on an invalid header",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{{
+					Pattern: "GET /post/{id}",
+					Groups:  []BackendGroup{{Name: "stable", Weight: 100, Match: GroupMatch{Headers: map[string]string{"X Canary": "1"}}}},
+				}},
+			},
+			expectedError: true,
+		},
+		{
+			name: "negative concurrency limit",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths:     []Route{{Pattern: "POST /post", Concurrency: Concurrency{MaxRequests: -1}}},
+			},
+			expectedError: true,
+		},
+		{
+			name: "negative backend max concurrent",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths:     []Route{{Pattern: "POST /post", Backends: []Backend{{Address: "http://omniwrite:80", MaxConcurrent: -1}}}},
+			},
+			expectedError: true,
+		},
+		{
+			name: "concurrency limits",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths: []Route{{
+					Pattern:     "POST /post",
+					Backends:    []Backend{{Address: "http://omniwrite:80", MaxConcurrent: 10}},
+					Concurrency: Concurrency{MaxRequests: 100, MaxPerBackend: 20, QueueSize: 50, QueueTimeout: 2 * time.Second},
+				}},
+			},
+			expectedError: false,
+		},
+		{
+			name: "more specific paths do not conflict",
+			config: Config{
+				Algorithm: "round-robin",
+				Paths:     patterns("GET /", "GET /post/{id}", "POST /post"),
+			},
+			expectedError: false,
+		},
 		{
 			name: "empty path",
 			config: Config{
 				Algorithm: "round-robin",
-				Paths:     []string{},
+				Paths:     patterns(),
 			},
 			expectedError: true,
 		},
@@ -96,3 +810,45 @@ func TestIsValidConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestRateLimitJWTSecret(t *testing.T) {
+	spec := RateLimit{Requests: 10, Key: "jwt-subject", JWTSecretEnv: "OMNI_TEST_JWT_SECRET"}
+	if err := spec.IsValid(); err == nil {
+		t.Errorf("expected the jwt-subject key to need a secret")
+	}
+	t.Setenv("OMNI_TEST_JWT_SECRET", "s3cret")
+	if err := spec.IsValid(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestParseStatusRange(t *testing.T) {
+	cases := []struct {
+		input         string
+		want          StatusRange
+		expectedError bool
+	}{
+		{input: "200", want: StatusRange{Min: 200, Max: 200}},
+		{input: "200-399", want: StatusRange{Min: 200, Max: 399}},
+		{input: "2xx", expectedError: true},
+		{input: "200-", expectedError: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			got, err := parseStatusRange(c.input)
+			if c.expectedError {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != c.want {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/harrydayexe/Omni/internal/loadbalancer/balancer"
+)
+
+// The kinds of DNS record backends can be discovered from
+const (
+	discoveryA   = "a" // A and AAAA records, with the port from the config
+	discoverySRV = "srv"
+)
+
+// Time allowed for requests in flight to a backend which is no longer
+// published before it is removed
+const discoveryDrainTimeout = 30 * time.Second
+
+// A Resolver looks up the DNS records used to discover backends.
+// net.DefaultResolver is the one used unless another is set with SetResolver.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+}
+
+// SetResolver changes the resolver used for discovery, which takes effect
+// from the next lookup
+func (p *LoadBalancerProxy) SetResolver(resolver Resolver) {
+	p.Lock()
+	defer p.Unlock()
+	p.resolver = resolver
+}
+
+func (p *LoadBalancerProxy) runDiscovery(ctx context.Context) {
+	ticker := time.NewTicker(p.discoverySpec.withDefaults().Interval)
+	defer ticker.Stop()
+
+	for {
+		p.discover(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// discover looks up the backends of the route and reconciles the pool with
+// them. Only backends which discovery added are removed, static backends and
+// those added through /addz are left alone. A failed or empty lookup keeps
+// the current backends, so a DNS outage does not empty the pool.
+func (p *LoadBalancerProxy) discover(ctx context.Context) {
+	spec := p.discoverySpec.withDefaults()
+
+	lookupCtx, cancel := context.WithTimeout(ctx, spec.Interval)
+	found, err := p.resolve(lookupCtx, spec)
+	cancel()
+	if ctx.Err() != nil {
+		return
+	}
+	if err == nil && len(found) == 0 {
+		err = errors.New("no records found")
+	}
+	if err != nil {
+		p.log().Warn("discovery failed, keeping the current backends", slog.String("path", p.pattern), slog.String("name", spec.Name), slog.Any("error", err))
+		return
+	}
+
+	var added []backendSnapshot
+	var gone []*url.URL
+	p.RLock()
+	for host, server := range p.discoveredMap {
+		if _, ok := found[host]; !ok && p.drainingMap[host] == nil {
+			gone = append(gone, server)
+		}
+	}
+	for host, backend := range found {
+		if _, ok := p.discoveredMap[host]; ok {
+			// Found again while draining, or its weight changed
+			if p.drainingMap[host] != nil || p.optionsMap[host] != backend.options {
+				added = append(added, backend)
+			}
+			continue
+		}
+		if _, exists := p.lookup(backend.url); !exists {
+			added = append(added, backend)
+		}
+	}
+	p.RUnlock()
+
+	for _, backend := range added {
+		p.markDiscovered(backend.url)
+		p.AddWithOptions(backend.url, backend.options)
+		p.log().Info("backend discovered", slog.String("path", p.pattern), slog.String("server", backend.url.String()), slog.Int("weight", backend.options.Weight))
+	}
+	for _, server := range gone {
+		p.log().Info("discovered backend is no longer published", slog.String("path", p.pattern), slog.String("server", server.String()))
+		p.Drain(server, discoveryDrainTimeout)
+	}
+}
+
+// resolve returns the backends currently published under the discovery name,
+// indexed by host
+func (p *LoadBalancerProxy) resolve(ctx context.Context, spec Discovery) (map[string]backendSnapshot, error) {
+	p.RLock()
+	resolver := p.resolver
+	p.RUnlock()
+
+	found := make(map[string]backendSnapshot)
+	add := func(host string, port int, weight int) {
+		server := &url.URL{Scheme: spec.Scheme, Host: net.JoinHostPort(host, strconv.Itoa(port))}
+		found[server.Host] = backendSnapshot{url: server, options: balancer.ServerOptions{Weight: max(weight, 1)}}
+	}
+
+	if spec.Type == discoverySRV {
+		// An empty service and proto looks up the name as given, such as
+		// _http._tcp.omniread.default.svc.cluster.local
+		_, records, err := resolver.LookupSRV(ctx, "", "", spec.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			add(strings.TrimSuffix(record.Target, "."), int(record.Port), int(record.Weight))
+		}
+		return found, nil
+	}
+
+	addresses, err := resolver.LookupIPAddr(ctx, spec.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, address := range addresses {
+		add(address.IP.String(), spec.Port, 1)
+	}
+	return found, nil
+}
+
+// markDiscovered records that a backend belongs to discovery, so it is
+// removed once it is no longer published
+func (p *LoadBalancerProxy) markDiscovered(server *url.URL) {
+	p.Lock()
+	defer p.Unlock()
+	p.discoveredMap[server.Host] = server
+}
@@ -0,0 +1,168 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A fakeResolver answers lookups from its records instead of DNS
+type fakeResolver struct {
+	mu  sync.Mutex
+	ips []string
+	srv []*net.SRV
+	err error
+}
+
+func (r *fakeResolver) set(ips []string, srv []*net.SRV, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ips, r.srv, r.err = ips, srv, err
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addresses := make([]net.IPAddr, len(r.ips))
+	for i, ip := range r.ips {
+		addresses[i] = net.IPAddr{IP: net.ParseIP(ip)}
+	}
+	return addresses, r.err
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return name, r.srv, r.err
+}
+
+func newDiscoveryTestProxy(t *testing.T, discovery Discovery, backends ...Backend) (*LoadBalancerProxy, *fakeResolver) {
+	t.Helper()
+	proxy, err := newRouteProxy(Route{Pattern: "GET /", Algorithm: "round-robin", Backends: backends, Discovery: discovery}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resolver := &fakeResolver{}
+	proxy.SetResolver(resolver)
+	return proxy, resolver
+}
+
+func backendURLs(proxy *LoadBalancerProxy) map[string]int {
+	urls := make(map[string]int)
+	for _, backend := range proxy.backends() {
+		urls[backend.url.String()] = backend.options.Weight
+	}
+	return urls
+}
+
+func TestDiscoveryReconcilesARecords(t *testing.T) {
+	proxy, resolver := newDiscoveryTestProxy(t, Discovery{Name: "omniread", Port: 8080})
+
+	resolver.set([]string{"10.0.0.1", "10.0.0.2", "fd00::3"}, nil, nil)
+	proxy.discover(context.Background())
+	if proxy.balancer.Len() != 0 {
+		t.Fatalf("expected discovered backends to wait for their health checks, got %d in the balancer", proxy.balancer.Len())
+	}
+	markAlive(proxy)
+
+	got := backendURLs(proxy)
+	for _, want := range []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080", "http://[fd00::3]:8080"} {
+		if _, ok := got[want]; !ok {
+			t.Errorf("expected %s to be discovered, got %v", want, got)
+		}
+	}
+	if proxy.balancer.Len() != 3 {
+		t.Fatalf("expected 3 backends in the balancer, got %d", proxy.balancer.Len())
+	}
+
+	resolver.set([]string{"10.0.0.2", "10.0.0.4"}, nil, nil)
+	proxy.discover(context.Background())
+
+	// Gone backends have nothing in flight, so their drain finishes straight away
+	if !waitFor(t, func() bool { return len(backendURLs(proxy)) == 2 }) {
+		t.Fatalf("expected backends which are no longer published to be removed, got %v", backendURLs(proxy))
+	}
+	got = backendURLs(proxy)
+	for _, want := range []string{"http://10.0.0.2:8080", "http://10.0.0.4:8080"} {
+		if _, ok := got[want]; !ok {
+			t.Errorf("expected %s to be discovered, got %v", want, got)
+		}
+	}
+}
+
+func TestDiscoverySRVRecords(t *testing.T) {
+	proxy, resolver := newDiscoveryTestProxy(t, Discovery{Name: "_http._tcp.omniread", Type: "srv", Scheme: "https"})
+
+	resolver.set(nil, []*net.SRV{
+		{Target: "omniread-0.omniread.", Port: 8443, Weight: 3},
+		{Target: "omniread-1.omniread.", Port: 8443, Weight: 0},
+	}, nil)
+	proxy.discover(context.Background())
+
+	got := backendURLs(proxy)
+	if got["https://omniread-0.omniread:8443"] != 3 || got["https://omniread-1.omniread:8443"] != 1 {
+		t.Errorf("expected backends weighted from their records, got %v", got)
+	}
+}
+
+func TestDiscoveryFailureKeepsBackends(t *testing.T) {
+	proxy, resolver := newDiscoveryTestProxy(t, Discovery{Name: "omniread", Port: 80})
+
+	resolver.set([]string{"10.0.0.1"}, nil, nil)
+	proxy.discover(context.Background())
+
+	resolver.set(nil, nil, errors.New("server misbehaving"))
+	proxy.discover(context.Background())
+	resolver.set(nil, nil, nil)
+	proxy.discover(context.Background())
+
+	if got := backendURLs(proxy); len(got) != 1 {
+		t.Errorf("expected failed and empty lookups to keep the backends, got %v", got)
+	}
+}
+
+func TestDiscoveryLeavesOtherBackends(t *testing.T) {
+	proxy, resolver := newDiscoveryTestProxy(t, Discovery{Name: "omniread", Port: 80}, Backend{Address: "http://10.0.0.1:80", Weight: 5})
+	proxy.Add(&url.URL{Scheme: "http", Host: "omniread-manual:80"})
+
+	// A published address which is already a static backend keeps its settings
+	resolver.set([]string{"10.0.0.1", "10.0.0.2"}, nil, nil)
+	proxy.discover(context.Background())
+	resolver.set([]string{"10.0.0.2"}, nil, nil)
+	proxy.discover(context.Background())
+
+	got := backendURLs(proxy)
+	if len(got) != 3 || got["http://10.0.0.1:80"] != 5 {
+		t.Errorf("expected static and added backends to be left alone, got %v", got)
+	}
+}
+
+func TestReloadKeepsDiscoveredBackends(t *testing.T) {
+	route := Route{Pattern: "GET /", Discovery: Discovery{Name: "omniread", Port: 80}}
+	lb := newTestLoadBalancer(t, Config{Algorithm: "round-robin", Paths: []Route{route}})
+	resolver := &fakeResolver{}
+	lb.Proxies["GET /"].SetResolver(resolver)
+	resolver.set([]string{"10.0.0.1"}, nil, nil)
+	lb.Proxies["GET /"].discover(context.Background())
+
+	route.Timeout = 5 * time.Second
+	if err := lb.Reload(Config{Algorithm: "round-robin", Paths: []Route{route}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	backends := lb.Proxies["GET /"].backends()
+	if len(backends) != 1 || !backends[0].discovered {
+		t.Errorf("expected the discovered backend to be carried over, got %+v", backends)
+	}
+
+	route.Discovery = Discovery{}
+	if err := lb.Reload(Config{Algorithm: "round-robin", Paths: []Route{route}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if backends := lb.Proxies["GET /"].backends(); len(backends) != 0 {
+		t.Errorf("expected discovered backends to go with discovery, got %+v", backends)
+	}
+}
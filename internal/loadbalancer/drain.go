@@ -0,0 +1,64 @@
+package loadbalancer
+
+import (
+	"errors"
+	"log/slog"
+	"net/url"
+	"time"
+)
+
+// How often a draining backend is checked for requests still in flight
+const drainPollInterval = 100 * time.Millisecond
+
+// errBackendRemoved is returned for a try whose backend was removed after it
+// was picked but before the request was sent to it
+var errBackendRemoved = errors.New("backend was removed before the request was sent")
+
+// A drain is a backend being taken out of use. It is a pointer so a drain
+// which has been cancelled by adding the backend again can tell it no longer
+// applies.
+type drain struct {
+	deadline time.Time
+}
+
+// Drain stops new requests from being sent to a backend, then removes it once
+// the requests in flight have finished or timeout has passed, whichever is
+// first. It returns false if the backend does not exist. Adding the backend
+// again before it is removed cancels the drain.
+func (p *LoadBalancerProxy) Drain(server *url.URL, timeout time.Duration) bool {
+	d := &drain{deadline: time.Now().Add(timeout)}
+
+	p.Lock()
+	existing, ok := p.lookup(server)
+	if !ok {
+		p.Unlock()
+		return false
+	}
+	p.drainingMap[existing.Host] = d
+	stats := p.statsMap[existing.Host]
+	p.Unlock()
+
+	p.updateBalancer(existing)
+	p.log().Info("draining backend", slog.String("path", p.pattern), slog.String("server", existing.String()), slog.Duration("timeout", timeout))
+
+	go func() {
+		for stats != nil && stats.inFlight.Load()+stats.streams.Load() > 0 && time.Now().Before(d.deadline) {
+			time.Sleep(drainPollInterval)
+		}
+
+		p.Lock()
+		if p.drainingMap[existing.Host] != d {
+			p.Unlock()
+			return
+		}
+		p.remove(existing)
+		p.Unlock()
+
+		inFlight := int64(0)
+		if stats != nil {
+			inFlight = stats.inFlight.Load() + stats.streams.Load()
+		}
+		p.log().Info("drained backend", slog.String("path", p.pattern), slog.String("server", existing.String()), slog.Int64("in_flight", inFlight))
+	}()
+	return true
+}
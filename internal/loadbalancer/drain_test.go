@@ -0,0 +1,182 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitFor polls condition until it is true or a second has passed
+func waitFor(t *testing.T, condition func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return condition()
+}
+
+func backendExists(proxy *LoadBalancerProxy, server *url.URL) bool {
+	proxy.RLock()
+	defer proxy.RUnlock()
+	_, ok := proxy.lookup(server)
+	return ok
+}
+
+func TestDrainWaitsForRequestsInFlight(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer slow.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer other.Close()
+
+	proxy, err := newRouteProxy(Route{Pattern: "GET /", Algorithm: "round-robin"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	slowURL, _ := url.Parse(slow.URL)
+	otherURL, _ := url.Parse(other.URL)
+	proxy.Add(slowURL)
+	markAlive(proxy)
+
+	rr := httptest.NewRecorder()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	}()
+	<-started
+	proxy.Add(otherURL)
+	markAlive(proxy)
+
+	if !proxy.Drain(slowURL, time.Minute) {
+		t.Fatalf("expected the backend to be drained")
+	}
+	if proxy.balancer.Len() != 1 {
+		t.Fatalf("expected the draining backend to leave the balancer, got %d backends", proxy.balancer.Len())
+	}
+	for i := 0; i < 3; i++ {
+		next := httptest.NewRecorder()
+		proxy.ServeHTTP(next, httptest.NewRequest(http.MethodGet, "/", nil))
+		if next.Code != http.StatusNoContent {
+			t.Fatalf("expected new requests to skip the draining backend, got %d", next.Code)
+		}
+	}
+	if !backendExists(proxy, slowURL) {
+		t.Fatalf("expected the backend to be kept while a request is in flight")
+	}
+
+	close(release)
+	wg.Wait()
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected the request in flight to finish, got %d", rr.Code)
+	}
+	if !waitFor(t, func() bool { return !backendExists(proxy, slowURL) }) {
+		t.Errorf("expected the backend to be removed once drained")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	proxy, servers := newOutlierTestProxy(t, 2, OutlierDetection{Disabled: true})
+	proxy.statsMap[servers[0].Host].inFlight.Store(1)
+
+	proxy.Drain(servers[0], 50*time.Millisecond)
+
+	if !waitFor(t, func() bool { return !backendExists(proxy, servers[0]) }) {
+		t.Errorf("expected the backend to be removed after the drain timeout")
+	}
+}
+
+func TestAddCancelsDrain(t *testing.T) {
+	proxy, servers := newOutlierTestProxy(t, 2, OutlierDetection{Disabled: true})
+	proxy.statsMap[servers[0].Host].inFlight.Store(1)
+
+	proxy.Drain(servers[0], 50*time.Millisecond)
+	proxy.Add(servers[0])
+
+	if proxy.balancer.Len() != 2 {
+		t.Fatalf("expected adding the backend again to return it to the balancer, got %d backends", proxy.balancer.Len())
+	}
+	time.Sleep(150 * time.Millisecond)
+	if !backendExists(proxy, servers[0]) {
+		t.Errorf("expected adding the backend again to cancel the drain")
+	}
+}
+
+func TestDrainUnknownBackend(t *testing.T) {
+	proxy, _ := newOutlierTestProxy(t, 1, OutlierDetection{Disabled: true})
+
+	if proxy.Drain(&url.URL{Scheme: "http", Host: "unknown:80"}, time.Second) {
+		t.Errorf("expected an unknown backend not to be drained")
+	}
+}
+
+func TestRemoveWhileRequestPicked(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	proxy, err := newRouteProxy(Route{Pattern: "GET /", Algorithm: "round-robin"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	server, _ := url.Parse(backend.URL)
+
+	// Requests racing with the backend being removed and added again must
+	// either reach it or fail cleanly, never panic
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				rr := httptest.NewRecorder()
+				proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+				if rr.Code != http.StatusOK && rr.Code != http.StatusBadGateway {
+					t.Errorf("unexpected status %d", rr.Code)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		proxy.Add(server)
+		proxy.setAlive(server, true)
+		proxy.Remove(server)
+	}
+	wg.Wait()
+}
+
+func TestRemoveBackendDrain(t *testing.T) {
+	lb := newTestLoadBalancer(t, Config{Algorithm: "round-robin", Paths: []Route{
+		{Pattern: "GET /", Backends: []Backend{{Address: "http://localhost:8080"}, {Address: "http://localhost:8081"}}},
+	}})
+
+	rr := httptest.NewRecorder()
+	lb.adminMux.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/removez?path=GET+/&address=http://localhost:8080&drain=30s", nil))
+
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("got %d, want %d", rr.Code, http.StatusAccepted)
+	}
+	proxy := lb.Proxies["GET /"]
+	if !waitFor(t, func() bool { return !backendExists(proxy, &url.URL{Scheme: "http", Host: "localhost:8080"}) }) {
+		t.Errorf("expected a backend with nothing in flight to be removed straight away")
+	}
+}
@@ -0,0 +1,208 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+var (
+	Forwarded        = http.CanonicalHeaderKey("Forwarded")
+	XForwardedHost   = http.CanonicalHeaderKey("X-Forwarded-Host")
+	XForwardedProto  = http.CanonicalHeaderKey("X-Forwarded-Proto")
+	forwardedHeaders = []string{XForwardedHost, XForwardedProto}
+)
+
+// trustedProxies are the networks of the proxies in front of the load
+// balancer, whose forwarding headers are believed
+type trustedProxies []netip.Prefix
+
+// parseTrustedProxies parses a list of addresses and CIDRs such as 10.0.0.0/8
+func parseTrustedProxies(entries []string) (trustedProxies, error) {
+	trusted := make(trustedProxies, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy %s is not an address or CIDR", entry)
+			}
+			addr = addr.Unmap()
+			trusted = append(trusted, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %s is not an address or CIDR", entry)
+		}
+		trusted = append(trusted, prefix.Masked())
+	}
+	return trusted, nil
+}
+
+// contains reports whether the address is one of a trusted proxy
+func (t trustedProxies) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range t {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type clientKey struct{}
+
+// A client is who a request was made by, worked out from the connection and
+// the forwarding headers of any trusted proxies it came through
+type client struct {
+	ip      string
+	trusted bool // Whether the connection is from a trusted proxy, whose forwarding headers are passed on
+}
+
+// trustForwarded records the client of each request in its context before
+// passing it to next
+func trustForwarded(next http.Handler, trusted trustedProxies) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientKey{}, trusted.resolve(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// resolve works out the client of a request. If it came from a trusted proxy,
+// the addresses the proxies forwarded it for are followed back from the most
+// recent until one which is not trusted, which is the client.
+func (t trustedProxies) resolve(r *http.Request) client {
+	c := client{ip: peerIP(r.RemoteAddr)}
+	peer, err := netip.ParseAddr(c.ip)
+	if err != nil || !t.contains(peer) {
+		return c
+	}
+	c.trusted = true
+
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			// Hidden or unknown addresses cannot be followed any further
+			break
+		}
+		c.ip = addr.Unmap().String()
+		if !t.contains(addr) {
+			break
+		}
+	}
+	return c
+}
+
+// forwardedFor returns the addresses a request was forwarded for, from the
+// client to the most recent proxy. The Forwarded header is used if there is
+// one, and X-Forwarded-For otherwise.
+func forwardedFor(header http.Header) []string {
+	var hops []string
+	if values := header.Values(Forwarded); len(values) > 0 {
+		for _, element := range splitHeader(values) {
+			for _, pair := range strings.Split(element, ";") {
+				name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(name, "for") {
+					hops = append(hops, forwardedNode(value))
+				}
+			}
+		}
+		return hops
+	}
+	return splitHeader(header.Values(XForwardedFor))
+}
+
+// splitHeader splits the comma separated values of a header
+func splitHeader(values []string) []string {
+	var parts []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				parts = append(parts, part)
+			}
+		}
+	}
+	return parts
+}
+
+// forwardedNode returns the address of a node in a Forwarded header, such as
+// "[2001:db8::1]:4711", without its quotes, brackets or port
+func forwardedNode(node string) string {
+	node = strings.Trim(node, `"`)
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+}
+
+// peerIP returns the host of an address such as 192.0.2.1:51234
+func peerIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// setForwarded sets the X-Forwarded-* and Forwarded headers of a proxied
+// request. The reverse proxy removes those of the inbound request, so they are
+// only carried over and added to when it came from a trusted proxy.
+func setForwarded(r *httputil.ProxyRequest) {
+	c, _ := r.In.Context().Value(clientKey{}).(client)
+	if c.trusted {
+		if prior := r.In.Header.Values(XForwardedFor); len(prior) > 0 {
+			// SetXForwarded appends the peer to an existing header
+			r.Out.Header[XForwardedFor] = slices.Clone(prior)
+		}
+	}
+	r.SetXForwarded()
+	if c.trusted {
+		// The proxy in front knows best how the client connected
+		for _, name := range forwardedHeaders {
+			if value := r.In.Header.Get(name); value != "" {
+				r.Out.Header.Set(name, value)
+			}
+		}
+	}
+
+	elements := []string{forwardedElement(r.In)}
+	if c.trusted {
+		elements = append(r.In.Header.Values(Forwarded), elements...)
+	}
+	r.Out.Header.Set(Forwarded, strings.Join(elements, ", "))
+}
+
+// forwardedElement describes the hop from the peer to the load balancer as
+// an element of a Forwarded header, as set out in RFC 7239
+func forwardedElement(r *http.Request) string {
+	node := peerIP(r.RemoteAddr)
+	if addr, err := netip.ParseAddr(node); err == nil && addr.Unmap().Is6() {
+		node = "[" + addr.String() + "]"
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	pairs := []string{"for=" + quoteForwarded(node)}
+	if r.Host != "" {
+		pairs = append(pairs, "host="+quoteForwarded(r.Host))
+	}
+	pairs = append(pairs, "proto="+proto)
+	return strings.Join(pairs, ";")
+}
+
+// quoteForwarded returns the value as a token if it is one, and as a quoted
+// string otherwise
+func quoteForwarded(value string) string {
+	if value != "" && strings.IndexFunc(value, isNotToken) == -1 {
+		return value
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
@@ -0,0 +1,132 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, entry := range []string{"10.0.0.0/33", "omni-lb", ""} {
+		if _, err := parseTrustedProxies([]string{entry}); err == nil {
+			t.Errorf("expected %q to be rejected", entry)
+		}
+	}
+}
+
+func TestResolveClient(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "2001:db8::1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cases := []struct {
+		name        string
+		remoteAddr  string
+		header      string
+		value       string
+		wantIP      string
+		wantTrusted bool
+	}{
+		{name: "untrusted peer", remoteAddr: "203.0.113.7:51234", header: XForwardedFor, value: "198.51.100.1", wantIP: "203.0.113.7"},
+		{name: "trusted peer without headers", remoteAddr: "10.0.0.1:51234", wantIP: "10.0.0.1", wantTrusted: true},
+		{name: "trusted peer", remoteAddr: "10.0.0.1:51234", header: XForwardedFor, value: "203.0.113.7", wantIP: "203.0.113.7", wantTrusted: true},
+		{name: "spoofed hop", remoteAddr: "10.0.0.1:51234", header: XForwardedFor, value: "198.51.100.1, 203.0.113.7, 10.0.0.2", wantIP: "203.0.113.7", wantTrusted: true},
+		{name: "forwarded", remoteAddr: "10.0.0.1:51234", header: Forwarded, value: `for=198.51.100.1, for="[2001:db8:cafe::17]:4711";proto=https`, wantIP: "2001:db8:cafe::17", wantTrusted: true},
+		{name: "hidden hop", remoteAddr: "10.0.0.1:51234", header: Forwarded, value: "for=_hidden, for=10.0.0.3", wantIP: "10.0.0.3", wantTrusted: true},
+		{name: "trusted ipv6 peer", remoteAddr: "[2001:db8::1]:51234", header: XForwardedFor, value: "203.0.113.7", wantIP: "203.0.113.7", wantTrusted: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			got := trusted.resolve(req)
+			if got.ip != tt.wantIP || got.trusted != tt.wantTrusted {
+				t.Errorf("got %+v, want ip %s and trusted %v", got, tt.wantIP, tt.wantTrusted)
+			}
+		})
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	received := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	lb := newTestLoadBalancer(t, Config{
+		Algorithm: "round-robin",
+		Paths:     []Route{{Pattern: "GET /post/{id}", Backends: []Backend{{Address: backend.URL}}}},
+	})
+	trusted, _ := parseTrustedProxies([]string{"10.0.0.0/8"})
+	handler := trustForwarded(lb, trusted)
+
+	cases := []struct {
+		name          string
+		remoteAddr    string
+		wantRealIP    string
+		wantForFor    string
+		wantForwarded string
+		wantProto     string
+	}{
+		{
+			name:          "untrusted peer",
+			remoteAddr:    "203.0.113.7:51234",
+			wantRealIP:    "203.0.113.7",
+			wantForFor:    "203.0.113.7",
+			wantForwarded: `for=203.0.113.7;host=omni.example;proto=http`,
+			wantProto:     "http",
+		},
+		{
+			name:          "trusted peer",
+			remoteAddr:    "10.0.0.1:51234",
+			wantRealIP:    "198.51.100.1",
+			wantForFor:    "198.51.100.1, 10.0.0.1",
+			wantForwarded: `for=198.51.100.1;proto=https, for=10.0.0.1;host=omni.example;proto=http`,
+			wantProto:     "https",
+		},
+		{
+			name:          "ipv6 peer",
+			remoteAddr:    "[2001:db8::7]:51234",
+			wantRealIP:    "2001:db8::7",
+			wantForFor:    "2001:db8::7",
+			wantForwarded: `for="[2001:db8::7]";host=omni.example;proto=http`,
+			wantProto:     "http",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://omni.example/post/1", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set(XForwardedFor, "198.51.100.1")
+			req.Header.Set(XForwardedProto, "https")
+			req.Header.Set(Forwarded, "for=198.51.100.1;proto=https")
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("unexpected status %d", rr.Code)
+			}
+
+			header := <-received
+			for name, want := range map[string]string{
+				XRealIP:         tt.wantRealIP,
+				XForwardedFor:   tt.wantForFor,
+				Forwarded:       tt.wantForwarded,
+				XForwardedProto: tt.wantProto,
+			} {
+				if got := header.Get(name); got != want {
+					t.Errorf("expected %s of %q, got %q", name, want, got)
+				}
+			}
+		})
+	}
+}
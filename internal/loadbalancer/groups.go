@@ -0,0 +1,234 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+
+	"github.com/harrydayexe/Omni/internal/loadbalancer/balancer"
+)
+
+// A backendGroup is one of the named pools a route splits its traffic
+// between. Each group has its own balancer, while the state of its backends is
+// kept in the maps of the proxy along with every other backend.
+type backendGroup struct {
+	name     string
+	weight   atomic.Int64 // Percentage of requests, which can be changed at runtime
+	match    GroupMatch
+	balancer balancer.Balancer
+	requests atomic.Int64 // Requests sent to the group since the proxy was created
+}
+
+// newBackendGroups creates the groups of a route, each with an empty balancer
+// using the algorithm of the route
+func newBackendGroups(route Route) ([]*backendGroup, error) {
+	groups := make([]*backendGroup, 0, len(route.Groups))
+	for _, spec := range route.Groups {
+		bal, err := balancer.BuildBalancer(route.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+		group := &backendGroup{name: spec.Name, match: spec.Match, balancer: bal}
+		group.weight.Store(int64(spec.Weight))
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// matches reports whether the request carries one of the headers or cookies
+// which override the weights and send it to the group
+func (g *backendGroup) matches(r *http.Request) bool {
+	for name, value := range g.match.Headers {
+		if r.Header.Get(name) == value {
+			return true
+		}
+	}
+	for name, value := range g.match.Cookies {
+		if cookie, err := r.Cookie(name); err == nil && cookie.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// pickGroup selects the group for the request. A request matching the
+// overrides of a group is always sent to it, and any other is sent to a group
+// chosen by weight from those with backends available. It returns nil if the
+// route has no groups or none can take the request.
+func (p *LoadBalancerProxy) pickGroup(r *http.Request) *backendGroup {
+	for _, group := range p.groups {
+		if group.matches(r) {
+			return group
+		}
+	}
+
+	var total int64
+	for _, group := range p.groups {
+		if group.balancer.Len() > 0 {
+			total += group.weight.Load()
+		}
+	}
+	if total <= 0 {
+		return nil
+	}
+
+	n := rand.Int64N(total)
+	for _, group := range p.groups {
+		if group.balancer.Len() == 0 {
+			continue
+		}
+		if n -= group.weight.Load(); n < 0 {
+			return group
+		}
+	}
+	return nil
+}
+
+// selectBalancer returns the balancer to pick the backends for the request
+// from, which is the balancer of its group if the route has groups
+func (p *LoadBalancerProxy) selectBalancer(r *http.Request) balancer.Balancer {
+	if len(p.groups) == 0 {
+		return p.balancer
+	}
+	group := p.pickGroup(r)
+	if group == nil {
+		// Every group is empty, so the proxy balancer reports the error
+		return p.balancer
+	}
+	group.requests.Add(1)
+	return group.balancer
+}
+
+// balancerOf returns the balancer a backend belongs in. Must be called with
+// the lock held.
+func (p *LoadBalancerProxy) balancerOf(host string) balancer.Balancer {
+	if group := p.groupMap[host]; group != nil {
+		return group.balancer
+	}
+	return p.balancer
+}
+
+// setGroup records the group of a backend, or that it has none if the group
+// is nil. Must be called with the lock held.
+func (p *LoadBalancerProxy) setGroup(host string, group *backendGroup) {
+	if group == nil {
+		delete(p.groupMap, host)
+		return
+	}
+	if p.groupMap == nil {
+		p.groupMap = make(map[string]*backendGroup)
+	}
+	p.groupMap[host] = group
+}
+
+// groupName returns the name of the group, or an empty string for a nil group
+func (g *backendGroup) groupName() string {
+	if g == nil {
+		return ""
+	}
+	return g.name
+}
+
+// group returns the group with the given name, or nil if there is none
+func (p *LoadBalancerProxy) group(name string) *backendGroup {
+	for _, group := range p.groups {
+		if group.name == name {
+			return group
+		}
+	}
+	return nil
+}
+
+// AddToGroup adds a server to the named group, or moves it there if it is
+// already in another. A route with groups needs a group for every backend,
+// while a route without them takes an empty name and behaves as
+// AddWithOptions.
+func (p *LoadBalancerProxy) AddToGroup(server *url.URL, name string, options balancer.ServerOptions) error {
+	if name == "" {
+		if len(p.groups) > 0 {
+			return errors.New("the path splits its traffic between groups, so a group is required")
+		}
+		p.AddWithOptions(server, options)
+		return nil
+	}
+
+	group := p.group(name)
+	if group == nil {
+		return fmt.Errorf("the path has no group %s", name)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.add(server, group, options)
+	return nil
+}
+
+// SetGroupWeights changes the weights of the groups of the route. Every group
+// must be given a weight, and the weights must add up to 100. The weights are
+// kept until the route is changed by a reload.
+func (p *LoadBalancerProxy) SetGroupWeights(weights map[string]int) error {
+	if len(p.groups) == 0 {
+		return errors.New("the path does not split its traffic between groups")
+	}
+
+	total := 0
+	for name, weight := range weights {
+		if p.group(name) == nil {
+			return fmt.Errorf("the path has no group %s", name)
+		}
+		if weight < 0 || weight > 100 {
+			return fmt.Errorf("the weight of group %s must be between 0 and 100", name)
+		}
+		total += weight
+	}
+	if len(weights) != len(p.groups) {
+		return errors.New("every group of the path must be given a weight")
+	}
+	if total != 100 {
+		return fmt.Errorf("the weights add up to %d rather than 100", total)
+	}
+
+	// Hold the lock so concurrent changes are applied one after the other
+	p.Lock()
+	defer p.Unlock()
+	for _, group := range p.groups {
+		group.weight.Store(int64(weights[group.name]))
+	}
+	return nil
+}
+
+// available returns the number of backends the balancers of the proxy are
+// currently using
+func (p *LoadBalancerProxy) available() int {
+	n := p.balancer.Len()
+	for _, group := range p.groups {
+		n += group.balancer.Len()
+	}
+	return n
+}
+
+// A groupStatus describes a group for the admin endpoints
+type groupStatus struct {
+	Name      string `json:"name"`
+	Weight    int64  `json:"weight"`
+	Available int    `json:"available"`
+	Requests  int64  `json:"requests"`
+}
+
+// groupStatuses describes every group of the proxy, in the order of the
+// config
+func (p *LoadBalancerProxy) groupStatuses() []groupStatus {
+	statuses := make([]groupStatus, 0, len(p.groups))
+	for _, group := range p.groups {
+		statuses = append(statuses, groupStatus{
+			Name:      group.name,
+			Weight:    group.weight.Load(),
+			Available: group.balancer.Len(),
+			Requests:  group.requests.Load(),
+		})
+	}
+	return statuses
+}
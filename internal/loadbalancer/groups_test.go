@@ -0,0 +1,184 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/harrydayexe/Omni/internal/loadbalancer/balancer"
+)
+
+// newCanaryTestLoadBalancer splits GET /post between a stable and a canary
+// server, sending every request with X-Omni-Canary: 1 to the canary
+func newCanaryTestLoadBalancer(t *testing.T, stable, canary *httptest.Server, canaryWeight int) *LoadBalancer {
+	t.Helper()
+	return newTestLoadBalancer(t, Config{
+		Algorithm: "round-robin",
+		Paths: []Route{{
+			Pattern: "GET /post",
+			Groups: []BackendGroup{
+				{Name: "stable", Weight: 100 - canaryWeight, Backends: []Backend{{Address: stable.URL}}},
+				{
+					Name:     "canary",
+					Weight:   canaryWeight,
+					Backends: []Backend{{Address: canary.URL}},
+					Match:    GroupMatch{Headers: map[string]string{"X-Omni-Canary": "1"}},
+				},
+			},
+		}},
+		Admin: Admin{Address: ":9090", Tokens: map[string]string{"deploy": "s3cret"}},
+	})
+}
+
+func newNamedServer(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	}))
+}
+
+// servedBy counts which server answered each of n requests
+func servedBy(lb *LoadBalancer, n int, header string) map[string]int {
+	counts := make(map[string]int)
+	for range n {
+		req := httptest.NewRequest(http.MethodGet, "/post", nil)
+		if header != "" {
+			req.Header.Set("X-Omni-Canary", header)
+		}
+		rr := httptest.NewRecorder()
+		lb.ServeHTTP(rr, req)
+		counts[rr.Body.String()]++
+	}
+	return counts
+}
+
+func TestGroupsSplitByWeight(t *testing.T) {
+	stable, canary := newNamedServer("stable"), newNamedServer("canary")
+	defer stable.Close()
+	defer canary.Close()
+
+	lb := newCanaryTestLoadBalancer(t, stable, canary, 20)
+	counts := servedBy(lb, 1000, "")
+	if counts["canary"] < 100 || counts["canary"] > 300 {
+		t.Errorf("expected about 200 requests on the canary, got %v", counts)
+	}
+	if counts["stable"]+counts["canary"] != 1000 {
+		t.Errorf("expected every request to be served, got %v", counts)
+	}
+}
+
+func TestGroupsOverride(t *testing.T) {
+	stable, canary := newNamedServer("stable"), newNamedServer("canary")
+	defer stable.Close()
+	defer canary.Close()
+
+	lb := newCanaryTestLoadBalancer(t, stable, canary, 0)
+	if counts := servedBy(lb, 20, "1"); counts["canary"] != 20 {
+		t.Errorf("expected every request with the header on the canary, got %v", counts)
+	}
+	if counts := servedBy(lb, 20, "0"); counts["stable"] != 20 {
+		t.Errorf("expected every request with another value on stable, got %v", counts)
+	}
+}
+
+func TestGroupsSkipEmptyGroup(t *testing.T) {
+	stable, canary := newNamedServer("stable"), newNamedServer("canary")
+	defer stable.Close()
+	defer canary.Close()
+
+	lb := newCanaryTestLoadBalancer(t, stable, canary, 50)
+	canaryURL, _ := url.Parse(canary.URL)
+	lb.Proxies["GET /post"].setAlive(canaryURL, false)
+
+	if counts := servedBy(lb, 20, ""); counts["stable"] != 20 {
+		t.Errorf("expected the weight of the empty canary to go to stable, got %v", counts)
+	}
+}
+
+func TestSetGroupWeights(t *testing.T) {
+	stable, canary := newNamedServer("stable"), newNamedServer("canary")
+	defer stable.Close()
+	defer canary.Close()
+
+	lb := newCanaryTestLoadBalancer(t, stable, canary, 5)
+
+	cases := []struct {
+		name string
+		body string
+		want int
+	}{
+		{name: "unknown path", body: `{"path":"GET /posts","weights":{"stable":0,"canary":100}}`, want: http.StatusNotFound},
+		{name: "unknown group", body: `{"path":"GET /post","weights":{"stable":0,"beta":100}}`, want: http.StatusBadRequest},
+		{name: "missing group", body: `{"path":"GET /post","weights":{"canary":100}}`, want: http.StatusBadRequest},
+		{name: "not adding up to 100", body: `{"path":"GET /post","weights":{"stable":50,"canary":60}}`, want: http.StatusBadRequest},
+		{name: "valid weights", body: `{"path":"GET /post","weights":{"stable":0,"canary":100}}`, want: http.StatusNoContent},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPut, "/weightz", strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer s3cret")
+			rr := httptest.NewRecorder()
+			lb.AdminHandler().ServeHTTP(rr, req)
+			if rr.Code != tt.want {
+				t.Errorf("expected %d, got %d: %s", tt.want, rr.Code, rr.Body.String())
+			}
+		})
+	}
+
+	if counts := servedBy(lb, 20, ""); counts["canary"] != 20 {
+		t.Errorf("expected every request on the canary after the change, got %v", counts)
+	}
+}
+
+func TestAddToGroup(t *testing.T) {
+	stable, canary := newNamedServer("stable"), newNamedServer("canary")
+	defer stable.Close()
+	defer canary.Close()
+	second := newNamedServer("second canary")
+	defer second.Close()
+
+	lb := newCanaryTestLoadBalancer(t, stable, canary, 0)
+
+	cases := []struct {
+		name string
+		body string
+		want int
+	}{
+		{name: "without a group", body: `{"path":"GET /post","address":"` + second.URL + `"}`, want: http.StatusBadRequest},
+		{name: "unknown group", body: `{"path":"GET /post","address":"` + second.URL + `","group":"beta"}`, want: http.StatusBadRequest},
+		{name: "existing group", body: `{"path":"GET /post","address":"` + second.URL + `","group":"canary"}`, want: http.StatusCreated},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/addz", strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer s3cret")
+			rr := httptest.NewRecorder()
+			lb.AdminHandler().ServeHTTP(rr, req)
+			if rr.Code != tt.want {
+				t.Errorf("expected %d, got %d: %s", tt.want, rr.Code, rr.Body.String())
+			}
+		})
+	}
+
+	markAlive(lb.Proxies["GET /post"])
+	counts := servedBy(lb, 20, "1")
+	if counts["canary"] != 10 || counts["second canary"] != 10 {
+		t.Errorf("expected canary requests to be balanced over both canaries, got %v", counts)
+	}
+	if counts := servedBy(lb, 20, ""); counts["stable"] != 20 {
+		t.Errorf("expected other requests to stay on stable, got %v", counts)
+	}
+
+	// Moving a backend to another group takes it out of the first
+	secondURL, _ := url.Parse(second.URL)
+	if err := lb.Proxies["GET /post"].AddToGroup(secondURL, "stable", balancer.ServerOptions{Weight: 1}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if counts := servedBy(lb, 20, "1"); counts["canary"] != 20 {
+		t.Errorf("expected the moved backend to leave the canary group, got %v", counts)
+	}
+}
@@ -2,31 +2,62 @@ package loadbalancer
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
+
+	"github.com/harrydayexe/Omni/internal/loadbalancer/balancer"
 )
 
-func CheckHealth(serviceURL *url.URL) bool {
-	client := http.Client{
-		Timeout: 5 * time.Second, // Set a timeout to avoid hanging indefinitely
-	}
+// healthClient is shared by every probe so connections to backends are
+// reused. Timeouts come from the context of each probe. Redirects are not
+// followed so that 3xx responses can be matched by the expected status.
+var healthClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// healthState is the result of recent probes of a backend
+type healthState struct {
+	successes int       // Consecutive passed probes
+	failures  int       // Consecutive failed probes
+	lastProbe time.Time // When the backend was last probed
+	lastError error     // Why the last probe failed, nil if it passed
+}
+
+// CheckHealth probes a service using the health check spec. It returns nil if
+// the service responded within the timeout with an expected status.
+func CheckHealth(ctx context.Context, serviceURL *url.URL, spec HealthCheck) error {
+	spec = spec.withDefaults()
+
+	ctx, cancel := context.WithTimeout(ctx, spec.Timeout)
+	defer cancel()
 
 	healthEndpoint := url.URL{
 		Scheme: serviceURL.Scheme,
 		Host:   serviceURL.Host,
-		Path:   "/readyz",
+		Path:   spec.Path,
 	}
 
-	resp, err := client.Get(healthEndpoint.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthEndpoint.String(), nil)
 	if err != nil {
-		log.Printf("Error reaching health endpoint: %v", err)
-		return false
+		return err
+	}
+
+	resp, err := healthClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error reaching health endpoint: %w", err)
 	}
 	defer resp.Body.Close()
 
-	return resp.StatusCode == http.StatusOK
+	if !spec.ExpectedStatus.Contains(resp.StatusCode) {
+		return fmt.Errorf("health endpoint returned %d, expected %s", resp.StatusCode, spec.ExpectedStatus)
+	}
+	return nil
 }
 
 func (p *LoadBalancerProxy) ReadAliveMap(server *url.URL) bool {
@@ -35,36 +66,178 @@ func (p *LoadBalancerProxy) ReadAliveMap(server *url.URL) bool {
 	return p.isAliveMap[server.Host]
 }
 
-func (p *LoadBalancerProxy) StartHealthCheck(ctx context.Context, interval time.Duration) {
-	for server := range p.serviceMap {
-		go p.runHealthCheck(ctx, server, interval)
+// setAlive marks a backend as alive or not and updates the balancer to match
+func (p *LoadBalancerProxy) setAlive(server *url.URL, alive bool) {
+	p.Lock()
+	if _, ok := p.lookup(server); !ok {
+		// Removed while its health was being worked out
+		p.Unlock()
+		return
 	}
+	p.isAliveMap[server.Host] = alive
+	p.Unlock()
+
+	p.updateBalancer(server)
 }
 
-func (p *LoadBalancerProxy) runHealthCheck(ctx context.Context, server *url.URL, interval time.Duration) {
-	ticker := time.NewTicker(interval * time.Second)
+// updateBalancer adds or removes a backend from the balancer to match
+// whether it is usable
+func (p *LoadBalancerProxy) updateBalancer(server *url.URL) {
+	p.RLock()
+	existing, ok := p.lookup(server)
+	if !ok {
+		p.RUnlock()
+		return
+	}
+	use := p.usable(existing)
+	options := p.optionsMap[existing.Host]
+	bal := p.balancerOf(existing.Host)
+	p.RUnlock()
+
+	if use {
+		balancer.AddServer(bal, existing, options)
+	} else {
+		bal.Remove(existing)
+	}
+}
+
+// usable reports whether a backend should be in the balancer. A backend is
+// only used while it is alive, has not been ejected for failing requests and
+// is not being drained. Must be called with the lock held.
+func (p *LoadBalancerProxy) usable(server *url.URL) bool {
+	if !p.isAliveMap[server.Host] || p.drainingMap[server.Host] != nil {
+		return false
+	}
+	if state, ok := p.outlierMap[server.Host]; ok && state.isEjected() {
+		return false
+	}
+	return true
+}
+
+func (p *LoadBalancerProxy) readHealthMap(server *url.URL) (healthState, bool) {
+	p.RLock()
+	defer p.RUnlock()
+	state, ok := p.healthMap[server.Host]
+	if !ok {
+		return healthState{}, false
+	}
+	return *state, true
+}
+
+// StartHealthCheck probes every backend of the proxy on the interval of its
+// health check spec until ctx is cancelled or StopHealthCheck is called.
+// Backends added after the health check starts are probed from the next tick.
+// If the route uses DNS discovery its lookups run alongside the probes, and
+// the shadow pool of a mirrored route is probed too.
+func (p *LoadBalancerProxy) StartHealthCheck(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	p.Lock()
+	if p.stopHealthCheck != nil {
+		p.stopHealthCheck()
+	}
+	p.stopHealthCheck = cancel
+	p.Unlock()
+
+	go p.runHealthCheck(ctx)
+	if p.discoverySpec.Name != "" {
+		go p.runDiscovery(ctx)
+	}
+	if p.mirror != nil {
+		p.mirror.StartHealthCheck(ctx)
+	}
+}
+
+// StopHealthCheck stops the health check started by StartHealthCheck
+func (p *LoadBalancerProxy) StopHealthCheck() {
+	p.Lock()
+	defer p.Unlock()
+	if p.stopHealthCheck != nil {
+		p.stopHealthCheck()
+		p.stopHealthCheck = nil
+	}
+}
+
+func (p *LoadBalancerProxy) runHealthCheck(ctx context.Context) {
+	ticker := time.NewTicker(p.healthSpec.withDefaults().Interval)
 	defer ticker.Stop()
 
 	for {
+		p.healthCheckAll(ctx)
+
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			p.healthCheck(ctx, server)
 		}
 	}
 }
 
+// healthCheckAll probes every backend at once and waits for the results
+func (p *LoadBalancerProxy) healthCheckAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, backend := range p.backends() {
+		wg.Add(1)
+		go func(server *url.URL) {
+			defer wg.Done()
+			p.healthCheck(ctx, server)
+		}(backend.url)
+	}
+	wg.Wait()
+}
+
+// healthCheck probes a backend once. The backend is removed from the balancer
+// after UnhealthyThreshold consecutive failures, and added back after
+// HealthyThreshold consecutive passes.
 func (p *LoadBalancerProxy) healthCheck(ctx context.Context, server *url.URL) {
-	if CheckHealth(server) && !p.ReadAliveMap(server) {
-		p.Lock()
-		p.isAliveMap[server.Host] = true
-		p.Unlock()
-		p.balancer.Add(server)
-	} else if !CheckHealth(server) && p.ReadAliveMap(server) {
-		p.Lock()
-		p.isAliveMap[server.Host] = false
+	spec := p.healthSpec.withDefaults()
+	err := CheckHealth(ctx, server, spec)
+	if ctx.Err() != nil {
+		// Shutting down, the result says nothing about the backend
+		return
+	}
+
+	p.Lock()
+	if _, ok := p.lookup(server); !ok {
+		// Removed while it was being probed, so there is nothing to record
 		p.Unlock()
-		p.balancer.Remove(server)
+		return
+	}
+	if p.healthMap == nil {
+		p.healthMap = make(map[string]*healthState)
+	}
+	state, ok := p.healthMap[server.Host]
+	if !ok {
+		state = &healthState{}
+		p.healthMap[server.Host] = state
+	}
+	state.lastProbe = time.Now()
+	state.lastError = err
+	stats := p.statsMap[server.Host]
+	if err == nil {
+		state.successes++
+		state.failures = 0
+		if stats != nil {
+			stats.probeSuccesses.Add(1)
+		}
+	} else {
+		state.failures++
+		state.successes = 0
+		if stats != nil {
+			stats.probeFailures.Add(1)
+		}
+	}
+	alive := p.isAliveMap[server.Host]
+	becameHealthy := !alive && state.successes >= spec.HealthyThreshold
+	becameUnhealthy := alive && state.failures >= spec.UnhealthyThreshold
+	p.Unlock()
+
+	switch {
+	case becameHealthy:
+		p.log().Info("backend is healthy", slog.String("path", p.pattern), slog.String("backend", server.String()))
+		p.setAlive(server, true)
+	case becameUnhealthy:
+		p.log().Warn("backend is unhealthy", slog.String("path", p.pattern), slog.String("backend", server.String()), slog.Any("error", err))
+		p.setAlive(server, false)
 	}
 }
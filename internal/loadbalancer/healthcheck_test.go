@@ -2,9 +2,13 @@ package loadbalancer
 
 import (
 	"context"
+	"net/http"
+	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/harrydayexe/Omni/internal/loadbalancer/balancer"
 	"github.com/testcontainers/testcontainers-go"
@@ -89,18 +93,19 @@ func TestCheckHealth(t *testing.T) {
 				Host:   endpoint,
 			}
 
-			if CheckHealth(url) != c.expected {
-				t.Errorf("Expected %v, got %v", c.expected, !c.expected)
+			err = CheckHealth(context.Background(), url, HealthCheck{})
+			if (err == nil) != c.expected {
+				t.Errorf("Expected %v, got %v: %v", c.expected, !c.expected, err)
 			}
 		})
 	}
 }
 
 func TestCheckHealthUnreachable(t *testing.T) {
-	if CheckHealth(&url.URL{
+	if CheckHealth(context.Background(), &url.URL{
 		Scheme: "http",
 		Host:   "localhost:1234",
-	}) {
+	}, HealthCheck{}) == nil {
 		t.Errorf("Expected %v, got %v", false, true)
 	}
 }
@@ -123,6 +128,7 @@ func TestHealthCheck(t *testing.T) {
 				isAliveMap: make(map[string]bool),
 				serviceMap: make(map[*url.URL]*httputil.ReverseProxy),
 				balancer:   balancer.NewRoundRobinBalancer(),
+				healthSpec: HealthCheck{HealthyThreshold: 1, UnhealthyThreshold: 1},
 			},
 			expectedAlive: true,
 		},
@@ -136,6 +142,7 @@ func TestHealthCheck(t *testing.T) {
 				isAliveMap: make(map[string]bool),
 				serviceMap: make(map[*url.URL]*httputil.ReverseProxy),
 				balancer:   balancer.NewRoundRobinBalancer(),
+				healthSpec: HealthCheck{HealthyThreshold: 1, UnhealthyThreshold: 1},
 			},
 			expectedAlive: false,
 		},
@@ -149,6 +156,7 @@ func TestHealthCheck(t *testing.T) {
 				isAliveMap: make(map[string]bool),
 				serviceMap: make(map[*url.URL]*httputil.ReverseProxy),
 				balancer:   balancer.NewRoundRobinBalancer(),
+				healthSpec: HealthCheck{HealthyThreshold: 1, UnhealthyThreshold: 1},
 			},
 			expectedAlive: false,
 		},
@@ -162,6 +170,7 @@ func TestHealthCheck(t *testing.T) {
 				isAliveMap: make(map[string]bool),
 				serviceMap: make(map[*url.URL]*httputil.ReverseProxy),
 				balancer:   balancer.NewRoundRobinBalancer(),
+				healthSpec: HealthCheck{HealthyThreshold: 1, UnhealthyThreshold: 1},
 			},
 			expectedAlive: true,
 		},
@@ -183,6 +192,7 @@ func TestHealthCheck(t *testing.T) {
 				Host:   endpoint,
 			}
 
+			c.loadBalancer.serviceMap[url] = httputil.NewSingleHostReverseProxy(url)
 			c.loadBalancer.balancer.Add(url)
 			c.loadBalancer.isAliveMap[url.Host] = c.initialHealth
 
@@ -194,3 +204,223 @@ func TestHealthCheck(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckHealthSpec(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/readyz", "/healthz":
+			w.WriteHeader(http.StatusOK)
+		case "/empty":
+			w.WriteHeader(http.StatusNoContent)
+		case "/moved":
+			http.Redirect(w, r, "/readyz", http.StatusFound)
+		case "/slow":
+			<-r.Context().Done()
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	cases := []struct {
+		name     string
+		spec     HealthCheck
+		expected bool
+	}{
+		{
+			name:     "default spec",
+			spec:     HealthCheck{},
+			expected: true,
+		},
+		{
+			name:     "custom path",
+			spec:     HealthCheck{Path: "/healthz"},
+			expected: true,
+		},
+		{
+			name:     "unhealthy path",
+			spec:     HealthCheck{Path: "/down"},
+			expected: false,
+		},
+		{
+			name:     "status within default range",
+			spec:     HealthCheck{Path: "/empty"},
+			expected: true,
+		},
+		{
+			name:     "status outside expected range",
+			spec:     HealthCheck{Path: "/empty", ExpectedStatus: StatusRange{Min: 200, Max: 200}},
+			expected: false,
+		},
+		{
+			name:     "redirects are not followed",
+			spec:     HealthCheck{Path: "/moved"},
+			expected: false,
+		},
+		{
+			name:     "redirect within expected range",
+			spec:     HealthCheck{Path: "/moved", ExpectedStatus: StatusRange{Min: 200, Max: 399}},
+			expected: true,
+		},
+		{
+			name:     "probe times out",
+			spec:     HealthCheck{Path: "/slow", Timeout: 20 * time.Millisecond},
+			expected: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := CheckHealth(context.Background(), serverURL, c.spec)
+			if (err == nil) != c.expected {
+				t.Errorf("Expected %v, got %v: %v", c.expected, !c.expected, err)
+			}
+		})
+	}
+}
+
+func TestCheckHealthCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := CheckHealth(ctx, serverURL, HealthCheck{}); err == nil {
+		t.Errorf("expected a cancelled probe to fail")
+	}
+}
+
+func TestHealthCheckThresholds(t *testing.T) {
+	var healthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if healthy.Load() {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	proxy, err := NewLoadBalancerProxy("round-robin")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	proxy.healthSpec = HealthCheck{HealthyThreshold: 2, UnhealthyThreshold: 3}
+	proxy.Add(serverURL)
+
+	steps := []struct {
+		healthy   bool
+		wantAlive bool
+	}{
+		{healthy: true, wantAlive: false}, // A new backend waits for its checks
+		{healthy: true, wantAlive: true},
+		{healthy: false, wantAlive: true},
+		{healthy: false, wantAlive: true},
+		{healthy: false, wantAlive: false}, // Third consecutive failure
+		{healthy: true, wantAlive: false},
+		{healthy: false, wantAlive: false}, // Resets the run of passes
+		{healthy: true, wantAlive: false},
+		{healthy: true, wantAlive: true}, // Second consecutive pass
+	}
+
+	for i, step := range steps {
+		healthy.Store(step.healthy)
+		proxy.healthCheck(context.Background(), serverURL)
+
+		if got := proxy.ReadAliveMap(serverURL); got != step.wantAlive {
+			t.Fatalf("step %d: expected alive %v, got %v", i, step.wantAlive, got)
+		}
+		wantLen := 0
+		if step.wantAlive {
+			wantLen = 1
+		}
+		if got := proxy.balancer.Len(); got != wantLen {
+			t.Fatalf("step %d: expected %d backends in the balancer, got %d", i, wantLen, got)
+		}
+	}
+
+	state, ok := proxy.readHealthMap(serverURL)
+	if !ok || state.lastProbe.IsZero() || state.lastError != nil {
+		t.Errorf("expected the last probe to be recorded, got %+v", state)
+	}
+}
+
+func TestStartHealthCheckProbesNewBackends(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	proxy, err := NewLoadBalancerProxy("round-robin")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	proxy.healthSpec = HealthCheck{Interval: 10 * time.Millisecond, UnhealthyThreshold: 1}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proxy.StartHealthCheck(ctx)
+	defer proxy.StopHealthCheck()
+
+	// Added after the health check started, as through /addz
+	proxy.Add(serverURL)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for proxy.ReadAliveMap(serverURL) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the new backend to be probed and marked unhealthy")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if proxy.balancer.Len() != 0 {
+		t.Errorf("expected the unhealthy backend to be removed from the balancer")
+	}
+}
+
+func TestHealthCheckForgetsRemovedBackend(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	proxy, err := NewLoadBalancerProxy("round-robin")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	proxy.healthSpec = HealthCheck{HealthyThreshold: 1}
+	proxy.Add(serverURL)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy.healthCheck(context.Background(), serverURL)
+	}()
+
+	// Removed through /removez while the probe is in flight
+	<-started
+	proxy.Remove(serverURL)
+	close(release)
+	<-done
+
+	proxy.RLock()
+	_, alive := proxy.isAliveMap[serverURL.Host]
+	_, health := proxy.healthMap[serverURL.Host]
+	proxy.RUnlock()
+	if alive || health {
+		t.Errorf("expected nothing to be recorded for a removed backend, got alive entry %v and health entry %v", alive, health)
+	}
+	if proxy.balancer.Len() != 0 {
+		t.Errorf("expected the removed backend to stay out of the balancer, got %d backends", proxy.balancer.Len())
+	}
+}
@@ -1,69 +1,156 @@
 package loadbalancer
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/harrydayexe/Omni/internal/loadbalancer/balancer"
 )
 
-type loadBalancer struct {
-	Config  Config
-	Logger  *slog.Logger
-	Proxies map[string]*LoadBalancerProxy
-	Mux     *http.ServeMux
+// A LoadBalancer routes each request to the proxy for its path. The paths can
+// be reloaded while it is running, see Reload.
+type LoadBalancer struct {
+	Logger *slog.Logger
+
+	sync.RWMutex // Protect Config, Proxies and healthCtx
+	Config       Config
+	Proxies      map[string]*LoadBalancerProxy
+	healthCtx    context.Context // Set once health checks are started
+
+	mux       atomic.Pointer[http.ServeMux]
+	adminMux  *http.ServeMux // Served by AdminHandler on the admin listener
+	accessLog *AccessLogger  // Nil if access logging is off, changes need a restart
 }
 
-func New(config Config, logger *slog.Logger) (*http.ServeMux, error) {
+// The patterns of the load balancer's own endpoints served alongside the
+// proxied paths, which paths in the config must not conflict with
+var reservedPatterns = []string{
+	"GET /livez",
+	"GET /readyz",
+}
+
+func New(config Config, logger *slog.Logger) (*LoadBalancer, error) {
 	logger.Debug("Creating new load balancer")
 
-	loadBalancer := &loadBalancer{
+	loadBalancer := &LoadBalancer{
 		Config:  config,
 		Logger:  logger,
 		Proxies: make(map[string]*LoadBalancerProxy),
-		Mux:     http.NewServeMux(),
 	}
 
-	for _, path := range config.Paths {
-		proxy, err := NewLoadBalancerProxy(config.Algorithm)
+	for _, route := range config.Routes() {
+		proxy, err := newRouteProxy(route, logger)
 		if err != nil {
-			logger.Error("failed to create new load balancer proxy", slog.String("path", path), slog.Any("error", err))
+			logger.Error("failed to create new load balancer proxy", slog.String("path", route.Pattern), slog.Any("error", err))
 			return nil, err
 		}
 
-		loadBalancer.Proxies[path] = proxy
-		loadBalancer.Mux.Handle(path, proxy)
+		loadBalancer.Proxies[route.Pattern] = proxy
 	}
 
-	loadBalancer.Mux.HandleFunc("POST /addz", func(w http.ResponseWriter, r *http.Request) {
-		loadBalancer.addBackend(w, r)
-	})
-	loadBalancer.Mux.HandleFunc("DELETE /removez", func(w http.ResponseWriter, r *http.Request) {
-		loadBalancer.removeBackend(w, r)
-	})
-	loadBalancer.Mux.HandleFunc("GET /livez", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
-	loadBalancer.Mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
-		loadBalancer.readyz(w, r)
-	})
+	mux, err := loadBalancer.buildMux(loadBalancer.Proxies)
+	if err != nil {
+		logger.Error("failed to register paths", slog.Any("error", err))
+		return nil, err
+	}
+	loadBalancer.mux.Store(mux)
+	loadBalancer.adminMux = loadBalancer.buildAdminMux()
+
+	loadBalancer.accessLog, err = NewAccessLogger(config.AccessLog)
+	if err != nil {
+		logger.Error("failed to open access log", slog.Any("error", err))
+		return nil, err
+	}
+
+	return loadBalancer, nil
+}
+
+// StartHealthChecks starts probing the backends of every path until ctx is
+// cancelled. Paths added by a later reload are probed too.
+func (loadBalancer *LoadBalancer) StartHealthChecks(ctx context.Context) {
+	loadBalancer.Lock()
+	defer loadBalancer.Unlock()
+
+	loadBalancer.healthCtx = ctx
+	for _, proxy := range loadBalancer.Proxies {
+		proxy.StartHealthCheck(ctx)
+	}
+}
 
-	return loadBalancer.Mux, nil
+func (loadBalancer *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	loadBalancer.accessLog.serve(w, r, loadBalancer.mux.Load())
+}
+
+// Close closes the access log
+func (loadBalancer *LoadBalancer) Close() error {
+	return loadBalancer.accessLog.Close()
+}
+
+// buildMux registers the proxies and the load balancer's public endpoints on a
+// new mux. Registering conflicting patterns panics, so that is recovered and
+// returned as an error.
+func (loadBalancer *LoadBalancer) buildMux(proxies map[string]*LoadBalancerProxy) (mux *http.ServeMux, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			mux = nil
+			err = fmt.Errorf("failed to register path: %v", r)
+		}
+	}()
+
+	mux = http.NewServeMux()
+	routes := make([]*pattern, 0, len(proxies))
+	for path, proxy := range proxies {
+		mux.Handle(path, proxy)
+		if pat, err := parsePattern(path); err == nil {
+			routes = append(routes, pat)
+		}
+	}
+
+	endpoints := map[string]http.HandlerFunc{
+		"GET /livez": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		},
+		"GET /readyz": func(w http.ResponseWriter, r *http.Request) {
+			loadBalancer.readyz(w, r)
+		},
+	}
+	// The endpoints are registered for every host with a path too, so they
+	// are reachable whichever hostname the load balancer is called by
+	for _, host := range append([]string{""}, patternHosts(routes)...) {
+		for _, endpoint := range reservedPatterns {
+			method, path, _ := strings.Cut(endpoint, " ")
+			mux.HandleFunc(method+" "+host+path, endpoints[endpoint])
+		}
+	}
+
+	return mux, nil
 }
 
 // Readiness check endpoint
 // Note this returns StatusServiceUnavailable if no backends are available for any path
 // TODO: Check standards to see if this is the right chocice
-func (loadBalancer *loadBalancer) readyz(w http.ResponseWriter, r *http.Request) {
+func (loadBalancer *LoadBalancer) readyz(w http.ResponseWriter, r *http.Request) {
 	loadBalancer.Logger.InfoContext(r.Context(), "readyz GET request received")
 
+	loadBalancer.RLock()
+	defer loadBalancer.RUnlock()
+
 	if len(loadBalancer.Proxies) == 0 {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
 
 	for _, proxy := range loadBalancer.Proxies {
-		if proxy.balancer.Len() == 0 {
+		if proxy.available() == 0 {
 			w.WriteHeader(http.StatusServiceUnavailable)
 			return
 		}
@@ -72,12 +159,84 @@ func (loadBalancer *loadBalancer) readyz(w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(http.StatusOK)
 }
 
+// A routeStatus describes a path for the admin endpoints
+type routeStatus struct {
+	Pattern   string          `json:"pattern"`
+	Algorithm string          `json:"algorithm"`
+	HashKey   string          `json:"hash_key,omitempty"`
+	Timeout   string          `json:"timeout,omitempty"`
+	Available int             `json:"available"` // Backends the balancer is currently using
+	Groups    []groupStatus   `json:"groups,omitempty"`
+	Backends  []backendStatus `json:"backends,omitempty"`
+}
+
+// routeStatuses describes every path, sorted by pattern. Backends are only
+// included when withBackends is set.
+func (loadBalancer *LoadBalancer) routeStatuses(withBackends bool) []routeStatus {
+	loadBalancer.RLock()
+	defer loadBalancer.RUnlock()
+
+	routes := make([]routeStatus, 0, len(loadBalancer.Proxies))
+	for path, proxy := range loadBalancer.Proxies {
+		route := routeStatus{
+			Pattern:   path,
+			Algorithm: proxy.algorithm,
+			Available: proxy.available(),
+			Groups:    proxy.groupStatuses(),
+		}
+		if proxy.hashKey != nil {
+			route.HashKey = proxy.hashKey.String()
+		}
+		if proxy.timeout > 0 {
+			route.Timeout = proxy.timeout.String()
+		}
+		if withBackends {
+			route.Backends = proxy.status()
+		}
+		routes = append(routes, route)
+	}
+
+	slices.SortFunc(routes, func(a, b routeStatus) int {
+		return strings.Compare(a.Pattern, b.Pattern)
+	})
+	return routes
+}
+
+// routez lists every path along with its settings
+func (loadBalancer *LoadBalancer) routez(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(loadBalancer.routeStatuses(false))
+}
+
+// backendz lists every path along with the state of each of its backends
+func (loadBalancer *LoadBalancer) backendz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(loadBalancer.routeStatuses(true))
+}
+
+// breakerz lists the circuit breaker state of every backend by path
+func (loadBalancer *LoadBalancer) breakerz(w http.ResponseWriter, r *http.Request) {
+	loadBalancer.RLock()
+	states := make(map[string]map[string]string, len(loadBalancer.Proxies))
+	for path, proxy := range loadBalancer.Proxies {
+		states[path] = proxy.breakerStates()
+	}
+	loadBalancer.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(states)
+}
+
 // Add a new backend to the load balancer
-func (loadBalancer *loadBalancer) addBackend(w http.ResponseWriter, r *http.Request) {
+func (loadBalancer *LoadBalancer) addBackend(w http.ResponseWriter, r *http.Request) {
 	loadBalancer.Logger.InfoContext(r.Context(), "addz POST request received")
 	var c struct {
 		Path    string `json:"path"`
 		Address string `json:"address"`
+		Weight  int    `json:"weight"`
+		Group   string `json:"group"` // Required for a path which splits its traffic between groups
+
+		MaxConcurrent int `json:"max_concurrent"` // Requests sent to the backend at once, defaults to the limit of the path
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -85,65 +244,157 @@ func (loadBalancer *loadBalancer) addBackend(w http.ResponseWriter, r *http.Requ
 	err := decoder.Decode(&c)
 	if err != nil {
 		loadBalancer.Logger.ErrorContext(r.Context(), "failed to decode request body", slog.Any("error", err))
-		var errorMessage = `{"error":"Bad Request","message":"Request body could not be parsed properly."}`
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(errorMessage))
+		writeJSONError(w, http.StatusBadRequest, "Request body could not be parsed properly.")
 		return
 	}
 
-	address, err := url.Parse(c.Address)
+	address, err := parseBackendAddress(c.Address)
 	if err != nil {
 		loadBalancer.Logger.ErrorContext(r.Context(), "failed to parse address", slog.Any("error", err))
-		var errorMessage = `{"error":"Bad Request","message":"Address could not be parsed properly."}`
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(errorMessage))
+		writeJSONError(w, http.StatusBadRequest, "Address must be an absolute URL such as http://omniread:80.")
+		return
+	}
+
+	// The weight is optional and defaults to 1
+	if c.Weight < 0 {
+		loadBalancer.Logger.ErrorContext(r.Context(), "negative weight", slog.Int("weight", c.Weight))
+		writeJSONError(w, http.StatusBadRequest, "Weight must not be negative.")
+		return
+	}
+	if c.Weight == 0 {
+		c.Weight = 1
+	}
+	if c.MaxConcurrent < 0 {
+		loadBalancer.Logger.ErrorContext(r.Context(), "negative max concurrent", slog.Int("max_concurrent", c.MaxConcurrent))
+		writeJSONError(w, http.StatusBadRequest, "Max concurrent must not be negative.")
 		return
 	}
 
+	// Hold the lock until the backend is added so a concurrent reload
+	// cannot carry over the proxy without it
+	loadBalancer.RLock()
+	defer loadBalancer.RUnlock()
+
 	proxy, prs := loadBalancer.Proxies[c.Path]
 	if !prs {
 		loadBalancer.Logger.ErrorContext(r.Context(), "path not found", slog.String("path", c.Path))
-		var errorMessage = `{"error":"Not Found","message":"Path not found."}`
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(errorMessage))
+		writeJSONError(w, http.StatusNotFound, "Path not found.")
 		return
 	}
 
-	proxy.Add(address)
+	options := balancer.ServerOptions{Weight: c.Weight, MaxConcurrent: c.MaxConcurrent}
+	if err := proxy.AddToGroup(address, c.Group, options); err != nil {
+		loadBalancer.Logger.ErrorContext(r.Context(), "failed to add backend to group", slog.String("group", c.Group), slog.Any("error", err))
+		writeJSONError(w, http.StatusBadRequest, "Group must be one of the groups of the path, and is required if the path has groups.")
+		return
+	}
+	loadBalancer.Logger.InfoContext(r.Context(), "backend added",
+		slog.String("caller", caller(r.Context())),
+		slog.String("path", c.Path),
+		slog.String("address", address.String()),
+		slog.Int("weight", c.Weight),
+		slog.String("group", c.Group),
+		slog.Int("max_concurrent", c.MaxConcurrent),
+	)
 	w.WriteHeader(http.StatusCreated)
 }
 
-func (loadBalancer *loadBalancer) removeBackend(w http.ResponseWriter, r *http.Request) {
+// setGroupWeights changes the share of traffic each group of a path gets,
+// such as to send more of it to a canary
+func (loadBalancer *LoadBalancer) setGroupWeights(w http.ResponseWriter, r *http.Request) {
+	loadBalancer.Logger.InfoContext(r.Context(), "weightz PUT request received")
+	var c struct {
+		Path    string         `json:"path"`
+		Weights map[string]int `json:"weights"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&c); err != nil {
+		loadBalancer.Logger.ErrorContext(r.Context(), "failed to decode request body", slog.Any("error", err))
+		writeJSONError(w, http.StatusBadRequest, "Request body could not be parsed properly.")
+		return
+	}
+
+	loadBalancer.RLock()
+	defer loadBalancer.RUnlock()
+
+	proxy, prs := loadBalancer.Proxies[c.Path]
+	if !prs {
+		loadBalancer.Logger.ErrorContext(r.Context(), "path not found", slog.String("path", c.Path))
+		writeJSONError(w, http.StatusNotFound, "Path not found.")
+		return
+	}
+
+	if err := proxy.SetGroupWeights(c.Weights); err != nil {
+		loadBalancer.Logger.ErrorContext(r.Context(), "invalid group weights", slog.Any("error", err))
+		writeJSONError(w, http.StatusBadRequest, "Every group of the path must be given a weight, and the weights must add up to 100.")
+		return
+	}
+	loadBalancer.Logger.InfoContext(r.Context(), "group weights changed",
+		slog.String("caller", caller(r.Context())),
+		slog.String("path", c.Path),
+		slog.Any("weights", c.Weights),
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (loadBalancer *LoadBalancer) removeBackend(w http.ResponseWriter, r *http.Request) {
 	loadBalancer.Logger.InfoContext(r.Context(), "removez DELETE request received")
 
 	pathString := r.URL.Query().Get("path")
 	addressString := r.URL.Query().Get("address")
 	if pathString == "" || addressString == "" {
-		loadBalancer.Logger.ErrorContext(r.Context(), "missing path query parameter")
-		var errorMessage = `{"error":"Bad Request","message":"path query parameter missing."}`
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(errorMessage))
+		loadBalancer.Logger.ErrorContext(r.Context(), "missing query parameter")
+		writeJSONError(w, http.StatusBadRequest, "path and address query parameters are required.")
 		return
 	}
 
 	address, err := url.Parse(addressString)
 	if err != nil {
 		loadBalancer.Logger.ErrorContext(r.Context(), "failed to parse address", slog.Any("error", err))
-		var errorMessage = `{"error":"Bad Request","message":"Address could not be parsed properly."}`
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(errorMessage))
+		writeJSONError(w, http.StatusBadRequest, "Address could not be parsed properly.")
 		return
 	}
 
+	// With drain the backend stops getting new requests straight away and is
+	// removed once the ones in flight finish, or the drain timeout passes
+	var drainTimeout time.Duration
+	if drainString := r.URL.Query().Get("drain"); drainString != "" {
+		drainTimeout, err = time.ParseDuration(drainString)
+		if err != nil || drainTimeout < 0 {
+			loadBalancer.Logger.ErrorContext(r.Context(), "failed to parse drain", slog.String("drain", drainString))
+			writeJSONError(w, http.StatusBadRequest, "Drain must be a non-negative duration such as 30s.")
+			return
+		}
+	}
+
+	loadBalancer.RLock()
+	defer loadBalancer.RUnlock()
+
 	proxy, prs := loadBalancer.Proxies[pathString]
 	if !prs {
 		loadBalancer.Logger.ErrorContext(r.Context(), "path not found", slog.String("path", pathString))
-		var errorMessage = `{"error":"Not Found","message":"Path not found."}`
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(errorMessage))
+		writeJSONError(w, http.StatusNotFound, "Path not found.")
+		return
+	}
+
+	if drainTimeout > 0 && proxy.Drain(address, drainTimeout) {
+		loadBalancer.Logger.InfoContext(r.Context(), "backend draining",
+			slog.String("caller", caller(r.Context())),
+			slog.String("path", pathString),
+			slog.String("address", address.String()),
+			slog.Duration("drain", drainTimeout),
+		)
+		w.WriteHeader(http.StatusAccepted)
 		return
 	}
 
 	proxy.Remove(address)
+	loadBalancer.Logger.InfoContext(r.Context(), "backend removed",
+		slog.String("caller", caller(r.Context())),
+		slog.String("path", pathString),
+		slog.String("address", address.String()),
+	)
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -1,13 +1,18 @@
 package loadbalancer
 
 import (
+	"encoding/json"
+	"errors"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/harrydayexe/Omni/internal/loadbalancer/balancer"
 )
@@ -59,11 +64,10 @@ func TestReadyz(t *testing.T) {
 			req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
 			rr := httptest.NewRecorder()
 
-			lb := &loadBalancer{
+			lb := &LoadBalancer{
 				Config:  Config{},
 				Logger:  slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelDebug})),
 				Proxies: tt.proxies,
-				Mux:     http.NewServeMux(),
 			}
 
 			lb.readyz(rr, req)
@@ -75,3 +79,269 @@ func TestReadyz(t *testing.T) {
 	}
 
 }
+
+func TestAddBackend(t *testing.T) {
+	cases := []struct {
+		name       string
+		body       string
+		want       int
+		wantWeight int
+	}{
+		{
+			name:       "without weight",
+			body:       `{"path":"GET /","address":"http://localhost:8080"}`,
+			want:       http.StatusCreated,
+			wantWeight: 1,
+		},
+		{
+			name:       "with weight",
+			body:       `{"path":"GET /","address":"http://localhost:8080","weight":4}`,
+			want:       http.StatusCreated,
+			wantWeight: 4,
+		},
+		{
+			name: "negative weight",
+			body: `{"path":"GET /","address":"http://localhost:8080","weight":-1}`,
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "unknown path",
+			body: `{"path":"GET /unknown","address":"http://localhost:8080"}`,
+			want: http.StatusNotFound,
+		},
+		{
+			name: "address without a scheme",
+			body: `{"path":"GET /","address":"localhost:8080"}`,
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "unknown field",
+			body: `{"path":"GET /","address":"http://localhost:8080","priority":1}`,
+			want: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, err := NewLoadBalancerProxy("weighted-round-robin")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			lb := &LoadBalancer{
+				Config:  Config{},
+				Logger:  slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelDebug})),
+				Proxies: map[string]*LoadBalancerProxy{"GET /": proxy},
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/addz", strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+			lb.addBackend(rr, req)
+
+			resp := rr.Result()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("got %d, want %d", resp.StatusCode, tt.want)
+			}
+			if tt.want != http.StatusCreated {
+				var body struct {
+					Error   string `json:"error"`
+					Message string `json:"message"`
+				}
+				if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error != http.StatusText(tt.want) || body.Message == "" {
+					t.Errorf("expected a JSON error, got %+v (%v)", body, err)
+				}
+				return
+			}
+
+			if len(proxy.backends()) != 1 {
+				t.Errorf("expected 1 backend, got %d", len(proxy.backends()))
+			}
+			if proxy.balancer.Len() != 0 {
+				t.Errorf("expected the backend to wait for its health checks, got %d in the balancer", proxy.balancer.Len())
+			}
+			if got := proxy.optionsMap["localhost:8080"].Weight; got != tt.wantWeight {
+				t.Errorf("expected weight %d, got %d", tt.wantWeight, got)
+			}
+		})
+	}
+}
+
+func TestNewBuildsProxyPerRoute(t *testing.T) {
+	config := Config{
+		Algorithm: "round-robin",
+		Paths: []Route{
+			{Pattern: "POST /post", Algorithm: "least-connections", Backends: []Backend{{Address: "http://omniwrite:80"}}},
+			{Pattern: "POST /login", Timeout: 2 * time.Second, HealthCheck: HealthCheck{Path: "/healthz"}},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	lb, err := New(config, logger)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(lb.Proxies) != 2 {
+		t.Fatalf("expected a proxy for each path, got %d", len(lb.Proxies))
+	}
+
+	write, ok := lb.Proxies["POST /post"]
+	if !ok {
+		t.Fatalf("expected a proxy for POST /post")
+	}
+	if _, ok := write.balancer.(*balancer.LeastConnectionsBalancer); !ok {
+		t.Errorf("expected a least-connections balancer, got %T", write.balancer)
+	}
+	if len(write.backends()) != 1 {
+		t.Errorf("expected 1 static backend, got %d", len(write.backends()))
+	}
+
+	login, ok := lb.Proxies["POST /login"]
+	if !ok {
+		t.Fatalf("expected a proxy for POST /login")
+	}
+	if _, ok := login.balancer.(*balancer.RoundRobinBalancer); !ok {
+		t.Errorf("expected the default round-robin balancer, got %T", login.balancer)
+	}
+	if login.timeout != 2*time.Second {
+		t.Errorf("expected a 2s timeout, got %v", login.timeout)
+	}
+	if login.healthSpec.Path != "/healthz" {
+		t.Errorf("expected health check path /healthz, got %s", login.healthSpec.Path)
+	}
+}
+
+func TestRemoveBackendErrors(t *testing.T) {
+	lb := newTestLoadBalancer(t, Config{Algorithm: "round-robin", Paths: patterns("GET /")})
+
+	cases := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{name: "missing address", query: "?path=GET+/", want: http.StatusBadRequest},
+		{name: "unknown path", query: "?path=GET+/unknown&address=http://localhost:8080", want: http.StatusNotFound},
+		{name: "invalid drain", query: "?path=GET+/&address=http://localhost:8080&drain=soon", want: http.StatusBadRequest},
+		{name: "negative drain", query: "?path=GET+/&address=http://localhost:8080&drain=-1s", want: http.StatusBadRequest},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			lb.adminMux.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/removez"+tt.query, nil))
+
+			if rr.Code != tt.want {
+				t.Fatalf("got %d, want %d", rr.Code, tt.want)
+			}
+			if got := rr.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("expected a JSON error, got content type %q", got)
+			}
+		})
+	}
+}
+
+func TestRoutezAndBackendz(t *testing.T) {
+	lb := newTestLoadBalancer(t, Config{
+		Algorithm: "round-robin",
+		Paths: []Route{
+			{Pattern: "POST /post", Algorithm: "weighted-round-robin", Timeout: 2 * time.Second, Backends: []Backend{
+				{Address: "http://omniwrite-2:80"},
+				{Address: "http://omniwrite-1:80", Weight: 3},
+			}},
+			{Pattern: "GET /post/{id}", HashKey: "path:id", Algorithm: "consistent-hash"},
+		},
+	})
+
+	write := lb.Proxies["POST /post"]
+	write.setAlive(&url.URL{Scheme: "http", Host: "omniwrite-2:80"}, false)
+	write.statsMap["omniwrite-1:80"].requests.Store(10)
+	write.statsMap["omniwrite-1:80"].errors.Store(2)
+	write.healthMap["omniwrite-2:80"] = &healthState{lastProbe: time.Now(), lastError: errors.New("connection refused")}
+
+	rr := httptest.NewRecorder()
+	lb.adminMux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/routez", nil))
+	var routes []routeStatus
+	if err := json.NewDecoder(rr.Body).Decode(&routes); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	wantRoutes := []routeStatus{
+		{Pattern: "GET /post/{id}", Algorithm: "consistent-hash", HashKey: "path:id"},
+		{Pattern: "POST /post", Algorithm: "weighted-round-robin", Timeout: "2s", Available: 1},
+	}
+	if !reflect.DeepEqual(routes, wantRoutes) {
+		t.Errorf("got routes %+v\nwant %+v", routes, wantRoutes)
+	}
+
+	rr = httptest.NewRecorder()
+	lb.adminMux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/backendz", nil))
+	routes = nil
+	if err := json.NewDecoder(rr.Body).Decode(&routes); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(routes) != 2 || len(routes[1].Backends) != 2 {
+		t.Fatalf("expected 2 backends for POST /post, got %+v", routes)
+	}
+
+	first, second := routes[1].Backends[0], routes[1].Backends[1]
+	if first.URL != "http://omniwrite-1:80" || first.Weight != 3 || !first.Alive || first.Requests != 10 || first.Errors != 2 || first.LastProbe != nil {
+		t.Errorf("unexpected status for omniwrite-1: %+v", first)
+	}
+	if second.URL != "http://omniwrite-2:80" || second.Alive || second.LastProbe == nil || second.LastProbeError != "connection refused" {
+		t.Errorf("unexpected status for omniwrite-2: %+v", second)
+	}
+	if first.CircuitBreaker != "closed" {
+		t.Errorf("expected closed circuit breaker, got %s", first.CircuitBreaker)
+	}
+}
+
+func TestHostRouting(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+	}
+	api := backend("api")
+	defer api.Close()
+	view := backend("view")
+	defer view.Close()
+	fallback := backend("fallback")
+	defer fallback.Close()
+
+	lb := newTestLoadBalancer(t, Config{
+		Algorithm: "round-robin",
+		Paths: []Route{
+			{Pattern: "GET api.omni.example/post/{id}", Backends: []Backend{{Address: api.URL}}},
+			{Pattern: "www.omni.example/", Backends: []Backend{{Address: view.URL}}},
+			{Pattern: "GET /post/{id}", Backends: []Backend{{Address: fallback.URL}}},
+		},
+	})
+
+	cases := []struct {
+		host   string
+		path   string
+		status int
+		want   string
+	}{
+		{host: "api.omni.example", path: "/post/1", status: http.StatusOK, want: "api"},
+		{host: "api.omni.example:8443", path: "/post/1", status: http.StatusOK, want: "api"},
+		{host: "www.omni.example", path: "/post/1", status: http.StatusOK, want: "view"},
+		{host: "omni.example", path: "/post/1", status: http.StatusOK, want: "fallback"},
+		{host: "www.omni.example", path: "/livez", status: http.StatusOK, want: ""},
+		{host: "omni.example", path: "/", status: http.StatusNotFound},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.host+tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Host = tt.host
+			rr := httptest.NewRecorder()
+			lb.ServeHTTP(rr, req)
+
+			if rr.Code != tt.status {
+				t.Fatalf("got %d, want %d", rr.Code, tt.status)
+			}
+			if tt.status == http.StatusOK && rr.Body.String() != tt.want {
+				t.Errorf("expected the request to reach %q, got %q", tt.want, rr.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The upper bounds in seconds of the request latency histogram buckets, the
+// same as the Prometheus client defaults
+var latencyBuckets = [...]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A histogram counts durations into latencyBuckets. It is safe to use from
+// several goroutines.
+type histogram struct {
+	buckets [len(latencyBuckets)]atomic.Uint64 // Not cumulative, see collectMetrics
+	count   atomic.Uint64
+	sum     atomic.Int64 // Nanoseconds
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.buckets[i].Add(1)
+			break
+		}
+	}
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+// A metricFamily is every sample of one metric, in the Prometheus text format
+type metricFamily struct {
+	name    string
+	kind    string
+	help    string
+	samples []string
+}
+
+// A metricSet gathers samples into their families so that each family is
+// written in one block, as the text format requires
+type metricSet struct {
+	families []*metricFamily
+	byName   map[string]*metricFamily
+}
+
+func newMetricSet() *metricSet {
+	return &metricSet{byName: make(map[string]*metricFamily)}
+}
+
+func (m *metricSet) describe(name, kind, help string) {
+	family := &metricFamily{name: name, kind: kind, help: help}
+	m.families = append(m.families, family)
+	m.byName[name] = family
+}
+
+// add records a sample of a family. The sample name is the family name with
+// suffix, such as _bucket for histograms. Labels are given as name, value
+// pairs.
+func (m *metricSet) add(name, suffix string, value float64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteString(suffix)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatValue(value))
+
+	family := m.byName[name]
+	family.samples = append(family.samples, b.String())
+}
+
+func (m *metricSet) write(w io.Writer) {
+	for _, family := range m.families {
+		if len(family.samples) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", family.name, family.kind)
+		for _, sample := range family.samples {
+			fmt.Fprintln(w, sample)
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// metrics serves the metrics of every path in the Prometheus text format
+func (loadBalancer *LoadBalancer) metrics(w http.ResponseWriter, r *http.Request) {
+	m := newMetricSet()
+	m.describe("omni_lb_route_requests_total", "counter", "Responses to requests for each path by status class, including requests rejected before reaching a backend.")
+	m.describe("omni_lb_requests_total", "counter", "Requests proxied to each backend by status class.")
+	m.describe("omni_lb_request_duration_seconds", "histogram", "Time taken by each backend to respond.")
+	m.describe("omni_lb_backend_in_flight_requests", "gauge", "Requests currently being proxied to each backend.")
+	m.describe("omni_lb_route_in_flight_requests", "gauge", "Requests currently being handled for each path.")
+	m.describe("omni_lb_backend_streams", "gauge", "WebSockets and event streams currently open to each backend.")
+	m.describe("omni_lb_route_streams", "gauge", "WebSockets and event streams currently open for each path.")
+	m.describe("omni_lb_retries_total", "counter", "Requests retried on another backend for each path.")
+	m.describe("omni_lb_rate_limited_total", "counter", "Requests rejected by the rate limit of each path.")
+	m.describe("omni_lb_mirror_requests_total", "counter", "Requests copied to the shadow pool of each mirrored path, or dropped because too many were in flight.")
+	m.describe("omni_lb_mirror_mismatches_total", "counter", "Mirrored requests whose status differed from the primary response for each path.")
+	m.describe("omni_lb_queued_requests", "gauge", "Requests waiting for a backend under the concurrency limits of each path.")
+	m.describe("omni_lb_queue_rejected_total", "counter", "Requests which failed with 503 because the queue of each path was full or they waited too long.")
+	m.describe("omni_lb_group_requests_total", "counter", "Requests sent to each backend group of a path which splits its traffic.")
+	m.describe("omni_lb_group_weight", "gauge", "Percentage of requests each backend group of a path is weighted to get.")
+	m.describe("omni_lb_health_checks_total", "counter", "Health check probes of each backend by result.")
+	m.describe("omni_lb_backend_up", "gauge", "Whether each backend is passing its health checks.")
+	m.describe("omni_lb_backends", "gauge", "Backends registered for each path.")
+	m.describe("omni_lb_pool_size", "gauge", "Backends the balancer is currently using for each path.")
+
+	loadBalancer.RLock()
+	paths := make([]string, 0, len(loadBalancer.Proxies))
+	for path := range loadBalancer.Proxies {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	for _, path := range paths {
+		loadBalancer.Proxies[path].collectMetrics(path, m)
+	}
+	loadBalancer.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.write(w)
+}
+
+// collectMetrics adds the metrics of the proxy and its backends to m
+func (p *LoadBalancerProxy) collectMetrics(route string, m *metricSet) {
+	p.RLock()
+	defer p.RUnlock()
+
+	for class := 1; class < len(p.responses); class++ {
+		if n := p.responses[class].Load(); n > 0 {
+			m.add("omni_lb_route_requests_total", "", float64(n), "route", route, "class", fmt.Sprintf("%dxx", class))
+		}
+	}
+	m.add("omni_lb_route_in_flight_requests", "", float64(p.inFlight.Load()), "route", route)
+	m.add("omni_lb_route_streams", "", float64(p.streams.Load()), "route", route)
+	m.add("omni_lb_retries_total", "", float64(p.retries.Load()), "route", route)
+	if p.limiter != nil {
+		m.add("omni_lb_rate_limited_total", "", float64(p.rateLimited.Load()), "route", route)
+	}
+	if p.mirror != nil {
+		m.add("omni_lb_mirror_requests_total", "", float64(p.mirrored.Load()), "route", route, "result", "sent")
+		m.add("omni_lb_mirror_requests_total", "", float64(p.mirrorDropped.Load()), "route", route, "result", "dropped")
+		m.add("omni_lb_mirror_mismatches_total", "", float64(p.mirrorMismatches.Load()), "route", route)
+	}
+	m.add("omni_lb_queued_requests", "", float64(p.limits.queued()), "route", route)
+	m.add("omni_lb_queue_rejected_total", "", float64(p.limits.rejected.Load()), "route", route)
+	for _, group := range p.groups {
+		m.add("omni_lb_group_requests_total", "", float64(group.requests.Load()), "route", route, "group", group.name)
+		m.add("omni_lb_group_weight", "", float64(group.weight.Load()), "route", route, "group", group.name)
+	}
+	m.add("omni_lb_backends", "", float64(len(p.serviceMap)), "route", route)
+	m.add("omni_lb_pool_size", "", float64(p.available()), "route", route)
+
+	servers := make([]string, 0, len(p.serviceMap))
+	hosts := make(map[string]string, len(p.serviceMap))
+	for server := range p.serviceMap {
+		servers = append(servers, server.String())
+		hosts[server.String()] = server.Host
+	}
+	slices.Sort(servers)
+
+	for _, backend := range servers {
+		host := hosts[backend]
+		up := 0.0
+		if p.isAliveMap[host] {
+			up = 1
+		}
+		m.add("omni_lb_backend_up", "", up, "route", route, "backend", backend)
+
+		stats, ok := p.statsMap[host]
+		if !ok {
+			continue
+		}
+		for class := 1; class < len(stats.classes); class++ {
+			if n := stats.classes[class].Load(); n > 0 {
+				m.add("omni_lb_requests_total", "", float64(n), "route", route, "backend", backend, "class", fmt.Sprintf("%dxx", class))
+			}
+		}
+		m.add("omni_lb_backend_in_flight_requests", "", float64(stats.inFlight.Load()), "route", route, "backend", backend)
+		m.add("omni_lb_backend_streams", "", float64(stats.streams.Load()), "route", route, "backend", backend)
+		m.add("omni_lb_health_checks_total", "", float64(stats.probeSuccesses.Load()), "route", route, "backend", backend, "result", "success")
+		m.add("omni_lb_health_checks_total", "", float64(stats.probeFailures.Load()), "route", route, "backend", backend, "result", "failure")
+
+		// Load the count first, as observe adds to a bucket before the count
+		count := stats.latency.count.Load()
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += stats.latency.buckets[i].Load()
+			m.add("omni_lb_request_duration_seconds", "_bucket", float64(cumulative), "route", route, "backend", backend, "le", formatValue(bound))
+		}
+		m.add("omni_lb_request_duration_seconds", "_bucket", float64(max(count, cumulative)), "route", route, "backend", backend, "le", "+Inf")
+		m.add("omni_lb_request_duration_seconds", "_sum", time.Duration(stats.latency.sum.Load()).Seconds(), "route", route, "backend", backend)
+		m.add("omni_lb_request_duration_seconds", "_count", float64(max(count, cumulative)), "route", route, "backend", backend)
+	}
+}
@@ -0,0 +1,94 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer backend.Close()
+
+	lb := newTestLoadBalancer(t, Config{
+		Algorithm: "round-robin",
+		Paths: []Route{
+			{Pattern: "GET /", Backends: []Backend{{Address: backend.URL}}},
+			{Pattern: "POST /post", RateLimit: RateLimit{Requests: 1, Per: time.Hour}, Backends: []Backend{{Address: backend.URL}}},
+		},
+	})
+	for _, path := range []string{"/", "/missing"} {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	// The second is rejected by the rate limit before reaching the backend
+	for range 2 {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/post", nil))
+	}
+
+	// Metrics are not served alongside the proxied paths, so the request goes
+	// to the backend
+	rr := httptest.NewRecorder()
+	lb.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if strings.Contains(rr.Body.String(), "omni_lb_") {
+		t.Errorf("expected no metrics on the public listener, got\n%s", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	lb.adminMux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d", rr.Code, http.StatusOK)
+	}
+	if got := rr.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Errorf("expected the Prometheus text format, got content type %q", got)
+	}
+
+	labels := `route="GET /",backend="` + backend.URL + `"`
+	for _, want := range []string{
+		"# TYPE omni_lb_requests_total counter",
+		`omni_lb_requests_total{` + labels + `,class="2xx"} 2`,
+		`omni_lb_requests_total{` + labels + `,class="4xx"} 1`,
+		"# TYPE omni_lb_request_duration_seconds histogram",
+		`omni_lb_request_duration_seconds_bucket{` + labels + `,le="+Inf"} 3`,
+		`omni_lb_request_duration_seconds_count{` + labels + `} 3`,
+		`omni_lb_backend_in_flight_requests{` + labels + `} 0`,
+		`omni_lb_health_checks_total{` + labels + `,result="success"} 0`,
+		`omni_lb_backend_up{` + labels + `} 1`,
+		"# TYPE omni_lb_route_requests_total counter",
+		`omni_lb_route_requests_total{route="GET /",class="2xx"} 2`,
+		`omni_lb_route_requests_total{route="GET /",class="4xx"} 1`,
+		`omni_lb_route_requests_total{route="POST /post",class="2xx"} 1`,
+		`omni_lb_route_requests_total{route="POST /post",class="4xx"} 1`,
+		`omni_lb_route_in_flight_requests{route="GET /"} 0`,
+		`omni_lb_pool_size{route="GET /"} 1`,
+	} {
+		if !strings.Contains(rr.Body.String(), want+"\n") {
+			t.Errorf("expected metrics to contain %q, got\n%s", want, rr.Body.String())
+		}
+	}
+}
+
+func TestHistogramObserve(t *testing.T) {
+	var h histogram
+	h.observe(3 * time.Millisecond)
+	h.observe(300 * time.Millisecond)
+	h.observe(time.Minute)
+
+	if h.buckets[0].Load() != 1 || h.buckets[6].Load() != 1 {
+		t.Errorf("expected observations in the 5ms and 500ms buckets")
+	}
+	if h.count.Load() != 3 {
+		t.Errorf("expected a count of 3, got %d", h.count.Load())
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	if got := escapeLabel("a\"b\\c\nd"); got != `a\"b\\c\nd` {
+		t.Errorf("got %s", got)
+	}
+}
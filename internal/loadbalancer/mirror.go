@@ -0,0 +1,124 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// newMirrorProxy creates the proxy for the shadow pool of a route. It shares
+// the route's rewrite rules so the shadow backends see the same requests, but
+// never retries, as a mirrored request is only ever sent once.
+func newMirrorProxy(route Route, logger *slog.Logger) (*LoadBalancerProxy, error) {
+	spec := route.Mirror.withDefaults()
+	return newRouteProxy(Route{
+		Pattern:     route.Pattern + " mirror",
+		Algorithm:   "weighted-round-robin",
+		Backends:    spec.Backends,
+		Timeout:     spec.Timeout,
+		HealthCheck: route.HealthCheck,
+		Retry:       Retry{Attempts: 1},
+		Rewrite:     route.Rewrite,
+	}, logger)
+}
+
+// shouldMirror decides whether to copy a request to the shadow pool. Streams
+// are never mirrored as they do not finish.
+func (p *LoadBalancerProxy) shouldMirror(r *http.Request) bool {
+	if p.mirror == nil || isStreaming(r) {
+		return false
+	}
+	return rand.IntN(100) < p.mirrorSpec.withDefaults().Percent
+}
+
+// mirrorRequest sends a copy of the request with body to the shadow pool in
+// the background. The returned function takes the status and latency of the
+// primary response and logs how the shadow response differed, once it has
+// arrived. It returns nil if too many mirrored requests are in flight.
+func (p *LoadBalancerProxy) mirrorRequest(r *http.Request, body []byte) func(status int, latency time.Duration) {
+	if p.mirrorInFlight.Add(1) > int64(p.mirrorSpec.withDefaults().MaxInFlight) {
+		p.mirrorInFlight.Add(-1)
+		p.mirrorDropped.Add(1)
+		return nil
+	}
+	p.mirrored.Add(1)
+
+	// The copy must outlive the request, and must not share its context so
+	// the shadow pool does not touch the access log record or retry state
+	shadow := r.Clone(context.Background())
+	shadow.Body = http.NoBody
+	if body != nil {
+		shadow.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	method, uri := r.Method, r.URL.RequestURI()
+
+	type result struct {
+		status  int
+		latency time.Duration
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer p.mirrorInFlight.Add(-1)
+		rec := &discardResponse{header: make(http.Header)}
+		start := time.Now()
+		p.mirror.ServeHTTP(rec, shadow)
+		done <- result{status: rec.statusCode(), latency: time.Since(start)}
+	}()
+
+	return func(status int, latency time.Duration) {
+		go func() {
+			mirrored := <-done
+			attrs := []any{
+				slog.String("path", p.pattern),
+				slog.String("method", method),
+				slog.String("uri", uri),
+				slog.Int("status", status),
+				slog.Int("mirror_status", mirrored.status),
+				slog.Duration("latency", latency),
+				slog.Duration("mirror_latency", mirrored.latency),
+				slog.Duration("latency_difference", mirrored.latency-latency),
+			}
+			if mirrored.status != status {
+				p.mirrorMismatches.Add(1)
+				p.log().Warn("mirrored response status differs", attrs...)
+				return
+			}
+			p.log().Debug("mirrored response matches", attrs...)
+		}()
+	}
+}
+
+// A discardResponse is the response writer for mirrored requests, which keeps
+// only the status
+type discardResponse struct {
+	header http.Header
+	status int
+}
+
+func (d *discardResponse) Header() http.Header {
+	return d.header
+}
+
+func (d *discardResponse) WriteHeader(status int) {
+	if d.status == 0 && status >= 200 {
+		d.status = status
+	}
+}
+
+func (d *discardResponse) Write(b []byte) (int, error) {
+	if d.status == 0 {
+		d.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (d *discardResponse) statusCode() int {
+	if d.status == 0 {
+		return http.StatusOK
+	}
+	return d.status
+}
@@ -0,0 +1,105 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newMirrorTestLoadBalancer mirrors POST /post from primary to shadow
+func newMirrorTestLoadBalancer(t *testing.T, primary, shadow *httptest.Server, maxInFlight int) *LoadBalancer {
+	t.Helper()
+	return newTestLoadBalancer(t, Config{
+		Algorithm: "round-robin",
+		Paths: []Route{{
+			Pattern:  "POST /post",
+			Backends: []Backend{{Address: primary.URL}},
+			Mirror: Mirror{
+				Backends:    []Backend{{Address: shadow.URL}},
+				MaxInFlight: maxInFlight,
+			},
+		}},
+	})
+}
+
+func TestMirrorCopiesRequests(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}))
+	defer primary.Close()
+
+	type mirrored struct {
+		method, path, requestID, body string
+	}
+	received := make(chan mirrored, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- mirrored{r.Method, r.URL.Path, r.Header.Get(XRequestID), string(body)}
+		writeJSONError(w, http.StatusInternalServerError, "shadow failed")
+	}))
+	defer shadow.Close()
+
+	lb := newMirrorTestLoadBalancer(t, primary, shadow, 0)
+	req := httptest.NewRequest(http.MethodPost, "/post", strings.NewReader(`{"title":"mirrored"}`))
+	req.Header.Set(XRequestID, "mirror-1")
+	rr := httptest.NewRecorder()
+	lb.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusCreated || rr.Body.String() != `{"title":"mirrored"}` {
+		t.Fatalf("expected the primary response, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	select {
+	case got := <-received:
+		want := mirrored{http.MethodPost, "/post", "mirror-1", `{"title":"mirrored"}`}
+		if got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the request to be mirrored")
+	}
+
+	proxy := lb.Proxies["POST /post"]
+	if !waitFor(t, func() bool { return proxy.mirrorMismatches.Load() == 1 }) {
+		t.Errorf("expected the status difference to be counted")
+	}
+	if got := proxy.mirrored.Load(); got != 1 {
+		t.Errorf("expected 1 mirrored request, got %d", got)
+	}
+}
+
+func TestMirrorDropsWhenFull(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer primary.Close()
+
+	release := make(chan struct{})
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer shadow.Close()
+	defer close(release)
+
+	lb := newMirrorTestLoadBalancer(t, primary, shadow, 1)
+	for range 2 {
+		// The primary answers at once, however long the shadow pool takes
+		start := time.Now()
+		rr := httptest.NewRecorder()
+		lb.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/post", strings.NewReader("body")))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected the primary response, got %d", rr.Code)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("expected the primary not to wait for the mirror, took %v", elapsed)
+		}
+	}
+
+	proxy := lb.Proxies["POST /post"]
+	if sent, dropped := proxy.mirrored.Load(), proxy.mirrorDropped.Load(); sent != 1 || dropped != 1 {
+		t.Errorf("expected 1 mirrored and 1 dropped request, got %d and %d", sent, dropped)
+	}
+}
@@ -0,0 +1,148 @@
+package loadbalancer
+
+import (
+	"log/slog"
+	"net/url"
+	"time"
+)
+
+// outlierState tracks the recent responses of a backend for passive outlier
+// detection
+type outlierState struct {
+	consecutiveErrors int       // 5xx responses and transport errors in a row
+	ejections         int       // How many times the backend has been ejected recently
+	ejectedUntil      time.Time // Zero when the backend is not ejected
+	lastEjected       time.Time
+}
+
+func (s *outlierState) isEjected() bool {
+	return !s.ejectedUntil.IsZero()
+}
+
+// recordResult counts the response from a backend and ejects it from the
+// balancer once it has returned too many errors in a row
+func (p *LoadBalancerProxy) recordResult(server *url.URL, status int) {
+	spec := p.outlierSpec.withDefaults()
+	if spec.Disabled {
+		return
+	}
+
+	p.Lock()
+	if _, ok := p.lookup(server); !ok {
+		p.Unlock()
+		return
+	}
+	if p.outlierMap == nil {
+		p.outlierMap = make(map[string]*outlierState)
+	}
+	state, ok := p.outlierMap[server.Host]
+	if !ok {
+		state = &outlierState{}
+		p.outlierMap[server.Host] = state
+	}
+
+	if status < 500 {
+		state.consecutiveErrors = 0
+		p.Unlock()
+		return
+	}
+
+	state.consecutiveErrors++
+	if state.isEjected() || state.consecutiveErrors < spec.ConsecutiveErrors {
+		p.Unlock()
+		return
+	}
+
+	// Never eject more than the maximum share of the pool, so a problem
+	// shared by every backend does not take the whole route down
+	ejected := 0
+	for _, s := range p.outlierMap {
+		if s.isEjected() {
+			ejected++
+		}
+	}
+	if (ejected+1)*100 > spec.MaxEjectionPercent*len(p.serviceMap) {
+		p.Unlock()
+		p.log().Warn("not ejecting backend, too many backends are already ejected",
+			slog.String("path", p.pattern),
+			slog.String("backend", server.String()),
+			slog.Int("ejected", ejected),
+		)
+		return
+	}
+
+	// Forget earlier ejections once the backend has behaved for long enough
+	now := time.Now()
+	if now.Sub(state.lastEjected) > spec.MaxEjectionTime+spec.BaseEjectionTime {
+		state.ejections = 0
+	}
+
+	duration := spec.BaseEjectionTime << state.ejections
+	if duration > spec.MaxEjectionTime || duration <= 0 {
+		duration = spec.MaxEjectionTime
+	}
+	state.ejections++
+	state.consecutiveErrors = 0
+	state.lastEjected = now
+	state.ejectedUntil = now.Add(duration)
+	ejections := state.ejections
+	p.Unlock()
+
+	p.log().Warn("ejecting backend after consecutive errors",
+		slog.String("path", p.pattern),
+		slog.String("backend", server.String()),
+		slog.Duration("duration", duration),
+		slog.Int("ejections", ejections),
+	)
+	p.updateBalancer(server)
+	time.AfterFunc(duration, func() { p.uneject(server) })
+}
+
+// uneject returns a backend to the balancer once its ejection has ended
+func (p *LoadBalancerProxy) uneject(server *url.URL) {
+	p.Lock()
+	state, ok := p.outlierMap[server.Host]
+	if !ok || !state.isEjected() {
+		p.Unlock()
+		return
+	}
+	state.ejectedUntil = time.Time{}
+	p.Unlock()
+
+	p.log().Info("backend ejection ended",
+		slog.String("path", p.pattern),
+		slog.String("backend", server.String()),
+	)
+	p.updateBalancer(server)
+}
+
+// restoreOutlier carries the outlier state of a backend over from the proxy a
+// reload replaced, so an ejection lasts as long as it would have
+func (p *LoadBalancerProxy) restoreOutlier(server *url.URL, state outlierState) {
+	p.Lock()
+	existing, ok := p.lookup(server)
+	if !ok {
+		p.Unlock()
+		return
+	}
+	if p.outlierMap == nil {
+		p.outlierMap = make(map[string]*outlierState)
+	}
+	p.outlierMap[existing.Host] = &state
+	p.Unlock()
+
+	if state.isEjected() {
+		p.updateBalancer(existing)
+		time.AfterFunc(time.Until(state.ejectedUntil), func() { p.uneject(existing) })
+	}
+}
+
+func (p *LoadBalancerProxy) readOutlierMap(server *url.URL) (outlierState, bool) {
+	p.RLock()
+	defer p.RUnlock()
+	state, ok := p.outlierMap[server.Host]
+	if !ok {
+		return outlierState{}, false
+	}
+	return *state, true
+}
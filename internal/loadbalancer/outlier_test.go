@@ -0,0 +1,224 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newOutlierTestProxy creates a round robin proxy with n backends which are
+// never contacted
+func newOutlierTestProxy(t *testing.T, n int, spec OutlierDetection) (*LoadBalancerProxy, []*url.URL) {
+	t.Helper()
+	proxy, err := NewLoadBalancerProxy("round-robin")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	proxy.outlierSpec = spec
+
+	servers := make([]*url.URL, n)
+	for i := range servers {
+		servers[i] = &url.URL{Scheme: "http", Host: fmt.Sprintf("localhost:80%02d", i)}
+		proxy.Add(servers[i])
+	}
+	markAlive(proxy)
+	return proxy, servers
+}
+
+func TestOutlierEjectsAfterConsecutiveErrors(t *testing.T) {
+	proxy, servers := newOutlierTestProxy(t, 4, OutlierDetection{ConsecutiveErrors: 3, BaseEjectionTime: time.Hour})
+
+	proxy.recordResult(servers[0], http.StatusBadGateway)
+	proxy.recordResult(servers[0], http.StatusInternalServerError)
+	if proxy.balancer.Len() != 4 {
+		t.Fatalf("expected backend to stay in the balancer before the threshold, got %d backends", proxy.balancer.Len())
+	}
+
+	proxy.recordResult(servers[0], http.StatusServiceUnavailable)
+	if proxy.balancer.Len() != 3 {
+		t.Fatalf("expected backend to be ejected, got %d backends", proxy.balancer.Len())
+	}
+	state, _ := proxy.readOutlierMap(servers[0])
+	if !state.isEjected() || state.ejections != 1 {
+		t.Errorf("expected one ejection, got %+v", state)
+	}
+	if !proxy.ReadAliveMap(servers[0]) {
+		t.Errorf("expected ejection to leave the health check state alone")
+	}
+}
+
+func TestOutlierSuccessResetsErrors(t *testing.T) {
+	proxy, servers := newOutlierTestProxy(t, 2, OutlierDetection{ConsecutiveErrors: 2, BaseEjectionTime: time.Hour})
+
+	proxy.recordResult(servers[0], http.StatusBadGateway)
+	proxy.recordResult(servers[0], http.StatusNotFound)
+	proxy.recordResult(servers[0], http.StatusBadGateway)
+
+	if proxy.balancer.Len() != 2 {
+		t.Fatalf("expected errors separated by a success not to eject, got %d backends", proxy.balancer.Len())
+	}
+}
+
+func TestOutlierDisabled(t *testing.T) {
+	proxy, servers := newOutlierTestProxy(t, 2, OutlierDetection{Disabled: true, ConsecutiveErrors: 1})
+
+	proxy.recordResult(servers[0], http.StatusBadGateway)
+
+	if proxy.balancer.Len() != 2 {
+		t.Fatalf("expected disabled outlier detection not to eject, got %d backends", proxy.balancer.Len())
+	}
+}
+
+func TestOutlierEjectionTimeGrows(t *testing.T) {
+	spec := OutlierDetection{
+		ConsecutiveErrors: 1,
+		BaseEjectionTime:  time.Hour,
+		MaxEjectionTime:   3 * time.Hour,
+	}
+	proxy, servers := newOutlierTestProxy(t, 2, spec)
+
+	for _, want := range []time.Duration{time.Hour, 2 * time.Hour, 3 * time.Hour, 3 * time.Hour} {
+		before := time.Now()
+		proxy.recordResult(servers[0], http.StatusBadGateway)
+		state, _ := proxy.readOutlierMap(servers[0])
+		got := state.ejectedUntil.Sub(before)
+		if got < want || got > want+time.Minute {
+			t.Fatalf("expected ejection of %v, got %v", want, got)
+		}
+		proxy.uneject(servers[0])
+	}
+}
+
+func TestOutlierMaxEjectionPercent(t *testing.T) {
+	proxy, servers := newOutlierTestProxy(t, 4, OutlierDetection{ConsecutiveErrors: 1, BaseEjectionTime: time.Hour})
+
+	for _, server := range servers {
+		proxy.recordResult(server, http.StatusBadGateway)
+	}
+
+	if proxy.balancer.Len() != 2 {
+		t.Fatalf("expected only half of the backends to be ejected, got %d backends left", proxy.balancer.Len())
+	}
+}
+
+func TestOutlierUnejectReturnsBackend(t *testing.T) {
+	proxy, servers := newOutlierTestProxy(t, 2, OutlierDetection{ConsecutiveErrors: 1, BaseEjectionTime: time.Hour})
+
+	proxy.recordResult(servers[0], http.StatusBadGateway)
+	if proxy.balancer.Len() != 1 {
+		t.Fatalf("expected backend to be ejected, got %d backends", proxy.balancer.Len())
+	}
+
+	proxy.uneject(servers[0])
+	if proxy.balancer.Len() != 2 {
+		t.Fatalf("expected backend to return after its ejection, got %d backends", proxy.balancer.Len())
+	}
+}
+
+func TestOutlierUnejectKeepsUnhealthyBackendOut(t *testing.T) {
+	proxy, servers := newOutlierTestProxy(t, 2, OutlierDetection{ConsecutiveErrors: 1, BaseEjectionTime: time.Hour})
+
+	proxy.recordResult(servers[0], http.StatusBadGateway)
+	proxy.setAlive(servers[0], false)
+	proxy.uneject(servers[0])
+
+	if proxy.balancer.Len() != 1 {
+		t.Fatalf("expected unhealthy backend to stay out after its ejection, got %d backends", proxy.balancer.Len())
+	}
+}
+
+func TestOutlierHealthyBackendStaysEjected(t *testing.T) {
+	proxy, servers := newOutlierTestProxy(t, 2, OutlierDetection{ConsecutiveErrors: 1, BaseEjectionTime: time.Hour})
+
+	proxy.recordResult(servers[0], http.StatusBadGateway)
+	proxy.setAlive(servers[0], true)
+
+	if proxy.balancer.Len() != 1 {
+		t.Fatalf("expected passing health checks not to end an ejection, got %d backends", proxy.balancer.Len())
+	}
+}
+
+func TestProxyEjectsFailingBackend(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer working.Close()
+
+	proxy, err := newRouteProxy(Route{
+		Pattern:          "GET /",
+		Algorithm:        "round-robin",
+		OutlierDetection: OutlierDetection{ConsecutiveErrors: 2, BaseEjectionTime: time.Hour},
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	failingURL, _ := url.Parse(failing.URL)
+	workingURL, _ := url.Parse(working.URL)
+	proxy.Add(failingURL)
+	proxy.Add(workingURL)
+	markAlive(proxy)
+
+	for i := 0; i < 4; i++ {
+		proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	for i := 0; i < 4; i++ {
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected failing backend to be ejected, got %d", rr.Code)
+		}
+	}
+}
+
+func TestProxyIgnoresClientAborts(t *testing.T) {
+	started := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer backend.Close()
+
+	proxy, err := newRouteProxy(Route{
+		Pattern:          "GET /",
+		Algorithm:        "round-robin",
+		OutlierDetection: OutlierDetection{ConsecutiveErrors: 3, BaseEjectionTime: time.Hour},
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	backendURL, _ := url.Parse(backend.URL)
+	proxy.Add(backendURL)
+	markAlive(proxy)
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-started
+			cancel()
+		}()
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+		if rr.Code != statusClientClosedRequest {
+			t.Errorf("expected %d for an aborted request, got %d", statusClientClosedRequest, rr.Code)
+		}
+	}
+
+	if proxy.balancer.Len() != 1 {
+		t.Errorf("expected client aborts to leave the backend in the balancer, got %d backends", proxy.balancer.Len())
+	}
+	if state, _ := proxy.readOutlierMap(backendURL); state.isEjected() {
+		t.Errorf("expected client aborts not to eject the backend, got %+v", state)
+	}
+	if errors := proxy.statsMap[backendURL.Host].errors.Load(); errors != 0 {
+		t.Errorf("expected client aborts not to count as errors, got %d", errors)
+	}
+}
@@ -1,11 +1,25 @@
 package loadbalancer
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/harrydayexe/Omni/internal/loadbalancer/balancer"
 )
@@ -20,24 +34,139 @@ var (
 // A LoadBalancerProxy is an HTTP handler that forwards requests to a pool of
 // backend servers. It uses a Balancer to select the next server to use.
 type LoadBalancerProxy struct {
-	serviceMap map[*url.URL]*httputil.ReverseProxy
-	balancer   balancer.Balancer
+	serviceMap  map[*url.URL]*httputil.ReverseProxy
+	balancer    balancer.Balancer
+	algorithm   string
+	pattern     string           // The path the proxy serves, used in logs
+	logger      *slog.Logger     // May be nil, see log
+	hashKey     *requestKey      // Used when the balancer is a KeyBalancer
+	timeout     time.Duration    // Maximum time for a proxied request, zero for no limit
+	flush       time.Duration    // FlushInterval of the reverse proxies
+	streaming   bool             // Whether responses which are streams are exempt from the timeouts and concurrency limits
+	healthSpec  HealthCheck      // How backends are probed, defaults are used for unset fields
+	outlierSpec OutlierDetection // When backends are ejected, defaults are used for unset fields
+	retrySpec   Retry            // When failed requests are retried, defaults are used for unset fields
+	breakerSpec CircuitBreaker   // When circuit breakers open, defaults are used for unset fields
+	limiter     *rateLimiter     // Nil if the route is not rate limited
 
-	sync.RWMutex // Protect isAliveMap
-	isAliveMap   map[string]bool
+	// Set even if the route has no limits, as backends added through /addz
+	// can have their own
+	limits *concurrencyLimiter
+
+	discoverySpec Discovery // How backends are discovered, discovery is off if the name is empty
+	resolver      Resolver  // Used for discovery, defaults to net.DefaultResolver
+	rewrite       Rewrite   // Changes to requests and responses, applied to backends added after it is set
+
+	mirror     *LoadBalancerProxy // Shadow pool requests are copied to, nil if the route is not mirrored
+	mirrorSpec Mirror
+	groups     []*backendGroup // Pools the route splits its traffic between, nil if it has none
+
+	inFlight        atomic.Int64 // Requests being proxied, used for the retry budget
+	streams         atomic.Int64 // WebSockets and event streams being proxied, which are not in inFlight
+	retriesInFlight atomic.Int64
+	retries         atomic.Int64 // Retries since the proxy was created
+	rateLimited     atomic.Int64 // Requests rejected by the rate limit since the proxy was created
+
+	// Responses by status class, indexed by status / 100, including requests
+	// rejected before they reached a backend
+	responses [6]atomic.Int64
+
+	mirrorInFlight   atomic.Int64
+	mirrored         atomic.Int64 // Requests copied to the shadow pool since the proxy was created
+	mirrorDropped    atomic.Int64 // Requests not copied because too many were in flight
+	mirrorMismatches atomic.Int64 // Mirrored requests whose status differed from the primary
+
+	sync.RWMutex    // Protect the maps and stopHealthCheck
+	isAliveMap      map[string]bool
+	optionsMap      map[string]balancer.ServerOptions
+	healthMap       map[string]*healthState
+	outlierMap      map[string]*outlierState
+	breakerMap      map[string]*circuitBreaker
+	drainingMap     map[string]*drain
+	statsMap        map[string]*backendStats
+	discoveredMap   map[string]*url.URL      // Backends added by discovery, which it may remove
+	groupMap        map[string]*backendGroup // The group of each backend of a route with groups
+	stopHealthCheck context.CancelFunc
 }
 
-func customRewrite(rf func(*httputil.ProxyRequest)) func(*httputil.ProxyRequest) {
+// customRewrite applies the rewrite rules of the route around rf. The path is
+// rewritten before rf so it is joined to the backend URL, and the headers
+// after so the rules can override those set by the load balancer.
+func customRewrite(rules Rewrite, rf func(*httputil.ProxyRequest)) func(*httputil.ProxyRequest) {
 	return func(r *httputil.ProxyRequest) {
+		rules.rewriteURL(r.Out.URL)
 		rf(r)
-		r.Out.Header.Set(XRealIP, r.In.RemoteAddr)
+		r.Out.Header.Set(XRealIP, clientIP(r.In))
 		r.Out.Header.Set(XProxy, ReverseProxy)
+		if rules.Host != "" {
+			r.Out.Host = rules.Host
+		}
+		rules.RequestHeaders.apply(r.Out.Header)
+	}
+}
+
+// statusClientClosedRequest is recorded for requests the client gave up on
+// before the backend answered, as nginx does
+const statusClientClosedRequest = 499
+
+// proxyError logs a failure to proxy a request to the backend and replies
+// with 504 when the route timeout is hit and 502 for any other error. Errors
+// which can be retried are handed back to ServeHTTP without replying.
+func (p *LoadBalancerProxy) proxyError(w http.ResponseWriter, r *http.Request, server *url.URL, err error) {
+	if clientGone(r) {
+		p.log().Debug("client closed the request",
+			slog.String("path", p.pattern),
+			slog.String("backend", server.String()),
+		)
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	}
+	err = timeoutCause(r, err)
+	if a, ok := r.Context().Value(attemptKey{}).(*attempt); ok && a.retryable(err) {
+		a.err = err
+		return
+	}
+	status, message := http.StatusBadGateway, "The backend for this path could not be reached."
+	if errors.Is(err, context.DeadlineExceeded) {
+		status, message = http.StatusGatewayTimeout, "The backend for this path took too long to respond."
 	}
+	p.log().Warn("failed to proxy request",
+		slog.String("path", p.pattern),
+		slog.String("backend", server.String()),
+		slog.Int("status", status),
+		slog.Any("error", err),
+	)
+	writeJSONError(w, status, message)
+}
+
+// clientGone reports whether the request ended because the client went away,
+// rather than because of a timeout of the route or the try
+func clientGone(r *http.Request) bool {
+	return errors.Is(context.Cause(r.Context()), context.Canceled)
+}
+
+// writeJSONError replies with an error in the same format as the admin
+// endpoints
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}{http.StatusText(status), message})
 }
 
 func NewLoadBalancerProxy(algorithm string) (*LoadBalancerProxy, error) {
 	services := make(map[*url.URL]*httputil.ReverseProxy)
 	isAlive := make(map[string]bool)
+	options := make(map[string]balancer.ServerOptions)
+	health := make(map[string]*healthState)
+	outliers := make(map[string]*outlierState)
+	breakers := make(map[string]*circuitBreaker)
+	stats := make(map[string]*backendStats)
+	draining := make(map[string]*drain)
+	discovered := make(map[string]*url.URL)
+	groups := make(map[string]*backendGroup)
 
 	bal, err := balancer.BuildBalancer(algorithm)
 	if err != nil {
@@ -45,53 +174,627 @@ func NewLoadBalancerProxy(algorithm string) (*LoadBalancerProxy, error) {
 	}
 
 	lb := LoadBalancerProxy{
-		serviceMap: services,
-		isAliveMap: isAlive,
-		balancer:   bal,
+		serviceMap:    services,
+		isAliveMap:    isAlive,
+		optionsMap:    options,
+		healthMap:     health,
+		outlierMap:    outliers,
+		breakerMap:    breakers,
+		statsMap:      stats,
+		drainingMap:   draining,
+		discoveredMap: discovered,
+		groupMap:      groups,
+		balancer:      bal,
+		algorithm:     algorithm,
+		resolver:      net.DefaultResolver,
+		limits:        newConcurrencyLimiter(Concurrency{}),
 	}
 
 	return &lb, nil
 }
 
+// newRouteProxy creates the proxy for a route, including its static backends.
+// The route should have its defaults filled in by Config.Routes.
+func newRouteProxy(route Route, logger *slog.Logger) (*LoadBalancerProxy, error) {
+	proxy, err := NewLoadBalancerProxy(route.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	proxy.pattern = route.Pattern
+	proxy.logger = logger
+
+	if route.HashKey != "" {
+		proxy.hashKey, err = parseRequestKey(route.HashKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	proxy.timeout = route.Timeout
+	proxy.flush = route.FlushInterval
+	proxy.streaming = route.Streaming
+	proxy.healthSpec = route.HealthCheck
+	proxy.outlierSpec = route.OutlierDetection
+	proxy.retrySpec = route.Retry
+	proxy.breakerSpec = route.CircuitBreaker
+	if route.RateLimit.Requests > 0 {
+		proxy.limiter = newRateLimiter(route.RateLimit)
+	}
+	proxy.limits = newConcurrencyLimiter(route.Concurrency)
+	proxy.discoverySpec = route.Discovery
+	proxy.rewrite = route.Rewrite
+	if len(route.Mirror.Backends) > 0 {
+		proxy.mirror, err = newMirrorProxy(route, logger)
+		if err != nil {
+			return nil, err
+		}
+		proxy.mirrorSpec = route.Mirror
+	}
+	proxy.groups, err = newBackendGroups(route)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, backend := range route.Backends {
+		address, err := parseBackendAddress(backend.Address)
+		if err != nil {
+			return nil, err
+		}
+		proxy.AddWithOptions(address, backend.options())
+	}
+	for _, group := range route.Groups {
+		for _, backend := range group.Backends {
+			address, err := parseBackendAddress(backend.Address)
+			if err != nil {
+				return nil, err
+			}
+			if err := proxy.AddToGroup(address, group.Name, backend.options()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return proxy, nil
+}
+
 func (p *LoadBalancerProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+	w = rec
+	defer func() {
+		if class := rec.status / 100; class > 0 && class < len(p.responses) {
+			p.responses[class].Add(1)
+		}
+	}()
 	defer func() {
 		if err := recover(); err != nil {
-			// log.Printf("proxy causes panic :%s", err)
-			w.WriteHeader(http.StatusBadGateway)
-			w.Write([]byte(err.(error).Error()))
+			// The reverse proxy aborts a response which fails part way
+			// through, which the server must see to close the connection
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			p.log().Error("proxy panicked", slog.String("path", p.pattern), slog.Any("error", err))
+			writeJSONError(w, http.StatusBadGateway, "The request could not be proxied.")
+		}
+	}()
+
+	if record := accessRecordFrom(r.Context()); record != nil {
+		record.route = p.pattern
+	}
+
+	if p.limiter != nil && !p.limiter.allow(w, r) {
+		p.rateLimited.Add(1)
+		return
+	}
+
+	// A request is only known to be a stream once the backend answers, see
+	// startStream. Streams stay open for as long as the client wants them,
+	// so from then on they are exempt from the timeouts and concurrency
+	// limits and counted apart from ordinary requests.
+	watch := &streamWatch{}
+	r = r.WithContext(context.WithValue(r.Context(), streamKey{}, watch))
+	watch.onStart(func() { allowStream(w) })
+	if p.timeout > 0 {
+		ctx, stop, cancel := withTimeout(r.Context(), p.timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+		watch.onStart(stop)
+	}
+
+	p.inFlight.Add(1)
+	finished := sync.OnceFunc(func() { p.inFlight.Add(-1) })
+	defer finished()
+	watch.onStart(func() {
+		finished()
+		p.streams.Add(1)
+	})
+	defer func() {
+		if watch.started {
+			p.streams.Add(-1)
 		}
 	}()
 
-	host, err := p.balancer.Balance()
+	// Retries stay within the group the request was sent to
+	bal := p.selectBalancer(r)
+	tried := make(map[string]bool)
+	var host *url.URL
+	var err error
+	// Requests over a concurrency limit wait for others to finish
+	entered := false
+	waitErr := p.limits.wait(r.Context(), func() bool {
+		if !entered {
+			if !p.limits.enter() {
+				return false
+			}
+			entered = true
+		}
+		host, err = p.pickBackend(bal, r, tried)
+		return !errors.Is(err, errSaturated)
+	})
+	if entered {
+		leave := sync.OnceFunc(p.limits.leave)
+		defer leave()
+		watch.onStart(leave)
+	}
+	if waitErr != nil {
+		p.busy(w, waitErr)
+		return
+	}
+	if errors.Is(err, errAllBreakersOpen) {
+		// Fail fast rather than adding to the load on failing backends
+		retryAfter := int(math.Ceil(p.breakerRetryAfter().Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+		writeJSONError(w, http.StatusServiceUnavailable, "Every backend for this path is failing, try again later.")
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusBadGateway)
-		w.Write([]byte(fmt.Sprintf("balance error: %s", err.Error())))
+		p.log().Warn("no backend available", slog.String("path", p.pattern), slog.Any("error", err))
+		writeJSONError(w, http.StatusBadGateway, "No backend is available for this path.")
 		return
 	}
 
-	p.serviceMap[host].ServeHTTP(w, r)
+	retry := p.retrySpec.withDefaults()
+	canRetry := retry.Attempts > 1 && isIdempotent(r)
+	mirror := p.shouldMirror(r)
+	var body []byte
+	if canRetry || mirror {
+		var buffered bool
+		body, buffered = bufferBody(r)
+		canRetry = canRetry && buffered
+		mirror = mirror && buffered
+	}
+	if mirror {
+		if compare := p.mirrorRequest(r, body); compare != nil {
+			rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			w = rec
+			start := time.Now()
+			defer func() { compare(rec.status, time.Since(start)) }()
+		}
+	}
+
+	for try := 1; ; try++ {
+		tried[host.String()] = true
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		err := p.serveTry(w, r, host, canRetry && try < retry.Attempts)
+		if err == nil {
+			return
+		}
+
+		if errors.Is(err, errBackendRemoved) {
+			// Nothing was sent, so any request can go to another backend
+			// without counting as a retry
+			next, nextErr := p.repickBackend(bal, r, tried)
+			if errors.Is(nextErr, errSaturated) {
+				p.busy(w, nextErr)
+				return
+			}
+			if nextErr != nil {
+				p.proxyError(w, r, host, err)
+				return
+			}
+			host = next
+			try--
+			continue
+		}
+
+		// Nothing has been written yet, so the request can still go to
+		// another backend or the error can be sent to the client
+		if !p.allowRetry() {
+			p.proxyError(w, r, host, err)
+			return
+		}
+		next, nextErr := p.repickBackend(bal, r, tried)
+		if errors.Is(nextErr, errSaturated) {
+			p.releaseRetry()
+			p.busy(w, nextErr)
+			return
+		}
+		if nextErr != nil {
+			p.releaseRetry()
+			p.proxyError(w, r, host, err)
+			return
+		}
+		p.log().Warn("retrying request on another backend",
+			slog.String("path", p.pattern),
+			slog.String("backend", host.String()),
+			slog.String("next", next.String()),
+			slog.Any("error", err),
+		)
+		host = next
+		p.retries.Add(1)
+		defer p.releaseRetry()
+	}
+}
+
+// repickBackend picks another backend for a request which has already been
+// sent to one. Like the first pick, it waits in the queue while every backend
+// left is at its concurrency limit, and returns an error wrapping errSaturated
+// if the wait fails.
+func (p *LoadBalancerProxy) repickBackend(bal balancer.Balancer, r *http.Request, tried map[string]bool) (*url.URL, error) {
+	var host *url.URL
+	var err error
+	waitErr := p.limits.wait(r.Context(), func() bool {
+		host, err = p.pickBackend(bal, r, tried)
+		return !errors.Is(err, errSaturated)
+	})
+	if waitErr != nil {
+		return nil, fmt.Errorf("%w: %w", errSaturated, waitErr)
+	}
+	return host, err
+}
+
+// busy replies to a request which could not get a concurrency slot in time
+func (p *LoadBalancerProxy) busy(w http.ResponseWriter, err error) {
+	p.log().Warn("request waited too long for a backend", slog.String("path", p.pattern), slog.Any("error", err))
+	writeJSONError(w, http.StatusServiceUnavailable, "Every backend for this path is busy, try again later.")
+}
+
+// serveTry proxies the request to a backend once. If canRetry is set and the
+// try fails in a way which can be retried, nothing is written and the error
+// is returned.
+func (p *LoadBalancerProxy) serveTry(w http.ResponseWriter, r *http.Request, host *url.URL, canRetry bool) error {
+	// The backend may have been removed since it was picked
+	p.RLock()
+	var proxy *httputil.ReverseProxy
+	if existing, ok := p.lookup(host); ok {
+		proxy = p.serviceMap[existing]
+	}
+	stats := p.statsMap[host.Host]
+	bal := p.balancerOf(host.Host)
+	p.RUnlock()
+
+	a := &attempt{parent: r.Context(), canRetry: canRetry}
+	// Taken by pickBackend
+	release := sync.OnceFunc(func() { p.limits.release(host.Host) })
+	defer release()
+	a.stream.onStart(release)
+	if proxy == nil {
+		return errBackendRemoved
+	}
+
+	if tracker, ok := bal.(balancer.ConnectionTracker); ok {
+		tracker.Inc(host)
+		defer tracker.Done(host)
+	}
+
+	ctx := context.WithValue(r.Context(), attemptKey{}, a)
+	if p.retrySpec.PerTryTimeout > 0 {
+		var stop func()
+		var cancel context.CancelFunc
+		ctx, stop, cancel = withTimeout(ctx, p.retrySpec.PerTryTimeout)
+		defer cancel()
+		a.stream.onStart(stop)
+	}
+
+	if stats != nil {
+		stats.inFlight.Add(1)
+		finished := sync.OnceFunc(func() { stats.inFlight.Add(-1) })
+		defer finished()
+		a.stream.onStart(func() {
+			finished()
+			stats.streams.Add(1)
+		})
+		defer func() {
+			if a.stream.started {
+				stats.streams.Add(-1)
+			}
+		}()
+	}
+
+	var traced func()
+	if record := accessRecordFrom(ctx); record != nil {
+		ctx, traced = record.traceTry(ctx, host.String())
+	}
+
+	start := time.Now()
+	rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+	proxy.ServeHTTP(rec, r.WithContext(ctx))
+	if traced != nil {
+		traced()
+	}
+	if clientGone(r) {
+		// A client hanging up says nothing about the backend
+		p.releaseBreaker(host)
+		return nil
+	}
+	if a.err != nil {
+		rec.status = http.StatusBadGateway
+	}
+	if stats != nil {
+		stats.requests.Add(1)
+		if rec.status >= 500 {
+			stats.errors.Add(1)
+		}
+		if class := rec.status / 100; class > 0 && class < len(stats.classes) {
+			stats.classes[class].Add(1)
+		}
+		// The length of a stream says nothing about how fast the backend is
+		if !a.stream.started {
+			stats.latency.observe(time.Since(start))
+		}
+	}
+	p.recordResult(host, rec.status)
+	p.recordBreaker(host, rec.status)
+	if observer, ok := bal.(balancer.LatencyObserver); ok && !a.stream.started {
+		observer.Observe(host, time.Since(start))
+	}
+	return a.err
+}
+
+// balance selects the backend for the request from bal, using the request key
+// when the balancer supports it and the request carries one
+func (p *LoadBalancerProxy) balance(bal balancer.Balancer, r *http.Request) (*url.URL, error) {
+	if kb, ok := bal.(balancer.KeyBalancer); ok && p.hashKey != nil {
+		if key := p.hashKey.extract(r); key != "" {
+			return kb.BalanceKey(key)
+		}
+	}
+	return bal.Balance()
 }
 
 func (p *LoadBalancerProxy) Add(server *url.URL) {
+	p.AddWithOptions(server, balancer.ServerOptions{Weight: 1})
+}
+
+// AddWithOptions adds a server along with the metadata the balancer should
+// use for it, such as its weight. Adding a server which is already present
+// updates its options.
+func (p *LoadBalancerProxy) AddWithOptions(server *url.URL, options balancer.ServerOptions) {
 	p.Lock()
 	defer p.Unlock()
+	p.add(server, nil, options)
+}
 
-	proxy := httputil.NewSingleHostReverseProxy(server)
+// add adds a server to the group, or to the proxy balancer if the group is
+// nil. Must be called with the lock held.
+func (p *LoadBalancerProxy) add(server *url.URL, group *backendGroup, options balancer.ServerOptions) {
+	if existing, ok := p.lookup(server); ok {
+		if previous := p.groupMap[existing.Host]; previous != group {
+			p.balancerOf(existing.Host).Remove(existing)
+			p.setGroup(existing.Host, group)
+		}
 
-	rewrite := proxy.Rewrite
-	proxy.Rewrite = customRewrite(rewrite)
+		// Adding a backend which is draining cancels the drain
+		p.optionsMap[existing.Host] = options
+		delete(p.drainingMap, existing.Host)
+		if p.usable(existing) {
+			balancer.AddServer(p.balancerOf(existing.Host), existing, options)
+		}
+		return
+	}
+
+	// A ReverseProxy must not have both a Director and a Rewrite, so the
+	// proxy is built directly rather than with NewSingleHostReverseProxy
+	proxy := &httputil.ReverseProxy{
+		Rewrite: customRewrite(p.rewrite, func(r *httputil.ProxyRequest) {
+			r.SetURL(server)
+			setForwarded(r)
+		}),
+		ModifyResponse: func(resp *http.Response) error {
+			p.startStream(resp)
+			return p.rewrite.modifyResponse(resp)
+		},
+		FlushInterval: p.flush,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			p.proxyError(w, r, server, err)
+		},
+	}
 
-	// Initially set to not alive
+	// Initially set to not alive, the backend is added to the balancer once
+	// it passes enough health checks
 	p.isAliveMap[server.Host] = false
+	p.optionsMap[server.Host] = options
+	if p.statsMap == nil {
+		p.statsMap = make(map[string]*backendStats)
+	}
+	p.statsMap[server.Host] = &backendStats{}
+	p.setGroup(server.Host, group)
 	p.serviceMap[server] = proxy
-	p.balancer.Add(server)
 }
 
 func (p *LoadBalancerProxy) Remove(server *url.URL) {
 	p.Lock()
 	defer p.Unlock()
+	p.remove(server)
+}
 
-	delete(p.serviceMap, server)
+// remove deletes a backend. Must be called with the lock held.
+func (p *LoadBalancerProxy) remove(server *url.URL) {
+	if existing, ok := p.lookup(server); ok {
+		delete(p.serviceMap, existing)
+	}
 	delete(p.isAliveMap, server.Host)
-	p.balancer.Remove(server)
+	delete(p.optionsMap, server.Host)
+	delete(p.healthMap, server.Host)
+	delete(p.outlierMap, server.Host)
+	delete(p.breakerMap, server.Host)
+	delete(p.statsMap, server.Host)
+	delete(p.drainingMap, server.Host)
+	delete(p.discoveredMap, server.Host)
+	p.balancerOf(server.Host).Remove(server)
+	delete(p.groupMap, server.Host)
+}
+
+// A responseRecorder records the status written by the reverse proxy
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, which the
+// reverse proxy uses to flush streamed responses
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Hijack records the switch to another protocol, which is written straight
+// to the connection rather than through WriteHeader
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err == nil {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+// log returns the proxy's logger, or one which discards everything for
+// proxies created without one
+func (p *LoadBalancerProxy) log() *slog.Logger {
+	if p.logger == nil {
+		return slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	return p.logger
+}
+
+// lookup finds the key in serviceMap for the server. Callers often hold a
+// different *url.URL for the same server, e.g. one parsed from a request, so
+// keys are compared by their string form. Must be called with the lock held.
+func (p *LoadBalancerProxy) lookup(server *url.URL) (*url.URL, bool) {
+	if _, ok := p.serviceMap[server]; ok {
+		return server, true
+	}
+	for existing := range p.serviceMap {
+		if existing.String() == server.String() {
+			return existing, true
+		}
+	}
+	return nil, false
+}
+
+// backendStats counts the requests proxied to a backend and its health checks
+type backendStats struct {
+	inFlight atomic.Int64
+	streams  atomic.Int64
+	requests atomic.Int64
+	errors   atomic.Int64    // 5xx responses and failures to reach the backend
+	classes  [6]atomic.Int64 // Responses by status class, indexed by status / 100
+	latency  histogram
+
+	probeSuccesses atomic.Int64
+	probeFailures  atomic.Int64
+}
+
+// A backendStatus describes a backend for the admin endpoints
+type backendStatus struct {
+	URL            string     `json:"url"`
+	Weight         int        `json:"weight"`
+	MaxConcurrent  int        `json:"max_concurrent,omitempty"`
+	Alive          bool       `json:"alive"`
+	Ejected        bool       `json:"ejected"`
+	Draining       bool       `json:"draining"`
+	Discovered     bool       `json:"discovered"`
+	Group          string     `json:"group,omitempty"`
+	CircuitBreaker string     `json:"circuit_breaker"`
+	InFlight       int64      `json:"in_flight"`
+	Streams        int64      `json:"streams"`
+	Requests       int64      `json:"requests"`
+	Errors         int64      `json:"errors"`
+	LastProbe      *time.Time `json:"last_probe,omitempty"` // Nil until the backend has been probed
+	LastProbeError string     `json:"last_probe_error,omitempty"`
+}
+
+// status describes every backend of the proxy, sorted by URL
+func (p *LoadBalancerProxy) status() []backendStatus {
+	p.RLock()
+	defer p.RUnlock()
+
+	statuses := make([]backendStatus, 0, len(p.serviceMap))
+	for server := range p.serviceMap {
+		status := backendStatus{
+			URL:            server.String(),
+			Weight:         p.optionsMap[server.Host].Weight,
+			MaxConcurrent:  p.optionsMap[server.Host].MaxConcurrent,
+			Alive:          p.isAliveMap[server.Host],
+			Draining:       p.drainingMap[server.Host] != nil,
+			Discovered:     p.discoveredMap[server.Host] != nil,
+			Group:          p.groupMap[server.Host].groupName(),
+			CircuitBreaker: breakerClosed.String(),
+		}
+		if state, ok := p.outlierMap[server.Host]; ok {
+			status.Ejected = state.isEjected()
+		}
+		if b, ok := p.breakerMap[server.Host]; ok {
+			status.CircuitBreaker = b.state.String()
+		}
+		if stats, ok := p.statsMap[server.Host]; ok {
+			status.InFlight = stats.inFlight.Load()
+			status.Streams = stats.streams.Load()
+			status.Requests = stats.requests.Load()
+			status.Errors = stats.errors.Load()
+		}
+		if health, ok := p.healthMap[server.Host]; ok {
+			lastProbe := health.lastProbe
+			status.LastProbe = &lastProbe
+			if health.lastError != nil {
+				status.LastProbeError = health.lastError.Error()
+			}
+		}
+		statuses = append(statuses, status)
+	}
+
+	slices.SortFunc(statuses, func(a, b backendStatus) int {
+		return strings.Compare(a.URL, b.URL)
+	})
+	return statuses
+}
+
+// A backendSnapshot is a copy of the state the proxy holds for one backend
+type backendSnapshot struct {
+	url        *url.URL
+	options    balancer.ServerOptions
+	alive      bool
+	discovered bool
+	draining   bool
+	outlier    *outlierState // Copy of the outlier state, nil if there is none
+	group      string        // Name of the group the backend is in, empty if the route has none
+}
+
+// backends returns a snapshot of every backend in the proxy
+func (p *LoadBalancerProxy) backends() []backendSnapshot {
+	p.RLock()
+	defer p.RUnlock()
+
+	snapshots := make([]backendSnapshot, 0, len(p.serviceMap))
+	for server := range p.serviceMap {
+		snapshot := backendSnapshot{
+			url:        server,
+			options:    p.optionsMap[server.Host],
+			alive:      p.isAliveMap[server.Host],
+			discovered: p.discoveredMap[server.Host] != nil,
+			draining:   p.drainingMap[server.Host] != nil,
+			group:      p.groupMap[server.Host].groupName(),
+		}
+		if state, ok := p.outlierMap[server.Host]; ok {
+			outlier := *state
+			snapshot.outlier = &outlier
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots
 }
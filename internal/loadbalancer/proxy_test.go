@@ -0,0 +1,116 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestProxyBalanceUsesHashKey(t *testing.T) {
+	proxy, err := NewLoadBalancerProxy("consistent-hash")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	proxy.hashKey = &requestKey{source: "header", name: "X-Omni-User"}
+	for i := 0; i < 5; i++ {
+		proxy.Add(&url.URL{Scheme: "http", Host: fmt.Sprintf("localhost:80%02d", i)})
+	}
+	markAlive(proxy)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Omni-User", "42")
+
+	first, err := proxy.balance(proxy.balancer, req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		got, _ := proxy.balance(proxy.balancer, req)
+		if got.String() != first.String() {
+			t.Fatalf("expected request to stay on %v, got %v", first, got)
+		}
+	}
+
+	// Without the key the requests are spread over the pool
+	seen := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		got, _ := proxy.balance(proxy.balancer, httptest.NewRequest(http.MethodGet, "/", nil))
+		seen[got.String()] = true
+	}
+	if len(seen) != 5 {
+		t.Errorf("expected requests without a key to use every backend, got %v", seen)
+	}
+}
+
+func TestProxyTimeout(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	backendURL, _ := url.Parse(backend.URL)
+	logs := &bytes.Buffer{}
+	logger := slog.New(slog.NewTextHandler(logs, nil))
+	proxy, err := newRouteProxy(Route{Pattern: "GET /", Algorithm: "round-robin", Timeout: 50 * time.Millisecond}, logger)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	proxy.Add(backendURL)
+	markAlive(proxy)
+
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Errorf("got %d, want %d", rr.Code, http.StatusGatewayTimeout)
+	}
+	var body struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil || body.Error != "Gateway Timeout" || body.Message == "" {
+		t.Errorf("expected a JSON error, got %+v (%v)", body, err)
+	}
+	// The failure is logged with the backend it was for
+	if !bytes.Contains(logs.Bytes(), []byte("failed to proxy request")) || !bytes.Contains(logs.Bytes(), []byte(backend.URL)) {
+		t.Errorf("expected the failure to be logged with the backend, got %q", logs.String())
+	}
+}
+
+func TestProxyForwardsRequest(t *testing.T) {
+	var gotProxyHeader string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotProxyHeader = r.Header.Get(XProxy)
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	proxy, err := NewLoadBalancerProxy("round-robin")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	proxy.Add(backendURL)
+	markAlive(proxy)
+
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rr.Code != http.StatusTeapot {
+		t.Errorf("got %d, want %d", rr.Code, http.StatusTeapot)
+	}
+	if gotProxyHeader != ReverseProxy {
+		t.Errorf("expected %s header %q, got %q", XProxy, ReverseProxy, gotProxyHeader)
+	}
+}
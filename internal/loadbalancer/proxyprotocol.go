@@ -0,0 +1,217 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The signature at the start of a PROXY protocol v2 header
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// The longest a PROXY protocol v1 header can be, including the CRLF
+const proxyProtocolV1MaxLength = 107
+
+var errUntrustedProxyHeader = errors.New("proxy protocol header from an untrusted peer")
+
+// A proxyProtocolListener reads the PROXY protocol header which a load
+// balancer in front sends at the start of each connection, so the connection
+// reports the address of the client it was made for. Connections which start
+// without a header are used as they are, and connections from peers which are
+// not trusted fail if they start with one.
+type proxyProtocolListener struct {
+	net.Listener
+	trusted trustedProxies // Peers whose headers are read
+	timeout time.Duration  // Time allowed to read the header
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	peer, err := netip.ParseAddr(peerIP(conn.RemoteAddr().String()))
+	trusted := err == nil && l.trusted.contains(peer)
+	return &proxyProtocolConn{Conn: conn, trusted: trusted, timeout: l.timeout}, nil
+}
+
+// A proxyProtocolConn reads its header on the first call to Read or
+// RemoteAddr, so a slow peer does not hold up Accept
+type proxyProtocolConn struct {
+	net.Conn
+	trusted bool // Whether the header is read, rather than failing the connection
+	timeout time.Duration
+
+	once   sync.Once
+	reader *bufio.Reader
+	remote net.Addr // From the header, nil to use the address of the peer
+	err    error
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.reader = bufio.NewReader(c.Conn)
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		if !c.trusted {
+			// A header from anyone else could claim any address, and is not
+			// to be read as the start of a request either
+			if proxyHeaderVersion(c.reader) != 0 {
+				c.err = errUntrustedProxyHeader
+			}
+			return
+		}
+		c.remote, c.err = readProxyHeader(c.reader)
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if errors.Is(c.err, errUntrustedProxyHeader) {
+		// The server answers other read errors with 400 Bad Request, but the
+		// connection is dropped without a word
+		c.Conn.Close()
+		return 0, io.EOF
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header and returns the
+// source address it gives. It returns nil without an error if there is no
+// header, or the header does not give an address, such as for health checks
+// from the proxy itself.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	switch proxyHeaderVersion(r) {
+	case 1:
+		return readProxyHeaderV1(r)
+	case 2:
+		return readProxyHeaderV2(r)
+	}
+	return nil, nil
+}
+
+// proxyHeaderVersion returns the version of the PROXY protocol header r starts
+// with without reading it, or 0 if there is none
+func proxyHeaderVersion(r *bufio.Reader) int {
+	first, err := r.Peek(1)
+	if err != nil {
+		// The connection is handled as if there were no header, and fails
+		// when it is read
+		return 0
+	}
+
+	switch first[0] {
+	case 'P':
+		if start, err := r.Peek(6); err == nil && string(start) == "PROXY " {
+			return 1
+		}
+	case proxyProtocolV2Signature[0]:
+		if start, err := r.Peek(len(proxyProtocolV2Signature)); err == nil && bytes.Equal(start, proxyProtocolV2Signature) {
+			return 2
+		}
+	}
+	return 0
+}
+
+// readProxyHeaderV1 reads a header such as
+// "PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n"
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtocolV1MaxLength {
+			return nil, errors.New("proxy protocol header is too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read proxy protocol header: %w", err)
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("proxy protocol header %q is malformed", strings.TrimSpace(string(line)))
+	}
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil || addr.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("proxy protocol header has an invalid source address %s", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol header has an invalid source port %s", fields[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+// readProxyHeaderV2 reads a binary header. Any TLVs after the addresses are
+// skipped.
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("failed to read proxy protocol header: %w", err)
+	}
+	if version := header[12] >> 4; version != 2 {
+		return nil, fmt.Errorf("proxy protocol version %d is not supported", version)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("failed to read proxy protocol addresses: %w", err)
+	}
+
+	const (
+		commandLocal = 0x0
+		commandProxy = 0x1
+		familyInet   = 0x1
+		familyInet6  = 0x2
+	)
+	switch command := header[12] & 0x0f; command {
+	case commandLocal:
+		// Sent by the proxy on its own behalf
+		return nil, nil
+	case commandProxy:
+	default:
+		return nil, fmt.Errorf("proxy protocol command %d is not supported", command)
+	}
+
+	var size int
+	switch family := header[13] >> 4; family {
+	case familyInet:
+		size = 4
+	case familyInet6:
+		size = 16
+	default:
+		// Unix sockets and unspecified addresses say nothing about the client
+		return nil, nil
+	}
+	if len(payload) < 2*size+4 {
+		return nil, errors.New("proxy protocol header is too short for its addresses")
+	}
+	addr, _ := netip.AddrFromSlice(payload[:size])
+	port := binary.BigEndian.Uint16(payload[2*size:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, port)), nil
+}
@@ -0,0 +1,132 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyHeaderV2 builds a binary header for a TCP connection from source
+func proxyHeaderV2(command byte, source net.IP, port uint16) []byte {
+	family, addresses := byte(0x11), make([]byte, 12)
+	if ip4 := source.To4(); ip4 != nil {
+		copy(addresses, ip4)
+		binary.BigEndian.PutUint16(addresses[8:], port)
+	} else {
+		family, addresses = 0x21, make([]byte, 36)
+		copy(addresses, source)
+		binary.BigEndian.PutUint16(addresses[32:], port)
+	}
+	// A TLV after the addresses, which is skipped
+	addresses = append(addresses, 0x04, 0x00, 0x01, 0x00)
+
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+const proxyHeaderV1 = "PROXY TCP4 203.0.113.7 10.0.0.1 51234 80\r\n"
+
+func TestReadProxyHeader(t *testing.T) {
+	cases := []struct {
+		name    string
+		input   string
+		want    string // Empty for no address
+		wantErr bool
+	}{
+		{name: "v1 tcp4", input: "PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n", want: "203.0.113.7:51234"},
+		{name: "v1 tcp6", input: "PROXY TCP6 2001:db8::7 2001:db8::1 51234 443\r\n", want: "[2001:db8::7]:51234"},
+		{name: "v1 unknown", input: "PROXY UNKNOWN\r\n"},
+		{name: "v1 mismatched family", input: "PROXY TCP4 2001:db8::7 10.0.0.1 51234 443\r\n", wantErr: true},
+		{name: "v1 bad port", input: "PROXY TCP4 203.0.113.7 10.0.0.1 70000 443\r\n", wantErr: true},
+		{name: "v1 too long", input: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", wantErr: true},
+		{name: "v2 ipv4", input: string(proxyHeaderV2(0x1, net.ParseIP("203.0.113.7"), 51234)), want: "203.0.113.7:51234"},
+		{name: "v2 ipv6", input: string(proxyHeaderV2(0x1, net.ParseIP("2001:db8::7"), 51234)), want: "[2001:db8::7]:51234"},
+		{name: "v2 local", input: string(proxyHeaderV2(0x0, net.ParseIP("203.0.113.7"), 51234))},
+		{name: "no header", input: "GET / HTTP/1.1\r\n"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input + "GET"))
+			addr, err := readProxyHeader(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("got address %q, want %q", got, tt.want)
+			}
+
+			// Whatever follows the header is left to be read
+			rest, _ := io.ReadAll(r)
+			if tt.name != "no header" && string(rest) != "GET" {
+				t.Errorf("expected the request to follow the header, got %q", rest)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	cases := []struct {
+		name    string
+		trusted []string
+		header  string
+		want    string
+	}{
+		{name: "any peer", trusted: []string{"0.0.0.0/0", "::/0"}, header: proxyHeaderV1, want: "203.0.113.7"},
+		{name: "trusted peer", trusted: []string{"127.0.0.0/8"}, header: proxyHeaderV1, want: "203.0.113.7"},
+		{name: "trusted peer without header", trusted: []string{"127.0.0.0/8"}, want: "127.0.0.1"},
+		{name: "untrusted peer", trusted: []string{"10.0.0.0/8"}, header: proxyHeaderV1, want: "connection closed"},
+		{name: "untrusted peer v2", trusted: []string{"10.0.0.0/8"}, header: string(proxyHeaderV2(0x1, net.ParseIP("203.0.113.7"), 51234)), want: "connection closed"},
+		{name: "untrusted peer without header", trusted: []string{"10.0.0.0/8"}, want: "127.0.0.1"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &Server{ProxyProtocol: true, TrustedProxies: tt.trusted}
+			listener, err := spec.Listen("127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, clientIP(r))
+			})}
+			go server.Serve(listener)
+			defer server.Close()
+
+			conn, err := net.DialTimeout("tcp", listener.Addr().String(), time.Second)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			io.WriteString(conn, tt.header+"GET / HTTP/1.1\r\nHost: omni.example\r\nConnection: close\r\n\r\n")
+
+			got := "connection closed"
+			if resp, err := http.ReadResponse(bufio.NewReader(conn), nil); err == nil {
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				got = string(body)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
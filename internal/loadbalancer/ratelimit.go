@@ -0,0 +1,186 @@
+package loadbalancer
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// The ways requests can be grouped for rate limiting
+const (
+	rateLimitByIP           = "ip"
+	rateLimitByForwardedFor = "forwarded-for"
+	rateLimitByJWTSubject   = "jwt-subject"
+)
+
+// A rateLimiter keeps a token bucket for each client. Buckets are kept in an
+// LRU so the memory used stays bounded however many clients there are, a
+// client whose bucket was evicted starts again with a full bucket.
+type rateLimiter struct {
+	spec      RateLimit
+	now       func() time.Time
+	jwtSecret []byte // Verifies tokens for the jwt-subject key
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List // Most recently used at the front
+}
+
+type tokenBucket struct {
+	key     string
+	tokens  float64
+	updated time.Time
+}
+
+// A rateLimitResult is the outcome of taking a token for a request
+type rateLimitResult struct {
+	allowed    bool
+	remaining  int
+	retryAfter time.Duration // Until a token is available, zero if allowed
+	reset      time.Duration // Until the bucket is full again
+}
+
+func newRateLimiter(spec RateLimit) *rateLimiter {
+	spec = spec.withDefaults()
+	limiter := &rateLimiter{
+		spec:    spec,
+		now:     time.Now,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	if spec.Key == rateLimitByJWTSubject {
+		limiter.jwtSecret = []byte(os.Getenv(spec.JWTSecretEnv))
+	}
+	return limiter
+}
+
+// rate returns the tokens added to a bucket per second
+func (l *rateLimiter) rate() float64 {
+	return float64(l.spec.Requests) / l.spec.Per.Seconds()
+}
+
+// take removes a token from the bucket for key if there is one
+func (l *rateLimiter) take(key string) rateLimitResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	burst := float64(l.spec.Burst)
+
+	var bucket *tokenBucket
+	if element, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(element)
+		bucket = element.Value.(*tokenBucket)
+		elapsed := now.Sub(bucket.updated).Seconds()
+		bucket.tokens = math.Min(burst, bucket.tokens+elapsed*l.rate())
+		bucket.updated = now
+	} else {
+		if l.lru.Len() >= l.spec.MaxKeys {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*tokenBucket).key)
+		}
+		bucket = &tokenBucket{key: key, tokens: burst, updated: now}
+		l.buckets[key] = l.lru.PushFront(bucket)
+	}
+
+	result := rateLimitResult{allowed: bucket.tokens >= 1}
+	if result.allowed {
+		bucket.tokens--
+	} else {
+		result.retryAfter = l.secondsFor(1 - bucket.tokens)
+	}
+	result.remaining = int(bucket.tokens)
+	result.reset = l.secondsFor(burst - bucket.tokens)
+	return result
+}
+
+// secondsFor returns how long it takes to add tokens to a bucket
+func (l *rateLimiter) secondsFor(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate() * float64(time.Second))
+}
+
+// key returns the client the request counts against
+func (l *rateLimiter) key(r *http.Request) string {
+	switch l.spec.Key {
+	case rateLimitByForwardedFor:
+		// The config makes sure trusted proxies are set, so the client is
+		// the one they forwarded the request for and never read from
+		// headers the client set itself
+		return clientIP(r)
+	case rateLimitByJWTSubject:
+		// Requests without a valid token count against their client
+		if subject := jwtSubject(r, l.jwtSecret); subject != "" {
+			return "sub:" + subject
+		}
+		return clientIP(r)
+	}
+	// Every request from a proxy in front counts against the proxy
+	return peerIP(r.RemoteAddr)
+}
+
+// allow takes a token for the request and sets the RateLimit headers on the
+// response. It replies with 429 and returns false if the client is over its
+// limit.
+func (l *rateLimiter) allow(w http.ResponseWriter, r *http.Request) bool {
+	result := l.take(l.key(r))
+
+	header := w.Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(l.spec.Burst))
+	header.Set("RateLimit-Remaining", strconv.Itoa(result.remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.reset)))
+	header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", l.spec.Requests, ceilSeconds(l.spec.Per)))
+	if result.allowed {
+		return true
+	}
+
+	header.Set("Retry-After", strconv.Itoa(max(ceilSeconds(result.retryAfter), 1)))
+	writeJSONError(w, http.StatusTooManyRequests, "Too many requests, try again later.")
+	return false
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// clientIP returns the address of the client, which is the peer connected to
+// the load balancer unless that is a trusted proxy forwarding for another
+func clientIP(r *http.Request) string {
+	if c, ok := r.Context().Value(clientKey{}).(client); ok {
+		return c.ip
+	}
+	return peerIP(r.RemoteAddr)
+}
+
+// jwtSubject returns the sub claim of the bearer token of the request, or an
+// empty string unless the token was signed by OmniAuth with the secret and
+// has not expired. Tokens are checked the same way as auth.IsValidToken.
+func jwtSubject(r *http.Request, secret []byte) string {
+	scheme, tokenString, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || len(secret) == 0 {
+		return ""
+	}
+
+	claims := &jwt.RegisteredClaims{}
+	token, err := jwt.ParseWithClaims(
+		tokenString,
+		claims,
+		func(token *jwt.Token) (interface{}, error) {
+			return secret, nil
+		},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil || !token.Valid {
+		return ""
+	}
+	return claims.Subject
+}
@@ -0,0 +1,171 @@
+package loadbalancer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func newTestRateLimiter(spec RateLimit) (*rateLimiter, *time.Time) {
+	now := time.Now()
+	limiter := newRateLimiter(spec)
+	limiter.now = func() time.Time { return now }
+	return limiter, &now
+}
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	limiter, now := newTestRateLimiter(RateLimit{Requests: 2, Per: time.Second, Burst: 3})
+
+	for i := 0; i < 3; i++ {
+		if result := limiter.take("client"); !result.allowed || result.remaining != 2-i {
+			t.Fatalf("expected request %d within the burst to be allowed, got %+v", i, result)
+		}
+	}
+
+	result := limiter.take("client")
+	if result.allowed {
+		t.Fatalf("expected request over the burst to be refused")
+	}
+	if result.retryAfter != 500*time.Millisecond {
+		t.Errorf("expected to wait 500ms for a token, got %v", result.retryAfter)
+	}
+	if !limiter.take("other").allowed {
+		t.Errorf("expected other clients to have their own bucket")
+	}
+
+	*now = now.Add(500 * time.Millisecond)
+	if !limiter.take("client").allowed {
+		t.Errorf("expected the bucket to refill over time")
+	}
+}
+
+func TestRateLimiterBoundedKeys(t *testing.T) {
+	limiter, _ := newTestRateLimiter(RateLimit{Requests: 1, MaxKeys: 2})
+
+	limiter.take("a")
+	limiter.take("b")
+	limiter.take("a")
+	limiter.take("c")
+
+	if limiter.lru.Len() != 2 || len(limiter.buckets) != 2 {
+		t.Fatalf("expected 2 buckets, got %d", limiter.lru.Len())
+	}
+	if _, ok := limiter.buckets["b"]; ok {
+		t.Errorf("expected the least recently used bucket to be evicted")
+	}
+}
+
+// signToken returns an Authorization header with a token for the subject,
+// signed with the secret as OmniAuth does
+func signToken(t *testing.T, secret, subject string, expires time.Time) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   subject,
+		ExpiresAt: jwt.NewNumericDate(expires),
+	})
+	signed, err := token.SignedString([]byte(secret))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return "Bearer " + signed
+}
+
+func TestRateLimiterKey(t *testing.T) {
+	t.Setenv("JWT_SECRET", "s3cret")
+	expires := time.Now().Add(time.Hour)
+	token := signToken(t, "s3cret", "user-42", expires)
+	forged := signToken(t, "guessed", "user-43", expires)
+	expired := signToken(t, "s3cret", "user-42", time.Now().Add(-time.Hour))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user-44"}`))
+	unsigned := fmt.Sprintf("Bearer header.%s.signature", payload)
+
+	trusted, _ := parseTrustedProxies([]string{"10.0.0.0/8"})
+
+	cases := []struct {
+		name       string
+		key        string
+		remoteAddr string
+		header     string
+		value      string
+		want       string
+	}{
+		{name: "client ip", key: rateLimitByIP, want: "192.0.2.1"},
+		{name: "client ip behind a trusted proxy", key: rateLimitByIP, remoteAddr: "10.0.0.1:51234", header: XForwardedFor, value: "203.0.113.7", want: "10.0.0.1"},
+		{name: "forwarded for", key: rateLimitByForwardedFor, remoteAddr: "10.0.0.1:51234", header: XForwardedFor, value: "198.51.100.1, 203.0.113.7", want: "203.0.113.7"},
+		{name: "forwarded for by an untrusted peer", key: rateLimitByForwardedFor, header: XForwardedFor, value: "203.0.113.7", want: "192.0.2.1"},
+		{name: "forwarded for missing", key: rateLimitByForwardedFor, want: "192.0.2.1"},
+		{name: "jwt subject", key: rateLimitByJWTSubject, header: "Authorization", value: token, want: "sub:user-42"},
+		{name: "jwt with another secret", key: rateLimitByJWTSubject, header: "Authorization", value: forged, want: "192.0.2.1"},
+		{name: "jwt expired", key: rateLimitByJWTSubject, header: "Authorization", value: expired, want: "192.0.2.1"},
+		{name: "jwt unsigned", key: rateLimitByJWTSubject, header: "Authorization", value: unsigned, want: "192.0.2.1"},
+		{name: "jwt malformed", key: rateLimitByJWTSubject, header: "Authorization", value: "Bearer nonsense", want: "192.0.2.1"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := newRateLimiter(RateLimit{Requests: 1, Key: tt.key})
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.remoteAddr != "" {
+				req.RemoteAddr = tt.remoteAddr
+			}
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+
+			var got string
+			trustForwarded(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = limiter.key(r)
+			}), trusted).ServeHTTP(httptest.NewRecorder(), req)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyRateLimit(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	lb := newTestLoadBalancer(t, Config{
+		Algorithm: "round-robin",
+		Paths: []Route{{
+			Pattern:   "GET /posts",
+			Backends:  []Backend{{Address: backend.URL}},
+			RateLimit: RateLimit{Requests: 2, Per: time.Minute},
+		}},
+	})
+
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		lb.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/posts", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected request %d to be allowed, got %d", i, rr.Code)
+		}
+		if got := rr.Header().Get("RateLimit-Remaining"); got != fmt.Sprint(1-i) {
+			t.Errorf("expected %d remaining, got %s", 1-i, got)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	lb.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/posts", nil))
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d, want %d", rr.Code, http.StatusTooManyRequests)
+	}
+	for header, want := range map[string]string{
+		"Retry-After":         "30",
+		"RateLimit-Limit":     "2",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "60",
+		"RateLimit-Policy":    "2;w=60",
+	} {
+		if got := rr.Header().Get(header); got != want {
+			t.Errorf("expected %s of %s, got %s", header, want, got)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"time"
+)
+
+// Reload applies a new config to the running load balancer. The config is
+// validated first and rejected without touching the running state if it is
+// invalid.
+//
+// Paths whose settings are unchanged keep their proxy, and only their static
+// backends are updated. Paths whose settings changed get a new proxy which
+// carries over the health and ejections of their backends and the backends
+// registered through /addz, in the same group if the path still has it.
+// Backends being drained are left out of the new proxy. Weights of groups
+// changed through /weightz are kept until the settings of the path change.
+// Requests already in flight finish on the mux and proxies they started on.
+// Backends found by DNS discovery are carried over as long as the path still
+// uses discovery.
+func (loadBalancer *LoadBalancer) Reload(config Config) error {
+	if err := config.IsValid(); err != nil {
+		loadBalancer.Logger.Error("rejecting invalid config", slog.Any("error", err))
+		return err
+	}
+
+	// Hold the lock for the whole reload so backends added or removed through
+	// the admin endpoints are not lost part way through
+	loadBalancer.Lock()
+	defer loadBalancer.Unlock()
+
+	oldRoutes := make(map[string]Route)
+	for _, route := range loadBalancer.Config.Routes() {
+		oldRoutes[route.Pattern] = route
+	}
+
+	// Build everything which can fail before changing any running state
+	proxies := make(map[string]*LoadBalancerProxy)
+	var reused []Route
+	for _, route := range config.Routes() {
+		oldProxy, exists := loadBalancer.Proxies[route.Pattern]
+		oldRoute := oldRoutes[route.Pattern]
+
+		if exists && sameSettings(oldRoute, route) {
+			proxies[route.Pattern] = oldProxy
+			reused = append(reused, route)
+			continue
+		}
+
+		proxy, err := newRouteProxy(route, loadBalancer.Logger)
+		if err != nil {
+			loadBalancer.Logger.Error("failed to create new load balancer proxy", slog.String("path", route.Pattern), slog.Any("error", err))
+			return err
+		}
+
+		if exists {
+			staticBackends := backendsByAddress(oldRoute.staticBackends(), route.staticBackends())
+			newStatic := backendsByAddress(route.staticBackends())
+			for _, backend := range oldProxy.backends() {
+				_, static := staticBackends[backend.url.String()]
+				if backend.draining {
+					// The drain finishes on the old proxy, which has the
+					// requests still in flight
+					if static {
+						proxy.Remove(backend.url)
+					}
+					continue
+				}
+				if static {
+					// Static backends the path still has keep their health,
+					// rather than waiting for the checks of the new proxy
+					if _, kept := newStatic[backend.url.String()]; kept {
+						if backend.outlier != nil {
+							proxy.restoreOutlier(backend.url, *backend.outlier)
+						}
+						proxy.setAlive(backend.url, backend.alive)
+					}
+					continue
+				}
+				if backend.discovered {
+					// Kept until the first lookup of the new proxy, which
+					// removes them if they are no longer published
+					if route.Discovery.Name == "" {
+						continue
+					}
+					proxy.markDiscovered(backend.url)
+				}
+				if err := proxy.AddToGroup(backend.url, backend.group, backend.options); err != nil {
+					loadBalancer.Logger.Warn("dropping backend which no longer fits the path",
+						slog.String("path", route.Pattern),
+						slog.String("address", backend.url.String()),
+						slog.Any("error", err),
+					)
+					continue
+				}
+				if backend.outlier != nil {
+					proxy.restoreOutlier(backend.url, *backend.outlier)
+				}
+				proxy.setAlive(backend.url, backend.alive)
+			}
+			loadBalancer.Logger.Info("path updated", slog.String("path", route.Pattern))
+		} else {
+			loadBalancer.Logger.Info("path added", slog.String("path", route.Pattern))
+		}
+		proxies[route.Pattern] = proxy
+	}
+
+	mux, err := loadBalancer.buildMux(proxies)
+	if err != nil {
+		loadBalancer.Logger.Error("failed to register paths", slog.Any("error", err))
+		return err
+	}
+
+	for _, route := range reused {
+		loadBalancer.reconcileBackends(proxies[route.Pattern], oldRoutes[route.Pattern], route)
+	}
+	for path, proxy := range loadBalancer.Proxies {
+		if _, ok := proxies[path]; !ok {
+			loadBalancer.Logger.Info("path removed", slog.String("path", path))
+		}
+		if proxies[path] != proxy {
+			proxy.StopHealthCheck()
+		}
+	}
+	if loadBalancer.healthCtx != nil {
+		for path, proxy := range proxies {
+			if loadBalancer.Proxies[path] != proxy {
+				proxy.StartHealthCheck(loadBalancer.healthCtx)
+			}
+		}
+	}
+
+	loadBalancer.Config = config
+	loadBalancer.Proxies = proxies
+	loadBalancer.mux.Store(mux)
+	loadBalancer.Logger.Info("config reloaded", slog.Int("paths", len(proxies)))
+
+	return nil
+}
+
+// ReloadFromFile reads the config from fileName and reloads it
+func (loadBalancer *LoadBalancer) ReloadFromFile(fileName string) error {
+	config, err := ReadConfig(fileName, loadBalancer.Logger)
+	if err != nil {
+		return err
+	}
+	return loadBalancer.Reload(config)
+}
+
+// reconcileBackends updates the static backends of a running proxy. Backends
+// which were not in the old config, i.e. those added through /addz, are left
+// alone.
+func (loadBalancer *LoadBalancer) reconcileBackends(proxy *LoadBalancerProxy, oldRoute, newRoute Route) {
+	oldBackends := backendsByAddress(oldRoute.Backends)
+	newBackends := backendsByAddress(newRoute.Backends)
+
+	for address, backend := range oldBackends {
+		if _, ok := newBackends[address]; !ok {
+			proxy.Remove(backend.url)
+			loadBalancer.Logger.Info("backend removed", slog.String("path", newRoute.Pattern), slog.String("address", address))
+		}
+	}
+	for address, backend := range newBackends {
+		if old, ok := oldBackends[address]; !ok || old.options != backend.options {
+			proxy.AddWithOptions(backend.url, backend.options)
+			loadBalancer.Logger.Info("backend added", slog.String("path", newRoute.Pattern), slog.String("address", address))
+		}
+	}
+}
+
+// sameSettings reports whether two routes only differ in their backends
+func sameSettings(a, b Route) bool {
+	a.Backends, b.Backends = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// backendsByAddress indexes the backends of one or more routes by their
+// parsed address. Routes must have been validated.
+func backendsByAddress(lists ...[]Backend) map[string]backendSnapshot {
+	backends := make(map[string]backendSnapshot)
+	for _, list := range lists {
+		for _, backend := range list {
+			address, err := parseBackendAddress(backend.Address)
+			if err != nil {
+				continue
+			}
+			backends[address.String()] = backendSnapshot{
+				url:     address,
+				options: backend.options(),
+			}
+		}
+	}
+	return backends
+}
+
+// WatchFile polls fileName every interval and calls onChange when its
+// modification time or size changes, until ctx is cancelled
+func WatchFile(ctx context.Context, fileName string, interval time.Duration, onChange func()) error {
+	last, err := os.Stat(fileName)
+	if err != nil {
+		return fmt.Errorf("failed to watch %s: %w", fileName, err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			info, err := os.Stat(fileName)
+			if err != nil {
+				// The file may be part way through being replaced
+				continue
+			}
+			if !info.ModTime().Equal(last.ModTime()) || info.Size() != last.Size() {
+				last = info
+				onChange()
+			}
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package loadbalancer
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/harrydayexe/Omni/internal/loadbalancer/balancer"
+)
+
+func newTestLoadBalancer(t *testing.T, config Config) *LoadBalancer {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	lb, err := New(config, logger)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, proxy := range lb.Proxies {
+		markAlive(proxy)
+	}
+	return lb
+}
+
+// markAlive puts every backend of the proxy, and of its shadow pool, in the
+// balancer as if it had passed its health checks
+func markAlive(p *LoadBalancerProxy) {
+	for _, backend := range p.backends() {
+		p.setAlive(backend.url, true)
+	}
+	if p.mirror != nil {
+		markAlive(p.mirror)
+	}
+}
+
+func backendAddresses(p *LoadBalancerProxy) map[string]balancer.ServerOptions {
+	addresses := make(map[string]balancer.ServerOptions)
+	for _, backend := range p.backends() {
+		addresses[backend.url.String()] = backend.options
+	}
+	return addresses
+}
+
+func TestReloadRejectsInvalidConfig(t *testing.T) {
+	lb := newTestLoadBalancer(t, Config{Algorithm: "round-robin", Paths: patterns("GET /post/{id}")})
+	proxy := lb.Proxies["GET /post/{id}"]
+	mux := lb.mux.Load()
+
+	cases := []struct {
+		name   string
+		config Config
+	}{
+		{
+			name:   "unknown algorithm",
+			config: Config{Algorithm: "invalid-algorithm", Paths: patterns("GET /posts")},
+		},
+		{
+			name:   "conflicting paths",
+			config: Config{Algorithm: "round-robin", Paths: patterns("GET /post/{id}", "GET /post/{postId}")},
+		},
+		{
+			name:   "path conflicting with a load balancer endpoint",
+			config: Config{Algorithm: "round-robin", Paths: patterns("GET /livez")},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := lb.Reload(c.config); err == nil {
+				t.Fatalf("expected error, got nil")
+			}
+			if len(lb.Proxies) != 1 || lb.Proxies["GET /post/{id}"] != proxy {
+				t.Errorf("expected the running proxies to be unchanged, got %v", lb.Proxies)
+			}
+			if lb.mux.Load() != mux {
+				t.Errorf("expected the running mux to be unchanged")
+			}
+		})
+	}
+}
+
+func TestReloadKeepsDynamicBackends(t *testing.T) {
+	lb := newTestLoadBalancer(t, Config{
+		Algorithm: "round-robin",
+		Paths: []Route{
+			{Pattern: "GET /post/{id}", Backends: []Backend{{Address: "http://static-1:80"}, {Address: "http://static-2:80"}}},
+			{Pattern: "POST /post", Backends: []Backend{{Address: "http://static-3:80"}}},
+		},
+	})
+	lb.Proxies["GET /post/{id}"].AddWithOptions(&url.URL{Scheme: "http", Host: "dynamic-1:80"}, balancer.ServerOptions{Weight: 3})
+	lb.Proxies["POST /post"].Add(&url.URL{Scheme: "http", Host: "dynamic-2:80"})
+	markAlive(lb.Proxies["GET /post/{id}"])
+	readProxy := lb.Proxies["GET /post/{id}"]
+
+	err := lb.Reload(Config{
+		Algorithm: "round-robin",
+		Paths: []Route{
+			// Only the static backends change so the proxy is kept
+			{Pattern: "GET /post/{id}", Backends: []Backend{{Address: "http://static-2:80", Weight: 2}, {Address: "http://static-4:80"}}},
+			// The algorithm changes so a new proxy is built
+			{Pattern: "POST /post", Algorithm: "least-connections", Backends: []Backend{{Address: "http://static-3:80"}}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if lb.Proxies["GET /post/{id}"] != readProxy {
+		t.Errorf("expected the proxy for an unchanged path to be kept")
+	}
+	wantRead := map[string]balancer.ServerOptions{
+		"http://static-2:80":  {Weight: 2},
+		"http://static-4:80":  {Weight: 1},
+		"http://dynamic-1:80": {Weight: 3},
+	}
+	if got := backendAddresses(readProxy); !mapsEqual(got, wantRead) {
+		t.Errorf("got backends %v, want %v", got, wantRead)
+	}
+	// The new static backend waits for its health checks
+	if readProxy.balancer.Len() != 2 {
+		t.Errorf("expected 2 backends in the balancer, got %d", readProxy.balancer.Len())
+	}
+
+	writeProxy := lb.Proxies["POST /post"]
+	if _, ok := writeProxy.balancer.(*balancer.LeastConnectionsBalancer); !ok {
+		t.Errorf("expected a least-connections balancer, got %T", writeProxy.balancer)
+	}
+	wantWrite := map[string]balancer.ServerOptions{
+		"http://static-3:80":  {Weight: 1},
+		"http://dynamic-2:80": {Weight: 1},
+	}
+	if got := backendAddresses(writeProxy); !mapsEqual(got, wantWrite) {
+		t.Errorf("got backends %v, want %v", got, wantWrite)
+	}
+	// The static backend keeps its health, the added one is still waiting
+	if writeProxy.balancer.Len() != 1 || !writeProxy.ReadAliveMap(&url.URL{Scheme: "http", Host: "static-3:80"}) {
+		t.Errorf("expected only the healthy static backend in the balancer, got %d backends", writeProxy.balancer.Len())
+	}
+}
+
+func mapsEqual(a, b map[string]balancer.ServerOptions) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReloadSwapsRoutes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	lb := newTestLoadBalancer(t, Config{
+		Algorithm: "round-robin",
+		Paths:     []Route{{Pattern: "GET /old", Backends: []Backend{{Address: backend.URL}}}},
+	})
+
+	err := lb.Reload(Config{
+		Algorithm: "round-robin",
+		Paths:     []Route{{Pattern: "GET /new", Backends: []Backend{{Address: backend.URL}}}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	markAlive(lb.Proxies["GET /new"])
+
+	rr := httptest.NewRecorder()
+	lb.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/old", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected removed path to return %d, got %d", http.StatusNotFound, rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	lb.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/new", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected added path to return %d, got %d", http.StatusOK, rr.Code)
+	}
+}
+
+func TestReloadKeepsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	lb := newTestLoadBalancer(t, Config{
+		Algorithm: "round-robin",
+		Paths:     []Route{{Pattern: "GET /slow", Backends: []Backend{{Address: backend.URL}}}},
+	})
+
+	done := make(chan int)
+	go func() {
+		rr := httptest.NewRecorder()
+		lb.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/slow", nil))
+		done <- rr.Code
+	}()
+
+	<-started
+	if err := lb.Reload(Config{Algorithm: "round-robin", Paths: patterns("GET /other")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	close(release)
+
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("expected in-flight request to finish with %d, got %d", http.StatusOK, code)
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(fileName, []byte("algorithm: round-robin\n"), 0o644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changed := make(chan struct{}, 1)
+	go WatchFile(ctx, fileName, 10*time.Millisecond, func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+
+	// Give the watcher time to take its first reading
+	time.Sleep(50 * time.Millisecond)
+	if err := os.WriteFile(fileName, []byte("algorithm: least-connections\n"), 0o644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected the change to be noticed")
+	}
+}
+
+func TestWatchFileMissing(t *testing.T) {
+	err := WatchFile(context.Background(), filepath.Join(t.TempDir(), "missing.yaml"), time.Second, func() {})
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+func TestReloadRestartsHealthChecks(t *testing.T) {
+	lb := newTestLoadBalancer(t, Config{Algorithm: "round-robin", Paths: patterns("GET /kept", "GET /changed")})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lb.StartHealthChecks(ctx)
+
+	kept := lb.Proxies["GET /kept"]
+	changed := lb.Proxies["GET /changed"]
+
+	err := lb.Reload(Config{
+		Algorithm: "round-robin",
+		Paths: []Route{
+			{Pattern: "GET /kept"},
+			{Pattern: "GET /changed", Algorithm: "least-connections"},
+			{Pattern: "GET /added"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	running := func(p *LoadBalancerProxy) bool {
+		p.RLock()
+		defer p.RUnlock()
+		return p.stopHealthCheck != nil
+	}
+
+	if !running(kept) {
+		t.Errorf("expected the kept proxy to still be health checked")
+	}
+	if running(changed) {
+		t.Errorf("expected the replaced proxy to stop being health checked")
+	}
+	if !running(lb.Proxies["GET /changed"]) || !running(lb.Proxies["GET /added"]) {
+		t.Errorf("expected the new proxies to be health checked")
+	}
+}
+
+func TestReloadKeepsDrainingAndEjectedBackendsOut(t *testing.T) {
+	lb := newTestLoadBalancer(t, Config{
+		Algorithm: "round-robin",
+		Paths: []Route{{
+			Pattern:          "GET /post/{id}",
+			OutlierDetection: OutlierDetection{ConsecutiveErrors: 1, BaseEjectionTime: time.Hour},
+			Backends:         []Backend{{Address: "http://static-1:80"}, {Address: "http://static-2:80"}},
+		}},
+	})
+	oldProxy := lb.Proxies["GET /post/{id}"]
+	draining := &url.URL{Scheme: "http", Host: "static-1:80"}
+	ejected := &url.URL{Scheme: "http", Host: "dynamic-1:80"}
+	oldProxy.Add(ejected)
+	markAlive(oldProxy)
+
+	// A request still in flight keeps the drain going
+	oldProxy.statsMap[draining.Host].inFlight.Add(1)
+	defer oldProxy.statsMap[draining.Host].inFlight.Add(-1)
+	if !oldProxy.Drain(draining, time.Minute) {
+		t.Fatalf("expected the backend to be drained")
+	}
+	oldProxy.recordResult(ejected, http.StatusBadGateway)
+	if oldProxy.balancer.Len() != 1 {
+		t.Fatalf("expected only one backend in the balancer before the reload, got %d", oldProxy.balancer.Len())
+	}
+
+	// The timeout changes so a new proxy is built
+	err := lb.Reload(Config{
+		Algorithm: "round-robin",
+		Paths: []Route{{
+			Pattern:          "GET /post/{id}",
+			Timeout:          time.Second,
+			OutlierDetection: OutlierDetection{ConsecutiveErrors: 1, BaseEjectionTime: time.Hour},
+			Backends:         []Backend{{Address: "http://static-1:80"}, {Address: "http://static-2:80"}},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	newProxy := lb.Proxies["GET /post/{id}"]
+	if newProxy == oldProxy {
+		t.Fatalf("expected a new proxy")
+	}
+	want := map[string]balancer.ServerOptions{
+		"http://static-2:80":  {Weight: 1},
+		"http://dynamic-1:80": {Weight: 1},
+	}
+	if got := backendAddresses(newProxy); !mapsEqual(got, want) {
+		t.Errorf("got backends %v, want %v", got, want)
+	}
+	if newProxy.balancer.Len() != 1 {
+		t.Errorf("expected the draining and ejected backends to stay out of the balancer, got %d backends", newProxy.balancer.Len())
+	}
+	if state, _ := newProxy.readOutlierMap(ejected); !state.isEjected() {
+		t.Errorf("expected the ejection to be carried over, got %+v", state)
+	}
+}
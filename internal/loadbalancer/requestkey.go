@@ -0,0 +1,72 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// A requestKey describes which part of a request is used as the key for key
+// based balancers. It is written in the config as "<source>:<name>", e.g.
+//
+//	header:X-Omni-User
+//	cookie:auth_token
+//	path:id
+type requestKey struct {
+	source string
+	name   string
+}
+
+func parseRequestKey(s string) (*requestKey, error) {
+	source, name, found := strings.Cut(s, ":")
+	if !found || name == "" {
+		return nil, fmt.Errorf("hash key %q must be of the form <source>:<name>", s)
+	}
+
+	switch source {
+	case "header":
+		name = http.CanonicalHeaderKey(name)
+	case "cookie", "path":
+	default:
+		return nil, fmt.Errorf("hash key source %q is unknown, expected header, cookie or path", source)
+	}
+
+	return &requestKey{source: source, name: name}, nil
+}
+
+// validFor checks that a path key names a wildcard of the pattern, otherwise
+// every request would be missing the key
+func (k *requestKey) validFor(p *pattern) error {
+	if k.source != "path" {
+		return nil
+	}
+	for _, seg := range p.segments {
+		if seg.wild && seg.s == k.name {
+			return nil
+		}
+	}
+	return errors.New("path wildcard {" + k.name + "} is not part of the pattern")
+}
+
+// extract returns the key for the request, or the empty string if the
+// request does not carry it
+func (k *requestKey) extract(r *http.Request) string {
+	switch k.source {
+	case "header":
+		return r.Header.Get(k.name)
+	case "cookie":
+		cookie, err := r.Cookie(k.name)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	case "path":
+		return r.PathValue(k.name)
+	}
+	return ""
+}
+
+func (k *requestKey) String() string {
+	return k.source + ":" + k.name
+}
@@ -0,0 +1,141 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRequestKey(t *testing.T) {
+	cases := []struct {
+		name          string
+		key           string
+		want          requestKey
+		expectedError bool
+	}{
+		{
+			name: "header",
+			key:  "header:x-omni-user",
+			want: requestKey{source: "header", name: "X-Omni-User"},
+		},
+		{
+			name: "cookie",
+			key:  "cookie:auth_token",
+			want: requestKey{source: "cookie", name: "auth_token"},
+		},
+		{
+			name: "path",
+			key:  "path:id",
+			want: requestKey{source: "path", name: "id"},
+		},
+		{
+			name:          "missing name",
+			key:           "header:",
+			expectedError: true,
+		},
+		{
+			name:          "missing separator",
+			key:           "auth_token",
+			expectedError: true,
+		},
+		{
+			name:          "unknown source",
+			key:           "query:id",
+			expectedError: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := parseRequestKey(c.key)
+			if c.expectedError {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if *got != c.want {
+				t.Errorf("got %v, want %v", *got, c.want)
+			}
+		})
+	}
+}
+
+func TestRequestKeyValidFor(t *testing.T) {
+	pat, err := parsePattern("GET /post/{id}")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := (&requestKey{source: "path", name: "id"}).validFor(pat); err != nil {
+		t.Errorf("expected {id} to be valid, got %v", err)
+	}
+	if err := (&requestKey{source: "path", name: "userId"}).validFor(pat); err == nil {
+		t.Errorf("expected {userId} to be invalid")
+	}
+	if err := (&requestKey{source: "cookie", name: "auth_token"}).validFor(pat); err != nil {
+		t.Errorf("expected cookie key to be valid for any pattern, got %v", err)
+	}
+}
+
+func TestRequestKeyExtract(t *testing.T) {
+	cases := []struct {
+		name    string
+		key     requestKey
+		prepare func(r *http.Request)
+		want    string
+	}{
+		{
+			name:    "header present",
+			key:     requestKey{source: "header", name: "X-Omni-User"},
+			prepare: func(r *http.Request) { r.Header.Set("X-Omni-User", "42") },
+			want:    "42",
+		},
+		{
+			name:    "header missing",
+			key:     requestKey{source: "header", name: "X-Omni-User"},
+			prepare: func(r *http.Request) {},
+			want:    "",
+		},
+		{
+			name:    "cookie present",
+			key:     requestKey{source: "cookie", name: "auth_token"},
+			prepare: func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "auth_token", Value: "abc"}) },
+			want:    "abc",
+		},
+		{
+			name:    "cookie missing",
+			key:     requestKey{source: "cookie", name: "auth_token"},
+			prepare: func(r *http.Request) {},
+			want:    "",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/post/1", nil)
+			c.prepare(req)
+			if got := c.key.extract(req); got != c.want {
+				t.Errorf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestRequestKeyExtractPath(t *testing.T) {
+	key := &requestKey{source: "path", name: "id"}
+
+	var got string
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /post/{id}", func(w http.ResponseWriter, r *http.Request) {
+		got = key.extract(r)
+	})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/post/1234", nil))
+
+	if got != "1234" {
+		t.Errorf("got %q, want %q", got, "1234")
+	}
+}
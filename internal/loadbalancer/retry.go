@@ -0,0 +1,101 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+var IdempotencyKey = http.CanonicalHeaderKey("Idempotency-Key")
+
+// Requests with larger bodies are sent to the backend as they are read rather
+// than buffered, and so are never retried
+const maxRetryBodySize = 1 << 20
+
+// The number of retries always allowed in flight, so that the budget does not
+// stop retries on a quiet route
+const minRetryConcurrency = 3
+
+// An attempt is one try of a request against a backend. It is stored in the
+// request context so the error handler can hand a failure back to ServeHTTP
+// to retry instead of replying to the client.
+type attempt struct {
+	parent   context.Context // Context of the whole request, not just this try
+	canRetry bool
+	err      error       // Set by the error handler when the try should be retried
+	stream   streamWatch // Hands back what the try holds if the response is a stream
+}
+
+type attemptKey struct{}
+
+// retryable reports whether a failed try can be retried on another backend.
+// Only failures where the backend cannot have handled the request count: the
+// connection was refused or reset before the response headers, or the try
+// ran out of time while the request as a whole did not.
+func (a *attempt) retryable(err error) bool {
+	if !a.canRetry || a.parent.Err() != nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isIdempotent reports whether a request can safely be sent more than once
+func isIdempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	case http.MethodPost:
+		return r.Header.Get(IdempotencyKey) != ""
+	}
+	return false
+}
+
+// bufferBody reads the request body so it can be sent again on a retry or to
+// the shadow pool of a mirrored route. It returns false if the body is too
+// large to buffer, in which case the body is left readable from the start.
+func bufferBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRetryBodySize+1))
+	if err != nil || len(body) > maxRetryBodySize {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false
+	}
+	return body, true
+}
+
+// allowRetry takes a retry from the budget if there is one left. The retry
+// must be released with releaseRetry once it is finished.
+func (p *LoadBalancerProxy) allowRetry() bool {
+	budget := p.retrySpec.withDefaults().Budget
+	limit := max(int64(minRetryConcurrency), p.inFlight.Load()*int64(budget)/100)
+	if p.retriesInFlight.Add(1) > limit {
+		p.retriesInFlight.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (p *LoadBalancerProxy) releaseRetry() {
+	p.retriesInFlight.Add(-1)
+}
@@ -0,0 +1,184 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newRetryTestProxy creates a round robin proxy with a backend which refuses
+// connections followed by one which echoes the request body
+func newRetryTestProxy(t *testing.T, retry Retry) *LoadBalancerProxy {
+	t.Helper()
+
+	refused := httptest.NewServer(http.NotFoundHandler())
+	refusedURL, _ := url.Parse(refused.URL)
+	refused.Close()
+
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	t.Cleanup(working.Close)
+	workingURL, _ := url.Parse(working.URL)
+
+	proxy, err := newRouteProxy(Route{
+		Pattern:          "/",
+		Algorithm:        "round-robin",
+		Retry:            retry,
+		OutlierDetection: OutlierDetection{Disabled: true},
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	proxy.Add(refusedURL)
+	proxy.Add(workingURL)
+	markAlive(proxy)
+	return proxy
+}
+
+func TestProxyRetriesRefusedConnection(t *testing.T) {
+	proxy := newRetryTestProxy(t, Retry{})
+
+	for i := 0; i < 4; i++ {
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodPut, "/", strings.NewReader("hello")))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected retry to reach the working backend, got %d", rr.Code)
+		}
+		if rr.Body.String() != "hello" {
+			t.Fatalf("expected body to be sent again on retry, got %q", rr.Body.String())
+		}
+	}
+}
+
+func TestProxyRetriesPostOnlyWithIdempotencyKey(t *testing.T) {
+	proxy := newRetryTestProxy(t, Retry{})
+
+	codes := make(map[int]int)
+	for i := 0; i < 4; i++ {
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello")))
+		codes[rr.Code]++
+	}
+	if codes[http.StatusBadGateway] != 2 {
+		t.Errorf("expected POSTs without a key not to be retried, got %v", codes)
+	}
+
+	for i := 0; i < 4; i++ {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello"))
+		req.Header.Set(IdempotencyKey, "abc")
+		proxy.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected POST with a key to be retried, got %d", rr.Code)
+		}
+	}
+}
+
+func TestProxyRetryDisabled(t *testing.T) {
+	proxy := newRetryTestProxy(t, Retry{Attempts: 1})
+
+	codes := make(map[int]int)
+	for i := 0; i < 4; i++ {
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+		codes[rr.Code]++
+	}
+	if codes[http.StatusBadGateway] != 2 {
+		t.Errorf("expected no retries with one attempt, got %v", codes)
+	}
+}
+
+func TestProxyRetriesPerTryTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer fast.Close()
+
+	proxy, err := newRouteProxy(Route{
+		Pattern:   "/",
+		Algorithm: "round-robin",
+		Retry:     Retry{PerTryTimeout: 50 * time.Millisecond},
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	slowURL, _ := url.Parse(slow.URL)
+	fastURL, _ := url.Parse(fast.URL)
+	proxy.Add(slowURL)
+	proxy.Add(fastURL)
+	markAlive(proxy)
+
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected try which timed out to be retried, got %d", rr.Code)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	proxy, err := NewLoadBalancerProxy("round-robin")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i := 0; i < minRetryConcurrency; i++ {
+		if !proxy.allowRetry() {
+			t.Fatalf("expected retry %d to be allowed", i)
+		}
+	}
+	if proxy.allowRetry() {
+		t.Fatalf("expected retry over the budget to be refused")
+	}
+
+	proxy.releaseRetry()
+	if !proxy.allowRetry() {
+		t.Fatalf("expected released retry to be allowed again")
+	}
+
+	// The budget grows with the requests in flight
+	proxy.inFlight.Store(100)
+	for i := minRetryConcurrency; i < 20; i++ {
+		if !proxy.allowRetry() {
+			t.Fatalf("expected retry %d to be within 20%% of 100 requests", i)
+		}
+	}
+	if proxy.allowRetry() {
+		t.Fatalf("expected retry over 20%% of requests to be refused")
+	}
+}
+
+func TestIsIdempotent(t *testing.T) {
+	var cases = []struct {
+		method string
+		key    string
+		want   bool
+	}{
+		{http.MethodGet, "", true},
+		{http.MethodHead, "", true},
+		{http.MethodPut, "", true},
+		{http.MethodDelete, "", true},
+		{http.MethodPost, "", false},
+		{http.MethodPost, "abc", true},
+		{http.MethodPatch, "", false},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, "/", nil)
+		if c.key != "" {
+			req.Header.Set(IdempotencyKey, c.key)
+		}
+		if got := isIdempotent(req); got != c.want {
+			t.Errorf("%s with key %q: got %v, want %v", c.method, c.key, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// rewriteURL strips and adds the path prefixes of the rules. A prefix is only
+// stripped at a segment boundary, so /api/read does not match /api/readers.
+func (rw *Rewrite) rewriteURL(u *url.URL) {
+	if rw.StripPrefix == "" && rw.AddPrefix == "" {
+		return
+	}
+	u.Path = rw.rewritePath(u.Path)
+	if u.RawPath != "" {
+		u.RawPath = rw.rewritePath(u.RawPath)
+	}
+}
+
+func (rw *Rewrite) rewritePath(path string) string {
+	if strip := strings.TrimSuffix(rw.StripPrefix, "/"); strip != "" {
+		if path == strip {
+			path = "/"
+		} else if rest, ok := strings.CutPrefix(path, strip+"/"); ok {
+			path = "/" + rest
+		}
+	}
+	if add := strings.TrimSuffix(rw.AddPrefix, "/"); add != "" {
+		path = add + path
+	}
+	return path
+}
+
+// modifyResponse applies the response header rules to a backend response
+func (rw *Rewrite) modifyResponse(resp *http.Response) error {
+	rw.ResponseHeaders.apply(resp.Header)
+	return nil
+}
+
+// apply removes, sets and then appends to the headers
+func (h *HeaderRules) apply(header http.Header) {
+	for _, name := range h.Remove {
+		header.Del(name)
+	}
+	for name, value := range h.Set {
+		header.Set(name, value)
+	}
+	for name, value := range h.Append {
+		header.Add(name, value)
+	}
+}
@@ -0,0 +1,94 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRewritePath(t *testing.T) {
+	cases := []struct {
+		name    string
+		rewrite Rewrite
+		path    string
+		want    string
+	}{
+		{name: "strip prefix", rewrite: Rewrite{StripPrefix: "/api/read"}, path: "/api/read/post/1", want: "/post/1"},
+		{name: "strip whole path", rewrite: Rewrite{StripPrefix: "/api/read/"}, path: "/api/read", want: "/"},
+		{name: "strip only at a segment boundary", rewrite: Rewrite{StripPrefix: "/api/read"}, path: "/api/readers", want: "/api/readers"},
+		{name: "add prefix", rewrite: Rewrite{AddPrefix: "/v2"}, path: "/post/1", want: "/v2/post/1"},
+		{name: "strip and add", rewrite: Rewrite{StripPrefix: "/api", AddPrefix: "/internal/"}, path: "/api/post", want: "/internal/post"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rewrite.rewritePath(tt.path); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyAppliesRewriteRules(t *testing.T) {
+	var got *http.Request
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Header().Set(XProxy, "omniread")
+		w.Header().Set("X-Internal-Id", "42")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	proxy, err := newRouteProxy(Route{
+		Pattern:   "GET /api/read/",
+		Algorithm: "round-robin",
+		Rewrite: Rewrite{
+			StripPrefix: "/api/read",
+			Host:        "omniread.internal",
+			RequestHeaders: HeaderRules{
+				Set:    map[string]string{"X-Gateway": "public"},
+				Append: map[string]string{"Via": "omni"},
+				Remove: []string{"Cookie"},
+			},
+			ResponseHeaders: HeaderRules{
+				Set:    map[string]string{"Cache-Control": "no-store"},
+				Remove: []string{XProxy, "X-Internal-Id"},
+			},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	backendURL, _ := url.Parse(backend.URL)
+	proxy.Add(backendURL)
+	markAlive(proxy)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/read/post/1?full=true", nil)
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("Via", "1.1 cdn")
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected the request to be proxied, got %d", rr.Code)
+	}
+	if got.URL.Path != "/post/1" || got.URL.RawQuery != "full=true" {
+		t.Errorf("expected the prefix to be stripped, got %s", got.URL.RequestURI())
+	}
+	if got.Host != "omniread.internal" {
+		t.Errorf("expected the host to be rewritten, got %s", got.Host)
+	}
+	if got.Header.Get("X-Gateway") != "public" || len(got.Header.Values("Via")) != 2 || got.Header.Get("Cookie") != "" {
+		t.Errorf("expected the request header rules to be applied, got %v", got.Header)
+	}
+	if got.Header.Get(XProxy) != ReverseProxy {
+		t.Errorf("expected the load balancer headers to be kept, got %v", got.Header)
+	}
+	if rr.Header().Get(XProxy) != "" || rr.Header().Get("X-Internal-Id") != "" {
+		t.Errorf("expected internal headers to be removed from the response, got %v", rr.Header())
+	}
+	if rr.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("expected the response header to be set, got %v", rr.Header())
+	}
+}
@@ -0,0 +1,177 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// NewHTTPServer creates the server for user traffic from the server config,
+// with TLS if a certificate is configured. The certificate is read straight
+// away, and reloaded when it changes once Watch is called on the returned
+// CertReloader, which is nil without TLS. The server should be served on a
+// listener from Listen.
+func (s *Server) NewHTTPServer(handler http.Handler, logger *slog.Logger) (*http.Server, *CertReloader, error) {
+	spec := s.withDefaults()
+
+	trusted, err := parseTrustedProxies(spec.TrustedProxies)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(trusted) > 0 {
+		handler = trustForwarded(handler, trusted)
+	}
+
+	server := &http.Server{
+		Addr:              spec.Address,
+		Handler:           handler,
+		ReadHeaderTimeout: spec.ReadHeaderTimeout,
+		ReadTimeout:       spec.ReadTimeout,
+		WriteTimeout:      spec.WriteTimeout,
+		IdleTimeout:       spec.IdleTimeout,
+	}
+	if spec.TLS.CertFile == "" {
+		return server, nil, nil
+	}
+
+	minVersion, err := parseTLSVersion(spec.TLS.MinVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	certs, err := NewCertReloader(spec.TLS.CertFile, spec.TLS.KeyFile, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	server.TLSConfig = &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: certs.GetCertificate,
+	}
+	if spec.TLS.DisableHTTP2 {
+		// A non-nil map stops the server from configuring HTTP/2
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
+	return server, certs, nil
+}
+
+// Listen listens for user traffic on address. With the PROXY protocol on, the
+// connections report the address of the client the proxy in front gave.
+func (s *Server) Listen(address string) (net.Listener, error) {
+	spec := s.withDefaults()
+
+	trusted, err := parseTrustedProxies(spec.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if !spec.ProxyProtocol {
+		return listener, nil
+	}
+	return &proxyProtocolListener{Listener: listener, trusted: trusted, timeout: spec.ReadHeaderTimeout}, nil
+}
+
+// NewRedirectServer creates the server which redirects plain HTTP requests to
+// HTTPS, or returns nil if no redirect address is configured
+func (s *Server) NewRedirectServer() *http.Server {
+	spec := s.withDefaults()
+	if spec.TLS.CertFile == "" || spec.TLS.RedirectAddress == "" {
+		return nil
+	}
+
+	return &http.Server{
+		Addr:              spec.TLS.RedirectAddress,
+		Handler:           RedirectToHTTPS(spec.Address),
+		ReadHeaderTimeout: spec.ReadHeaderTimeout,
+		ReadTimeout:       spec.ReadTimeout,
+		IdleTimeout:       spec.IdleTimeout,
+	}
+}
+
+// RedirectToHTTPS redirects every request to the same URL over HTTPS on the
+// port of tlsAddress. The method and body are kept by using 308.
+func RedirectToHTTPS(tlsAddress string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddress)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("tls version %s is not supported, expected 1.2 or 1.3", version)
+}
+
+// A CertReloader serves a certificate and key pair from disk, reloading them
+// when the files change so certificates can be renewed without a restart
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	logger   *slog.Logger
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+func NewCertReloader(certFile, keyFile string, logger *slog.Logger) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile, logger: logger}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the certificate and key again. The current certificate is kept
+// if they cannot be loaded.
+func (c *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	c.cert.Store(&cert)
+	return nil
+}
+
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// Watch reloads the certificate whenever the cert or key file changes, until
+// ctx is cancelled
+func (c *CertReloader) Watch(ctx context.Context, interval time.Duration) {
+	reload := func() {
+		if err := c.Reload(); err != nil {
+			// The key and certificate are often replaced one after the
+			// other, the next change will load the matching pair
+			c.logger.Error("Could not reload certificate", slog.String("certFile", c.certFile), slog.Any("error", err))
+			return
+		}
+		c.logger.Info("Reloaded certificate", slog.String("certFile", c.certFile))
+	}
+
+	for _, file := range []string{c.certFile, c.keyFile} {
+		go func(file string) {
+			if err := WatchFile(ctx, file, interval, reload); err != nil {
+				c.logger.Error("Could not watch certificate", slog.String("file", file), slog.Any("error", err))
+			}
+		}(file)
+	}
+}
@@ -0,0 +1,181 @@
+package loadbalancer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and its
+// key to dir
+func writeTestCertificate(t *testing.T, dir, commonName string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestNewHTTPServerDefaults(t *testing.T) {
+	server, certs, err := (&Server{}).NewHTTPServer(http.NotFoundHandler(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if certs != nil || server.TLSConfig != nil {
+		t.Errorf("expected no TLS without a certificate")
+	}
+	if server.Addr != ":80" || server.ReadHeaderTimeout != 10*time.Second || server.IdleTimeout != 2*time.Minute {
+		t.Errorf("expected default address and timeouts, got %s, %v and %v", server.Addr, server.ReadHeaderTimeout, server.IdleTimeout)
+	}
+}
+
+func TestNewHTTPServerTLS(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir(), "omni")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	config := Server{TLS: ServerTLS{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.3"}}
+	server, certs, err := config.NewHTTPServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}), logger)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if server.Addr != ":443" || certs == nil {
+		t.Fatalf("expected a TLS server on :443, got %s", server.Addr)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get("https://" + listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2, got %s", resp.Proto)
+	}
+	if resp.TLS.Version != tls.VersionTLS13 {
+		t.Errorf("expected TLS 1.3, got %x", resp.TLS.Version)
+	}
+
+	tls12 := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12},
+	}}
+	if _, err := tls12.Get("https://" + listener.Addr().String()); err == nil {
+		t.Errorf("expected TLS 1.2 to be refused")
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "first")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	certs, err := NewCertReloader(certFile, keyFile, logger)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	commonName := func() string {
+		cert, _ := certs.GetCertificate(nil)
+		parsed, _ := x509.ParseCertificate(cert.Certificate[0])
+		return parsed.Subject.CommonName
+	}
+	if got := commonName(); got != "first" {
+		t.Fatalf("expected the first certificate, got %s", got)
+	}
+
+	writeTestCertificate(t, dir, "second")
+	if err := certs.Reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := commonName(); got != "second" {
+		t.Errorf("expected the renewed certificate, got %s", got)
+	}
+
+	// A broken file keeps the current certificate
+	os.WriteFile(certFile, []byte("not a certificate"), 0o600)
+	if err := certs.Reload(); err == nil {
+		t.Errorf("expected an error reloading a broken certificate")
+	}
+	if got := commonName(); got != "second" {
+		t.Errorf("expected the current certificate to be kept, got %s", got)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	cases := []struct {
+		name    string
+		address string
+		target  string
+		want    string
+	}{
+		{name: "default port", address: ":443", target: "http://omni.example/posts?page=2", want: "https://omni.example/posts?page=2"},
+		{name: "custom port", address: ":8443", target: "http://omni.example:8080/posts", want: "https://omni.example:8443/posts"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			RedirectToHTTPS(tt.address).ServeHTTP(rr, httptest.NewRequest(http.MethodPost, tt.target, nil))
+
+			if rr.Code != http.StatusPermanentRedirect {
+				t.Errorf("got %d, want %d", rr.Code, http.StatusPermanentRedirect)
+			}
+			if got := rr.Header().Get("Location"); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// isStreaming reports whether a request asks for a long-lived stream, either
+// a protocol upgrade such as a WebSocket or a server-sent event stream. As the
+// client chooses its headers, this only decides what is safe to skip, such as
+// mirroring, never what the request is exempt from.
+func isStreaming(r *http.Request) bool {
+	return isUpgrade(r) || acceptsEventStream(r)
+}
+
+// isUpgrade reports whether the request asks to switch protocols
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptsEventStream reports whether the request is for server-sent events,
+// which browsers ask for with Accept: text/event-stream
+func acceptsEventStream(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(value, ",") {
+			mediaType, _, err := mime.ParseMediaType(mediaRange)
+			if err == nil && mediaType == "text/event-stream" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isStreamResponse reports whether the backend answered with a long-lived
+// stream, by switching protocols or sending a server-sent event stream
+func isStreamResponse(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// allowStream clears the server's read and write deadlines on the connection
+// of a stream, which would otherwise cut it off after the server timeouts.
+// Writers which cannot set deadlines, such as in tests, are left alone.
+func allowStream(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+}
+
+type streamKey struct{}
+
+// A streamWatch runs the functions given to onStart if the response turns
+// out to be a stream, which hand back the timeouts and concurrency slots the
+// request holds. It is only used from the goroutine serving the request.
+type streamWatch struct {
+	started bool
+	funcs   []func()
+}
+
+// onStart calls f when the stream starts
+func (s *streamWatch) onStart(f func()) {
+	s.funcs = append(s.funcs, f)
+}
+
+func (s *streamWatch) start() {
+	if s.started {
+		return
+	}
+	s.started = true
+	for _, f := range s.funcs {
+		f()
+	}
+}
+
+// startStream is called with every response from a backend. If the route
+// allows streams and the response is one, the try and the request it is part
+// of stop counting against the timeouts and concurrency limits of the route.
+func (p *LoadBalancerProxy) startStream(resp *http.Response) {
+	if !p.streaming || !isStreamResponse(resp) {
+		return
+	}
+	ctx := resp.Request.Context()
+	if a, ok := ctx.Value(attemptKey{}).(*attempt); ok {
+		a.stream.start()
+	}
+	if watch, ok := ctx.Value(streamKey{}).(*streamWatch); ok {
+		watch.start()
+	}
+}
+
+// withTimeout is like context.WithTimeout, except the timeout can be stopped
+// by calling stop, such as when the request turns into a stream. When it runs
+// out the context is cancelled with context.DeadlineExceeded as the cause,
+// see timeoutCause.
+func withTimeout(parent context.Context, timeout time.Duration) (ctx context.Context, stop func(), cancel context.CancelFunc) {
+	ctx, cancelCause := context.WithCancelCause(parent)
+	timer := time.AfterFunc(timeout, func() { cancelCause(context.DeadlineExceeded) })
+	stop = func() { timer.Stop() }
+	cancel = func() {
+		timer.Stop()
+		cancelCause(context.Canceled)
+	}
+	return ctx, stop, cancel
+}
+
+// timeoutCause returns context.DeadlineExceeded in place of the error the
+// transport returns when a timeout from withTimeout cancelled the request
+func timeoutCause(r *http.Request, err error) error {
+	if errors.Is(err, context.Canceled) && errors.Is(context.Cause(r.Context()), context.DeadlineExceeded) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
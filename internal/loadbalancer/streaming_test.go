@@ -0,0 +1,208 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsStreaming(t *testing.T) {
+	cases := []struct {
+		name   string
+		header http.Header
+		want   bool
+	}{
+		{name: "websocket", header: http.Header{"Connection": {"keep-alive, Upgrade"}, "Upgrade": {"websocket"}}, want: true},
+		{name: "event stream", header: http.Header{"Accept": {"text/html, text/event-stream;q=0.9"}}, want: true},
+		{name: "upgrade without connection", header: http.Header{"Upgrade": {"websocket"}}, want: false},
+		{name: "ordinary request", header: http.Header{"Accept": {"application/json"}}, want: false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header = tt.header
+			if got := isStreaming(r); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newStreamingTestServer serves a route with a short timeout behind a server
+// with short timeouts, which streams must outlast if the route allows them
+func newStreamingTestServer(t *testing.T, backend *httptest.Server, streaming bool) (*httptest.Server, *LoadBalancer) {
+	t.Helper()
+	lb := newTestLoadBalancer(t, Config{
+		Algorithm: "round-robin",
+		Paths: []Route{{
+			Pattern:       "GET /live",
+			Timeout:       100 * time.Millisecond,
+			FlushInterval: -1,
+			Streaming:     streaming,
+			Backends:      []Backend{{Address: backend.URL}},
+		}},
+	})
+
+	server := httptest.NewUnstartedServer(lb)
+	server.Config.ReadTimeout = 200 * time.Millisecond
+	server.Config.WriteTimeout = 200 * time.Millisecond
+	server.Start()
+	return server, lb
+}
+
+func TestEventStreamOutlastsTimeouts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 5; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+	server, lb := newStreamingTestServer(t, backend, true)
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/live", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	first, _ := reader.ReadString('\n')
+	if first != "data: 0\n" {
+		t.Fatalf("expected the first event straight away, got %q", first)
+	}
+	proxy := lb.Proxies["GET /live"]
+	if proxy.streams.Load() != 1 || proxy.inFlight.Load() != 0 {
+		t.Errorf("expected the stream to be counted apart from requests, got %d streams and %d requests", proxy.streams.Load(), proxy.inFlight.Load())
+	}
+
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("expected the stream to outlast the timeouts, got %v", err)
+	}
+	if !strings.HasSuffix(string(rest), "data: 4\n\n") {
+		t.Errorf("expected every event, got %q", rest)
+	}
+}
+
+func TestWebSocketOutlastsTimeouts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		brw.Flush()
+		// Echo lines until the client goes away
+		for {
+			line, err := brw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			brw.WriteString(line)
+			brw.Flush()
+		}
+	}))
+	defer backend.Close()
+	server, lb := newStreamingTestServer(t, backend, true)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET /live HTTP/1.1\r\nHost: omni.example\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(150 * time.Millisecond)
+		fmt.Fprintf(conn, "ping %d\n", i)
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("expected the connection to outlast the timeouts, got %v", err)
+		}
+		if line != fmt.Sprintf("ping %d\n", i) {
+			t.Fatalf("unexpected echo %q", line)
+		}
+	}
+	if streams := lb.Proxies["GET /live"].streams.Load(); streams != 1 {
+		t.Errorf("expected one open stream, got %d", streams)
+	}
+}
+
+func TestStreamingHeadersDoNotEscapeTimeouts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		io.WriteString(w, `{"ok":true}`)
+	}))
+	defer backend.Close()
+	server, _ := newStreamingTestServer(t, backend, true)
+	defer server.Close()
+
+	// Asking for a stream does not make an ordinary response one
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/live", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "x")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("got %d, want %d", resp.StatusCode, http.StatusGatewayTimeout)
+	}
+}
+
+func TestEventStreamNeedsStreamingRoute(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 5; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+	server, lb := newStreamingTestServer(t, backend, false)
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/live", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	rest, _ := io.ReadAll(resp.Body)
+	if strings.HasSuffix(string(rest), "data: 4\n\n") {
+		t.Errorf("expected the route timeout to cut the stream short, got %q", rest)
+	}
+	if streams := lb.Proxies["GET /live"].streams.Load(); streams != 0 {
+		t.Errorf("expected no streams, got %d", streams)
+	}
+}